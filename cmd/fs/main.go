@@ -1,10 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/allim132/filesystem/internal/cli"
 )
 
 func main() {
     cli := cli.NewCLI()
+    if len(os.Args) > 1 {
+        os.Exit(cli.Exec(os.Args[1:]))
+    }
     cli.Run()
 }
\ No newline at end of file
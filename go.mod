@@ -1,3 +1,5 @@
 module github.com/allim132/filesystem
 
 go 1.23.3
+
+require golang.org/x/crypto v0.41.0
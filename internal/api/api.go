@@ -0,0 +1,242 @@
+// Package api serves a disk image to other programs over HTTP with JSON
+// bodies, mirroring the exported file system operations:
+//
+//	GET    /v1/files               list every file
+//	GET    /v1/files/{name}        download a file's contents
+//	PUT    /v1/files/{name}        upload a file's contents (?mode=, ?owner=)
+//	DELETE /v1/files/{name}        remove a file
+//	GET    /v1/stat/{name}         describe a file
+//	POST   /v1/rename              rename a file, {"from": ..., "to": ...}
+//	GET    /v1/df                  report free blocks and names
+//
+// An upload answers 201 Created for a new file and 200 OK for a replaced one.
+// With mode=noclobber an existing file is kept and the upload answers 412
+// Precondition Failed.
+//
+// Contents are streamed as application/octet-stream. Every other response is
+// a JSON object; failures are {"error": {"code": ..., "message": ...}} where
+// code is filesystem.ErrorCode of the error.
+//
+// The API has no authentication, so only serve it on a loopback address or a
+// Unix socket.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/httperr"
+)
+
+// File describes a stored file
+type File struct {
+	Name     string    `json:"name"`
+	Inode    int       `json:"inode"`
+	Size     int64     `json:"size"`
+	Blocks   int       `json:"blocks"`
+	Inline   bool      `json:"inline"`
+	Modified time.Time `json:"modified"`
+	Owner    string    `json:"owner"`
+}
+
+// Usage is the response to GET /v1/df
+type Usage struct {
+	BlockSize   int  `json:"block_size"`
+	TotalBlocks int  `json:"total_blocks"`
+	FreeBlocks  int  `json:"free_blocks"`
+	Names       int  `json:"names"`
+	FreeNames   int  `json:"free_names"`
+	ReadOnly    bool `json:"read_only"`
+}
+
+// Error is the body of a failed request
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// putModes are the values of the mode parameter of an upload
+var putModes = map[string]filesystem.PutMode{
+	"":          filesystem.PutCreate,
+	"create":    filesystem.PutCreate,
+	"overwrite": filesystem.PutOverwrite,
+	"noclobber": filesystem.PutNoClobber,
+}
+
+// NewHandler returns a handler serving fs. Changes are saved to the image
+// before the response is sent; a read-only file system refuses them.
+func NewHandler(fs *filesystem.FileSystem) http.Handler {
+	h := &handler{fs: fs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/files", h.list)
+	mux.HandleFunc("GET /v1/files/{name...}", h.get)
+	mux.HandleFunc("PUT /v1/files/{name...}", h.put)
+	mux.HandleFunc("DELETE /v1/files/{name...}", h.remove)
+	mux.HandleFunc("GET /v1/stat/{name...}", h.stat)
+	mux.HandleFunc("POST /v1/rename", h.rename)
+	mux.HandleFunc("GET /v1/df", h.df)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, &Error{Code: "unsupported", Message: "no such endpoint: " + r.Method + " " + r.URL.Path})
+	})
+	return mux
+}
+
+type handler struct {
+	fs *filesystem.FileSystem
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	stats, err := filesystem.FilesFS(h.fs)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	files := make([]File, 0, len(stats))
+	for _, st := range stats {
+		files = append(files, fileFor(st))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"files": files})
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	st, err := filesystem.StatFS(h.fs, name)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(st.Size))
+	w.Header().Set("Last-Modified", st.LastModified.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	// Headers are gone, so a failure part way can only cut the body short
+	filesystem.GetWriterFS(h.fs, name, w)
+}
+
+func (h *handler) put(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	query := r.URL.Query()
+	mode, ok := putModes[query.Get("mode")]
+	if !ok {
+		fail(w, fmt.Errorf("%w: mode must be create, overwrite or noclobber", filesystem.ErrInvalid))
+		return
+	}
+
+	outcome, err := filesystem.PutReaderFS(h.fs, r.Body, filesystem.PutOptions{
+		Name:       name,
+		Mode:       mode,
+		Owner:      query.Get("owner"),
+		AllowEmpty: true,
+	})
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	status := http.StatusCreated
+	switch outcome {
+	case filesystem.PutReplaced:
+		status = http.StatusOK
+	case filesystem.PutKept:
+		writeError(w, http.StatusPreconditionFailed, &Error{Code: filesystem.ErrorCode(filesystem.ErrExist), Message: name + " already exists and was kept"})
+		return
+	}
+
+	st, err := filesystem.StatFS(h.fs, name)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, status, fileFor(*st))
+}
+
+func (h *handler) remove(w http.ResponseWriter, r *http.Request) {
+	if err := filesystem.RemoveFS(h.fs, r.PathValue("name")); err != nil {
+		fail(w, err)
+		return
+	}
+	if err := filesystem.SaveFS(h.fs, h.fs.DiskName); err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{})
+}
+
+func (h *handler) stat(w http.ResponseWriter, r *http.Request) {
+	st, err := filesystem.StatFS(h.fs, r.PathValue("name"))
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fileFor(*st))
+}
+
+func (h *handler) rename(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil || req.From == "" || req.To == "" {
+		fail(w, fmt.Errorf(`%w: body must be {"from": name, "to": name}`, filesystem.ErrInvalid))
+		return
+	}
+
+	if err := filesystem.RenameFS(h.fs, req.From, req.To); err != nil {
+		fail(w, err)
+		return
+	}
+	if err := filesystem.SaveFS(h.fs, h.fs.DiskName); err != nil {
+		fail(w, err)
+		return
+	}
+	st, err := filesystem.StatFS(h.fs, req.To)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fileFor(*st))
+}
+
+func (h *handler) df(w http.ResponseWriter, r *http.Request) {
+	usage := filesystem.UsageFS(h.fs)
+	writeJSON(w, http.StatusOK, Usage{
+		BlockSize:   filesystem.BlockSize,
+		TotalBlocks: usage.TotalBlocks,
+		FreeBlocks:  usage.FreeBlocks,
+		Names:       usage.Names,
+		FreeNames:   usage.FreeNames,
+		ReadOnly:    h.fs.ReadOnly(),
+	})
+}
+
+func fileFor(st filesystem.FileStat) File {
+	return File{
+		Name:     st.Name,
+		Inode:    st.Inode,
+		Size:     st.Size,
+		Blocks:   st.AllocatedBlocks,
+		Inline:   st.Inline,
+		Modified: st.LastModified.UTC(),
+		Owner:    st.Owner,
+	}
+}
+
+// fail reports a file system error
+func fail(w http.ResponseWriter, err error) {
+	writeError(w, httperr.Status(err), &Error{Code: filesystem.ErrorCode(err), Message: err.Error()})
+}
+
+func writeError(w http.ResponseWriter, status int, e *Error) {
+	writeJSON(w, status, map[string]*Error{"error": e})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// newTestServer serves a fresh image and returns the server and the image
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	fs := filesystem.CreateFS(256, "tester")
+	if err := filesystem.FormatFS(fs, 16, 16); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(t.TempDir(), "disk")
+	if err := filesystem.SaveFS(fs, image); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filesystem.CloseFS(fs) })
+	server := httptest.NewServer(NewHandler(fs))
+	t.Cleanup(server.Close)
+	return server, image
+}
+
+// do sends a request and returns the status and body of the response
+func do(t *testing.T, server *httptest.Server, method, path, body string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// errorCode returns the code of an error body, failing the test if the body
+// is not shaped like one
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var e struct {
+		Error *Error `json:"error"`
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&e); err != nil || e.Error == nil || e.Error.Code == "" || e.Error.Message == "" {
+		t.Fatalf("body %s is not an error object", body)
+	}
+	return e.Error.Code
+}
+
+func TestHandler(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	for _, step := range []struct {
+		method, path, body string
+		status             int
+		code               string            // Error code, for failures
+		check              func([]byte) bool // Checks the body of a success
+	}{
+		{"PUT", "/v1/files/docs/a.txt", "hello", http.StatusCreated, "", func(b []byte) bool {
+			var f File
+			return json.Unmarshal(b, &f) == nil && f.Name == "docs/a.txt" && f.Size == 5 && f.Inline
+		}},
+		{"PUT", "/v1/files/docs/a.txt", "again", http.StatusConflict, "exist", nil},
+		{"PUT", "/v1/files/docs/a.txt?mode=overwrite", "hello, world", http.StatusOK, "", func(b []byte) bool {
+			var f File
+			return json.Unmarshal(b, &f) == nil && f.Size == 12
+		}},
+		{"PUT", "/v1/files/docs/a.txt?mode=noclobber", "kept?", http.StatusPreconditionFailed, "exist", nil},
+		{"PUT", "/v1/files/new.txt?mode=noclobber&owner=alice", "", http.StatusCreated, "", func(b []byte) bool {
+			var f File
+			return json.Unmarshal(b, &f) == nil && f.Size == 0 && f.Owner == "alice"
+		}},
+		{"PUT", "/v1/files/b.txt?mode=sometimes", "x", http.StatusBadRequest, "invalid", nil},
+		{"PUT", "/v1/files/" + strings.Repeat("n", filesystem.MaxNameLength+1), "x", http.StatusBadRequest, "name_too_long", nil},
+		{"GET", "/v1/files/docs/a.txt", "", http.StatusOK, "", func(b []byte) bool {
+			return string(b) == "hello, world"
+		}},
+		{"GET", "/v1/files/missing", "", http.StatusNotFound, "not_exist", nil},
+		{"GET", "/v1/stat/docs/a.txt", "", http.StatusOK, "", func(b []byte) bool {
+			var f File
+			return json.Unmarshal(b, &f) == nil && f.Name == "docs/a.txt" && f.Owner == "tester"
+		}},
+		{"GET", "/v1/stat/missing", "", http.StatusNotFound, "not_exist", nil},
+		{"GET", "/v1/files", "", http.StatusOK, "", func(b []byte) bool {
+			var list struct{ Files []File }
+			return json.Unmarshal(b, &list) == nil && len(list.Files) == 2
+		}},
+		{"POST", "/v1/rename", `{"from": "docs/a.txt", "to": "b.txt"}`, http.StatusOK, "", func(b []byte) bool {
+			var f File
+			return json.Unmarshal(b, &f) == nil && f.Name == "b.txt" && f.Size == 12
+		}},
+		{"POST", "/v1/rename", `{"from": "b.txt", "to": "new.txt"}`, http.StatusConflict, "exist", nil},
+		{"POST", "/v1/rename", `{"from": "docs/a.txt", "to": "c.txt"}`, http.StatusNotFound, "not_exist", nil},
+		{"POST", "/v1/rename", `{"from": "b.txt"}`, http.StatusBadRequest, "invalid", nil},
+		{"POST", "/v1/rename", `{"from": "b.txt", "to": "c.txt", "force": true}`, http.StatusBadRequest, "invalid", nil},
+		{"DELETE", "/v1/files/b.txt", "", http.StatusOK, "", func(b []byte) bool {
+			return strings.TrimSpace(string(b)) == "{}"
+		}},
+		{"DELETE", "/v1/files/b.txt", "", http.StatusNotFound, "not_exist", nil},
+		{"GET", "/v1/df", "", http.StatusOK, "", func(b []byte) bool {
+			var u Usage
+			return json.Unmarshal(b, &u) == nil && u.BlockSize == filesystem.BlockSize && u.TotalBlocks == 256 &&
+				u.FreeBlocks > 0 && u.FreeBlocks < u.TotalBlocks && !u.ReadOnly
+		}},
+		{"GET", "/v2/files", "", http.StatusNotFound, "unsupported", nil},
+		{"PATCH", "/v1/files/new.txt", "", http.StatusNotFound, "unsupported", nil},
+	} {
+		status, body := do(t, server, step.method, step.path, step.body)
+		name := step.method + " " + step.path
+		if status != step.status {
+			t.Fatalf("%s answered %d, want %d: %s", name, status, step.status, body)
+		}
+		if step.code != "" {
+			if code := errorCode(t, body); code != step.code {
+				t.Errorf("%s failed with code %s, want %s", name, code, step.code)
+			}
+		}
+		if step.check != nil && !step.check(body) {
+			t.Errorf("%s answered unexpected body %s", name, body)
+		}
+	}
+}
+
+func TestHandlerReadOnly(t *testing.T) {
+	_, image := newTestServer(t)
+	fs, err := filesystem.OpenFSWithOptions(image, filesystem.OpenOptions{ReadOnly: true, Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.CloseFS(fs)
+	server := httptest.NewServer(NewHandler(fs))
+	defer server.Close()
+
+	status, body := do(t, server, "PUT", "/v1/files/a.txt", "hello")
+	if status != http.StatusForbidden {
+		t.Fatalf("PUT on a read-only image answered %d, want %d: %s", status, http.StatusForbidden, body)
+	}
+	if code := errorCode(t, body); code != "read_only" {
+		t.Errorf("PUT on a read-only image failed with code %s, want read_only", code)
+	}
+
+	status, body = do(t, server, "GET", "/v1/df", "")
+	var u Usage
+	if status != http.StatusOK || json.Unmarshal(body, &u) != nil || !u.ReadOnly {
+		t.Errorf("df on a read-only image answered %d %s", status, body)
+	}
+}
@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+func (c *CLI) export(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Separate the format from the output name
+	format, names, ok := archiveArgs(args[1:])
+	if !ok || len(names) != 1 {
+		c.fail(codeUsage, "Usage: export [--format tar|tar.gz|zip] <archive|->")
+		return
+	}
+	out := names[0]
+	if format == "" {
+		format = filesystem.ArchiveFormatFor(out)
+	}
+	if format == "" {
+		c.fail(codeInvalid, "Cannot tell the archive format from %s; use --format tar, tar.gz or zip", out)
+		return
+	}
+
+	// Write to standard output or a new host file
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if out == "-" {
+		c.streamed = true
+	} else {
+		var err error
+		file, err = os.Create(out)
+		if err != nil {
+			c.fail(filesystem.ErrorCode(err), "Failed to create archive: %v", err)
+			return
+		}
+		w = file
+	}
+
+	// Call ExportFS function to stream every file into the archive
+	var err error
+	if c.tx != nil {
+		err = c.tx.Export(w, format)
+	} else {
+		err = filesystem.ExportFS(c.fs, w, format)
+	}
+	if file != nil {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to export filesystem: %v", err)
+		return
+	}
+
+	if out != "-" {
+		c.set("path", out)
+		c.say("File system exported to %s.", out)
+	}
+}
+
+func (c *CLI) importArchive(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Separate the flags from the archive name
+	format, names, ok := archiveArgs(args[1:])
+	var mode filesystem.PutMode
+	var archives []string
+	for _, name := range names {
+		switch name {
+		case "--overwrite", "-f":
+			mode = filesystem.PutOverwrite
+		case "--no-clobber", "-n":
+			mode = filesystem.PutNoClobber
+		default:
+			archives = append(archives, name)
+		}
+	}
+	if !ok || len(archives) != 1 {
+		c.fail(codeUsage, "Usage: import [--format tar|tar.gz|zip] [--overwrite|--no-clobber] <archive>")
+		return
+	}
+	if format == "" {
+		format = filesystem.ArchiveFormatFor(archives[0])
+	}
+	if format == "" {
+		c.fail(codeInvalid, "Cannot tell the archive format from %s; use --format tar, tar.gz or zip", archives[0])
+		return
+	}
+
+	// Call ImportFS function to load every file in the archive
+	var summary *filesystem.TreeSummary
+	var err error
+	if c.tx != nil {
+		summary, err = c.tx.Import(archives[0], format, mode)
+	} else {
+		summary, err = filesystem.ImportFS(c.fs, archives[0], format, mode)
+	}
+	c.treeSummary(summary, err)
+}
+
+func (c *CLI) mkfs(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs != nil {
+		c.fail(codeFilesystemLoaded, "File system already loaded. Please close the current file system first.")
+		return
+	}
+
+	// Separate the flags from the image name
+	format, names, ok := archiveArgs(args[1:])
+	var archive, user string
+	var build filesystem.BuildOptions
+	var images []string
+	for i := 0; i < len(names); i++ {
+		switch {
+		case names[i] == "--from" && i+1 < len(names):
+			i++
+			archive = names[i]
+		case names[i] == "--user" && i+1 < len(names):
+			i++
+			user = names[i]
+		case names[i] == "--reproducible":
+			build.Reproducible = true
+		default:
+			images = append(images, names[i])
+		}
+	}
+	if !ok || archive == "" || len(images) != 1 {
+		c.fail(codeUsage, "Usage: mkfs --from <archive> [--format tar|tar.gz|zip] [--user name] [--reproducible] <diskname>")
+		return
+	}
+
+	// SOURCE_DATE_EPOCH asks for a reproducible build stamped with its time;
+	// without it a reproducible build uses the Unix epoch. A reproducible
+	// build must not depend on who runs it either.
+	epoch, ok, err := filesystem.SourceDateEpoch()
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to create file system: %v", err)
+		return
+	}
+	if ok {
+		build.Reproducible = true
+		build.Epoch = epoch
+	} else {
+		build.Epoch = time.Unix(0, 0)
+	}
+	build.User = user
+	if build.User == "" && build.Reproducible {
+		build.User = "root"
+	} else if build.User == "" {
+		build.User = os.Getenv("USER")
+	}
+	image := images[0]
+	if format == "" {
+		format = filesystem.ArchiveFormatFor(archive)
+	}
+	if format == "" {
+		c.fail(codeInvalid, "Cannot tell the archive format from %s; use --format tar, tar.gz or zip", archive)
+		return
+	}
+	if _, err := os.Stat(image); err == nil {
+		err := &os.PathError{Op: "create", Path: image, Err: os.ErrExist}
+		c.fail(filesystem.ErrorCode(err), "Failed to create file system: %v", err)
+		return
+	}
+
+	// Call CreateFSFromArchive function to build a file system sized to fit
+	fs, summary, err := filesystem.CreateFSFromArchive(archive, format, build)
+	c.treeSummary(summary, err)
+	if err != nil {
+		return
+	}
+	err = filesystem.SaveFS(fs, image)
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to save filesystem: %v", err)
+		filesystem.CloseFS(fs)
+		return
+	}
+
+	c.fs = fs
+	c.set("disk", image)
+	c.set("blocks", fs.TotalBlocks)
+	c.say("File system %s created with %d blocks.", image, fs.TotalBlocks)
+}
+
+// archiveArgs separates --format from the other arguments. It returns false
+// if the format is missing.
+func archiveArgs(args []string) (filesystem.ArchiveFormat, []string, bool) {
+	var format filesystem.ArchiveFormat
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--format":
+			if i+1 == len(args) {
+				return format, rest, false
+			}
+			i++
+			format = filesystem.ArchiveFormat(args[i])
+		case strings.HasPrefix(arg, "--format="):
+			format = filesystem.ArchiveFormat(strings.TrimPrefix(arg, "--format="))
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return format, rest, true
+}
@@ -2,99 +2,227 @@ package cli
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/allim132/filesystem/internal/filesystem"
 )
 
 type CLI struct {
-	fs *filesystem.FileSystem
+	fs     *filesystem.FileSystem
+	tx     *filesystem.Tx // Open transaction, if any
+	batch  bool           // Running a single command from Exec
+	output string         // outputText or outputJSON
+
+	// The running command
+	command  string
+	failed   bool           // Reported an error
+	result   map[string]any // Fields of its JSON result
+	streamed bool           // Wrote its data to standard output, so has no JSON result
+	emitted  bool           // Already wrote its JSON result
 }
 
 func NewCLI() *CLI {
-	return &CLI{}
+	return &CLI{output: outputText, result: make(map[string]any)}
 }
 
 func (c *CLI) Run() {
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Print("\nType \"commands\" for list of commands\n")
-		fmt.Print("FS> ")
+		if !c.jsonOutput() {
+			fmt.Print("\nType \"commands\" for list of commands\n")
+		}
+		if c.fs != nil && c.fs.ReadOnly() {
+			c.prompt("FS[ro]> ")
+		} else {
+			c.prompt("FS> ")
+		}
 		input, _ := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
-		input = strings.ToLower(input)
 		args := strings.Fields(input)
 
 		if len(args) == 0 {
 			continue
 		}
+		args[0] = strings.ToLower(args[0]) // File names keep their case
+		c.start(args[0])
+		more := c.execute(reader, args)
+		c.finish()
+		if !more {
+			return
+		}
+	}
+}
 
-		switch args[0] {
-		case "commands":
-			listoperations()
-		case "createfs":
-			c.fs = createfs(reader) // Update to store the returned FileSystem
-			if c.fs != nil {
-				fmt.Println("File system created successfully.")
-			}
-		case "formatfs":
+// execute runs one command and reports whether to keep reading commands
+func (c *CLI) execute(reader *bufio.Reader, args []string) bool {
+	switch args[0] {
+	case "commands":
+		c.listoperations()
+	case "createfs":
+		if c.txOpen() {
+			break
+		}
+		c.fs = c.createfs(reader) // Update to store the returned FileSystem
+		if c.fs != nil {
+			c.say("File system created successfully.")
+		}
+	case "formatfs":
+		if !c.txOpen() {
 			c.formatfs() // Call formatfs method to format file system
-		case "savefs":
+		}
+	case "savefs":
+		if !c.txOpen() {
 			c.savefs(args)
-		case "openfs":
+		}
+	case "openfs":
+		if !c.txOpen() {
 			c.openfs(args)
-		case "list":
-			c.listFiles() // Call listFiles method to list files
-		case "remove":
-			c.remove(args)
-		case "rename":
-			c.rename(args)
-		case "put":
-			c.put(args)
-		case "get":
-		case "quit":
-			return
-		case "exit":
-			return
-		default:
-			fmt.Println("Unknown command")
 		}
+	case "closefs":
+		if !c.txOpen() {
+			c.closefs()
+		}
+	case "list":
+		c.listFiles() // Call listFiles method to list files
+	case "ls":
+		c.ls(args)
+	case "remove":
+		c.remove(args)
+	case "rename":
+		c.rename(args)
+	case "put":
+		c.put(args)
+	case "get":
+		c.get(args)
+	case "cat":
+		c.cat(args)
+	case "truncate":
+		c.truncate(args)
+	case "stat":
+		c.stat(args)
+	case "resize":
+		if !c.txOpen() {
+			c.resize(args)
+		}
+	case "tune":
+		if !c.txOpen() {
+			c.tune(args)
+		}
+	case "defrag":
+		if !c.txOpen() {
+			c.defrag(args)
+		}
+	case "export":
+		c.export(args)
+	case "import":
+		c.importArchive(args)
+	case "mkfs":
+		if !c.txOpen() {
+			c.mkfs(args)
+		}
+	case "sync":
+		if !c.txOpen() {
+			c.sync(args)
+		}
+	case "serve":
+		if !c.txOpen() {
+			c.serve(args)
+		}
+	case "mount":
+		if !c.txOpen() {
+			c.mount(args)
+		}
+	case "nbd-serve":
+		if !c.txOpen() {
+			c.nbdServe(args)
+		}
+	case "begin":
+		c.begin()
+	case "commit":
+		c.commit()
+	case "rollback":
+		c.rollback()
+	case "quit", "exit":
+		if c.tx != nil {
+			c.rollback()
+		}
+		c.closefs()
+		return false
+	case "set":
+		c.setting(args)
+	default:
+		c.fail(codeUnknownCommand, "Unknown command")
 	}
+	return true
+}
+
+// operations describes every command, for commands and help
+var operations = []string{
+	"createfs - Create file system",
+	"formatfs - Format file system",
+	"savefs - Save file system",
+	"openfs [--force] [--ro] (diskname) - Open existing file system, --force ignores another process's lock, --ro opens it read-only",
+	"closefs - Close the file system and release its lock",
+	"list - List files",
+	"ls [-l] [-a] [--sort name|size|time] [-r] [--json] [dir] - Lists a directory; -l shows mode, inode, blocks, owner, size and time, -a shows dot files",
+	"remove (name) - Removes given file",
+	"rename (currentname) (newname) - Renames a given file",
+	"put [--overwrite|--no-clobber] (externalfile) [internalname] - Stores a file into the disk, optionally under another name; - reads standard input when running a single command",
+	"get [--no-clobber] (internalfile) [externalfile] - Gets a file from the file system to host's OS file system, - writes to standard output",
+	"put -r / get -r [--include pattern] [--exclude pattern] (source) (target) - Copies a whole directory tree, names in the image use / between directories",
+	"cat (internalfile) - Writes a file to standard output",
+	"truncate (name) (size) - Shrinks or extends a file; extensions take no space",
+	"stat (name) - Shows a file's size and allocated space",
+	"resize (blocks) - Grows or shrinks the file system to the given number of blocks",
+	"tune (entries) - Enlarges the filename and DABPT tables to the given number of entries",
+	"defrag [report] - Makes every file contiguous, or only reports fragmentation",
+	"export [--format tar|tar.gz|zip] (archive) - Writes every file into an archive, - writes to standard output",
+	"import [--format tar|tar.gz|zip] [--overwrite|--no-clobber] (archive) - Stores every file in an archive",
+	"mkfs --from (archive) [--user name] [--reproducible] (diskname) - Creates a file system sized to fit an archive and loads it; SOURCE_DATE_EPOCH makes it reproducible",
+	"sync [--delete] [--dry-run] [--checksum] (hostdir) (internaldir|.) - Copies files changed since the last sync in either direction and reports conflicts",
+	"serve [--protocol webdav|9p|api] [--addr host:port|unix:path] [--users file] [--tls-cert file --tls-key file] - Serves the files over WebDAV, 9P2000.L or an HTTP+JSON API until interrupted; only when running a single command, read-only with fs --ro serve",
+	"mount (diskname) (dir) - Mounts the files on a directory with FUSE until interrupted; Linux only, when running a single command, read-only with fs --ro mount",
+	"nbd-serve [--addr host:port|unix:path] - Exports the data blocks as a Network Block Device until interrupted; only when running a single command, read-only with fs --ro nbd-serve",
+	"set output text|json - Writes each result as one JSON object on stdout and errors as JSON with a stable code on stderr; --output json does the same for a single command",
+	"begin - Start a transaction; put, remove, rename and truncate take effect on commit",
+	"commit - Apply and save every change made since begin",
+	"rollback - Discard every change made since begin",
 }
 
 // Implement methods for each command (createfs, formatfs, etc.)
-func listoperations() {
+func (c *CLI) listoperations() {
+	if c.jsonOutput() {
+		c.set("operations", operations)
+		return
+	}
 	fmt.Println("\nOperations:")
-	fmt.Println("createfs - Create file system")
-	fmt.Println("formatfs - Format file system")
-	fmt.Println("savefs - Save file system")
-	fmt.Println("openfs (diskname) - Open existing file system")
-	fmt.Println("list - List files")
-	fmt.Println("remove (name) - Removes given file")
-	fmt.Println("rename (currentname) (newname) - Renames a given file")
-	fmt.Println("put (externalfile) - Stores a file into the disk")
-	fmt.Println("get (internalfile) - Gets a file from the file system to host's OS file system")
+	for _, op := range operations {
+		fmt.Println(op)
+	}
 }
 
-func createfs(reader *bufio.Reader) *filesystem.FileSystem {
-	fmt.Print("Enter a name for the disk (e.g., disk01): ")
+func (c *CLI) createfs(reader *bufio.Reader) *filesystem.FileSystem {
+	c.prompt("Enter a name for the disk (e.g., disk01): ")
 	diskName, _ := reader.ReadString('\n')
 	diskName = strings.TrimSpace(diskName)
 
-	fmt.Print("Enter your username: ")
+	c.prompt("Enter your username: ")
 	currentUser, _ := reader.ReadString('\n')
 	currentUser = strings.TrimSpace(currentUser)
 
-	fmt.Printf("Creating File System...\nEnter number of blocks: ")
+	c.prompt("Creating File System...\nEnter number of blocks: ")
 	input, _ := reader.ReadString('\n')
 	input = strings.TrimSpace(input)
 	number, err := strconv.ParseInt(input, 10, 32)
 
 	if err != nil {
-			fmt.Println("Error: Input must be an integer!")
+			c.fail(codeInvalid, "Error: Input must be an integer!")
 			return nil
 	}
 
@@ -102,19 +230,48 @@ func createfs(reader *bufio.Reader) *filesystem.FileSystem {
 	fs := filesystem.CreateFS(int(number), currentUser)
 	fs.DiskName = diskName // Optionally set DiskName here
 
-	fmt.Printf("File system with %d blocks successfully created!\n", number)
+	c.set("disk", diskName)
+	c.set("blocks", number)
+	c.say("File system with %d blocks successfully created!", number)
 	return fs
 }
 
 func (c *CLI) listFiles() {
 	if c.fs == nil {
-		fmt.Println("No filesystem created. Please create one first.")
+		c.fail(codeNoFilesystem, "No filesystem created. Please create one first.")
 		return
 	}
 
-	fileList, err := filesystem.ListFS(c.fs) // Assuming ListFS is a method in your filesystem package
+	// Describe each file with fields rather than sentences for JSON
+	if c.jsonOutput() {
+		var stats []filesystem.FileStat
+		var err error
+		if c.tx != nil {
+			stats, err = c.tx.Files()
+		} else {
+			stats, err = filesystem.FilesFS(c.fs)
+		}
+		if err != nil {
+			c.fail(filesystem.ErrorCode(err), "Error listing files: %v", err)
+			return
+		}
+		files := make([]jsonFile, 0, len(stats))
+		for _, st := range stats {
+			files = append(files, fileJSON(st))
+		}
+		c.set("files", files)
+		return
+	}
+
+	var fileList []string
+	var err error
+	if c.tx != nil {
+		fileList, err = c.tx.List()
+	} else {
+		fileList, err = filesystem.ListFS(c.fs) // Assuming ListFS is a method in your filesystem package
+	}
 	if err != nil {
-		fmt.Printf("Error listing files: %v\n", err)
+		c.fail(filesystem.ErrorCode(err), "Error listing files: %v", err)
 		return
 	}
 
@@ -132,7 +289,7 @@ func (c *CLI) listFiles() {
 func (c *CLI) formatfs() {
     // Check if the filesystem is loaded
     if c.fs == nil {
-        fmt.Println("No filesystem loaded. Please create or open a filesystem first.")
+        c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
         return
     }
 
@@ -140,63 +297,126 @@ func (c *CLI) formatfs() {
     totalBlocks := c.fs.TotalBlocks
 
     // Prompt user for number of entries (for both FNT and DABPT)
-    fmt.Printf("Enter number of entries (for filenames and DABPT). Max number of entries is %d: ", totalBlocks)
+    c.prompt("Enter number of entries (for filenames and DABPT). Max number of entries is %d: ", totalBlocks)
     
     reader := bufio.NewReader(os.Stdin)
     inputEntries, _ := reader.ReadString('\n')
     inputEntries = strings.TrimSpace(inputEntries)
     numEntries, err := strconv.Atoi(inputEntries)
     if err != nil || numEntries <= 0 || numEntries > totalBlocks {
-        fmt.Println("Invalid input for number of entries. Please enter a positive integer within the limit.")
+        c.fail(codeInvalid, "Invalid input for number of entries. Please enter a positive integer within the limit.")
         return
     }
 
     // Call FormatFS function to format the filesystem
     err = filesystem.FormatFS(c.fs, numEntries, numEntries) // Same number for both FNT and DABPT
     if err != nil {
-        fmt.Printf("Failed to format filesystem: %v\n", err)
+        c.fail(filesystem.ErrorCode(err), "Failed to format filesystem: %v", err)
         return
     }
 
-    fmt.Println("Filesystem formatted successfully.")
+    c.set("entries", numEntries)
+    c.say("Filesystem formatted successfully.")
 }
 
 func (c *CLI) put(args []string) {
     // Check if the filesystem is loaded
     if c.fs == nil {
-        fmt.Println("No filesystem loaded. Please create or open a filesystem first.")
+        c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
         return
     }
 
+    // Separate the flags from the file names
+    parsed, ok := parseCopyArgs(args[1:])
+    if !ok {
+        c.fail(codeUsage, "Usage: put [-r] [--include pattern] [--exclude pattern] [--overwrite|--no-clobber] <externalfile> [internalname]")
+        return
+    }
+    if parsed.recursive {
+        c.putTree(parsed)
+        return
+    }
+    opts := filesystem.PutOptions{Mode: parsed.tree.Mode}
+    names := parsed.names
+
     // Check if a filename argument is provided
-    if len(args) < 2 {
-        fmt.Println("Usage: put <filename>")
+    if len(names) < 1 || len(names) > 2 {
+        c.fail(codeUsage, "Usage: put [--overwrite|--no-clobber] <externalfile> [internalname]")
         return
     }
 
-    // Get the external file name from the command arguments
-    externalFileName := args[1]
+    // Get the external file name, and the internal one if given
+    externalFileName := names[0]
+    if len(names) == 2 {
+        opts.Name = names[1]
+    }
+
+    // Standard input is only free for data when not reading commands from it
+    if externalFileName == "-" {
+        if !c.batch {
+            c.fail(codeBatchOnly, "put - reads standard input and is only available when running a single command, e.g. fs put --image disk01 - name")
+            return
+        }
+        if opts.Name == "" {
+            c.fail(codeUsage, "Usage: put [--overwrite|--no-clobber] - <internalname>")
+            return
+        }
+    }
 
-    // Call PutFS function to store the external file in the filesystem
-    err := filesystem.PutFS(c.fs, externalFileName)
+    // Report a skipped file instead of claiming it was stored
+    if opts.Mode == filesystem.PutNoClobber {
+        name := opts.Name
+        if name == "" {
+            name = filepath.Base(externalFileName)
+        }
+        var err error
+        if c.tx != nil {
+            _, err = c.tx.Stat(name)
+        } else {
+            _, err = filesystem.StatFS(c.fs, name)
+        }
+        if err == nil {
+            c.set("name", name)
+            c.set("skipped", true)
+            c.say("Skipped: %s already exists.", name)
+            return
+        }
+    }
+
+    // Call PutFSWithOptions function to store the external file in the filesystem
+    var err error
+    switch {
+    case externalFileName == "-" && c.tx != nil:
+        _, err = c.tx.PutReader(os.Stdin, opts)
+    case externalFileName == "-":
+        _, err = filesystem.PutReaderFS(c.fs, os.Stdin, opts)
+    case c.tx != nil:
+        err = c.tx.PutWithOptions(externalFileName, opts)
+    default:
+        err = filesystem.PutFSWithOptions(c.fs, externalFileName, opts)
+    }
     if err != nil {
-        fmt.Printf("Failed to put file into filesystem: %v\n", err)
+        c.fail(filesystem.ErrorCode(err), "Failed to put file into filesystem: %v", err)
         return
     }
 
-    fmt.Println("File successfully stored in the filesystem.")
+    if opts.Name == "" {
+        opts.Name = filepath.Base(externalFileName)
+    }
+    c.set("name", opts.Name)
+    c.say("File successfully stored in the filesystem.")
 }
 
 func (c *CLI) remove(args []string) {
 	// Check if the filesystem is loaded
 	if c.fs == nil {
-		fmt.Println("No filesystem loaded. Please create or open a filesystem first.")
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
 		return
 	}
 	
 	// Check if a filename argument is provided
 	if len(args) < 2 {
-		fmt.Println("Usage: remove <filename>")
+		c.fail(codeUsage, "Usage: remove <filename>")
 		return
 	}
 
@@ -204,70 +424,117 @@ func (c *CLI) remove(args []string) {
 	internalFileName := args[1]
 	
 	// Call RemoveFS function to remove the internal file from the filesystem
-	err := filesystem.RemoveFS(c.fs, internalFileName)
+	var err error
+	if c.tx != nil {
+		err = c.tx.Remove(internalFileName)
+	} else {
+		err = filesystem.RemoveFS(c.fs, internalFileName)
+	}
 	if err != nil {
-		fmt.Printf("Failed to remove file from filesystem: %v\n", err)
+		c.fail(filesystem.ErrorCode(err), "Failed to remove file from filesystem: %v", err)
 		return
 	}
 	
-	fmt.Println("File successfully removed from the filesystem.")
+	c.set("name", internalFileName)
+	c.say("File successfully removed from the filesystem.")
 }
 
 func (c *CLI) savefs(args []string) {
 	// Check if the filesystem is loaded
 	if c.fs == nil {
-		fmt.Println("No filesystem loaded. Please create or open a filesystem first.")
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
 		return
 	}
 	
 	// Call SaveFS function to save the filesystem
 	err := filesystem.SaveFS(c.fs, c.fs.DiskName)
 	if err != nil {
-		fmt.Printf("Failed to save filesystem: %v\n", err)
+		c.fail(filesystem.ErrorCode(err), "Failed to save filesystem: %v", err)
 		return
 	}
 	
-	fmt.Println("File system successfully saved.")
+	c.set("disk", c.fs.DiskName)
+	c.say("File system successfully saved.")
 }
 
 func (c *CLI) openfs(args []string) {
 	// Check if the filesystem is loaded
 	if c.fs != nil {
-		fmt.Println("File system already loaded. Please close the current file system first.")
+		c.fail(codeFilesystemLoaded, "File system already loaded. Please close the current file system first.")
 		return
 	}
 	
+	// Separate the --force flag from the file name
+	var opts filesystem.OpenOptions
+	var names []string
+	for _, arg := range args[1:] {
+		if arg == "--force" {
+			opts.Force = true
+		} else if arg == "--ro" || arg == "--read-only" {
+			opts.ReadOnly = true
+		} else {
+			names = append(names, arg)
+		}
+	}
+
 	// Check if a filename argument is provided
-	if len(args) < 2 {
-		fmt.Println("Usage: openfs <filename>")
+	if len(names) < 1 {
+		c.fail(codeUsage, "Usage: openfs [--force] [--ro] <filename>")
 		return
 	}
 	
 	// Get the file name from the command arguments
-	fileName := args[1]
+	fileName := names[0]
 	
-	// Call OpenFS function to open the file system
-	fmt.Printf("Trying to open file system: %s\n", fileName)
-	fs, err := filesystem.OpenFS(fileName)
+	// Call OpenFSWithOptions function to open and lock the file system
+	c.say("Trying to open file system: %s", fileName)
+	fs, err := filesystem.OpenFSWithOptions(fileName, opts)
 	if err != nil {
-		fmt.Printf("Failed to open file system: %v\n", err)
+		c.fail(filesystem.ErrorCode(err), "Failed to open file system: %v", err)
+		var locked *filesystem.ImageLockedError
+		if errors.As(err, &locked) {
+			c.hint("Use openfs --force to open it anyway if the lock is stale.")
+		}
 		return
 	}
 
 	c.fs = fs
-	fmt.Println("File system successfully opened.")
+	c.set("disk", fs.DiskName)
+	c.set("read_only", fs.ReadOnly())
+	if fs.ReadOnly() {
+		c.say("File system successfully opened read-only.")
+		return
+	}
+	c.say("File system successfully opened.")
+}
+
+func (c *CLI) closefs() {
+	// Nothing to do if no filesystem is loaded
+	if c.fs == nil {
+		return
+	}
+
+	// Call CloseFS function to release the image lock
+	err := filesystem.CloseFS(c.fs)
+	c.fs = nil
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to close file system: %v", err)
+		return
+	}
+
+	c.say("File system closed.")
 }
 
 func (c *CLI) rename(args []string) {
 	// Check if the filesystem is loaded
 	if c.fs == nil {
-		fmt.Println("No filesystem loaded. Please create or open a filesystem first.")
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
 		return
 	}
 	
 	// Check if a filename argument is provided
 	if len(args) < 3 {
-		fmt.Println("Usage: rename <currentfilename> <newfilename>")
+		c.fail(codeUsage, "Usage: rename <currentfilename> <newfilename>")
 		return
 	}
 	
@@ -276,11 +543,361 @@ func (c *CLI) rename(args []string) {
 	newFileName := args[2]
 	
 	// Call RenameFS function to rename the internal file in the filesystem
-	err := filesystem.RenameFS(c.fs, currentFileName, newFileName)
+	var err error
+	if c.tx != nil {
+		err = c.tx.Rename(currentFileName, newFileName)
+	} else {
+		err = filesystem.RenameFS(c.fs, currentFileName, newFileName)
+	}
 	if err != nil {
-		fmt.Printf("Failed to rename file in filesystem: %v\n", err)
+		c.fail(filesystem.ErrorCode(err), "Failed to rename file in filesystem: %v", err)
 		return
 	}
 	
-	fmt.Println("File successfully renamed in the filesystem.")
-}
\ No newline at end of file
+	c.set("from", currentFileName)
+	c.set("to", newFileName)
+	c.say("File successfully renamed in the filesystem.")
+}
+
+func (c *CLI) get(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Separate the flags from the file names
+	parsed, ok := parseCopyArgs(args[1:])
+	if !ok {
+		c.fail(codeUsage, "Usage: get [-r] [--include pattern] [--exclude pattern] [--no-clobber] <internalfilename> [externalfilename]")
+		return
+	}
+	if parsed.recursive {
+		c.getTree(parsed)
+		return
+	}
+
+	// Check if a filename argument is provided
+	if len(parsed.names) < 1 {
+		c.fail(codeUsage, "Usage: get <internalfilename> [externalfilename]")
+		return
+	}
+
+	// Default the host file name to the internal one
+	internalFileName := parsed.names[0]
+	externalFileName := internalFileName
+	if len(parsed.names) > 1 {
+		externalFileName = parsed.names[1]
+	}
+
+	// Write to standard output instead of a host file
+	if externalFileName == "-" {
+		c.cat([]string{"cat", internalFileName})
+		return
+	}
+
+	// Keep an existing host file when asked to
+	if parsed.tree.Mode == filesystem.PutNoClobber {
+		if _, err := os.Lstat(externalFileName); err == nil {
+			c.set("name", internalFileName)
+			c.set("path", externalFileName)
+			c.set("skipped", true)
+			c.say("Skipped: %s already exists.", externalFileName)
+			return
+		}
+	}
+
+	// Call GetFS function to copy the file out to the host
+	var err error
+	if c.tx != nil {
+		err = c.tx.Get(internalFileName, externalFileName)
+	} else {
+		err = filesystem.GetFS(c.fs, internalFileName, externalFileName)
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to get file from filesystem: %v", err)
+		return
+	}
+
+	c.set("name", internalFileName)
+	c.set("path", externalFileName)
+	c.say("File successfully copied to %s.", externalFileName)
+}
+
+func (c *CLI) cat(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Check if a filename argument is provided
+	if len(args) < 2 {
+		c.fail(codeUsage, "Usage: cat <filename>")
+		return
+	}
+
+	// Call GetWriterFS function to copy the file to standard output
+	c.streamed = true
+	var err error
+	if c.tx != nil {
+		err = c.tx.GetWriter(args[1], os.Stdout)
+	} else {
+		err = filesystem.GetWriterFS(c.fs, args[1], os.Stdout)
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to read file: %v", err)
+	}
+}
+
+func (c *CLI) truncate(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Check if filename and size arguments are provided
+	if len(args) < 3 {
+		c.fail(codeUsage, "Usage: truncate <filename> <size>")
+		return
+	}
+
+	size, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || size < 0 {
+		c.fail(codeInvalid, "Error: Size must be a non-negative integer!")
+		return
+	}
+
+	// Call TruncateFS function to resize the file
+	if c.tx != nil {
+		err = c.tx.Truncate(args[1], size)
+	} else {
+		err = filesystem.TruncateFS(c.fs, args[1], size)
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to truncate file: %v", err)
+		return
+	}
+
+	c.set("name", args[1])
+	c.set("size", size)
+	c.say("File successfully truncated.")
+}
+
+func (c *CLI) stat(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Check if a filename argument is provided
+	if len(args) < 2 {
+		c.fail(codeUsage, "Usage: stat <filename>")
+		return
+	}
+
+	// Call StatFS function to describe the file
+	var st *filesystem.FileStat
+	var err error
+	if c.tx != nil {
+		st, err = c.tx.Stat(args[1])
+	} else {
+		st, err = filesystem.StatFS(c.fs, args[1])
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to stat file: %v", err)
+		return
+	}
+
+	if c.jsonOutput() {
+		c.set("file", fileJSON(*st))
+		return
+	}
+	fmt.Printf("File: %s\n", st.Name)
+	fmt.Printf("Size: %d bytes\n", st.Size)
+	fmt.Printf("Allocated: %d bytes (%d blocks)\n", st.AllocatedSize, st.AllocatedBlocks)
+	if st.Inline {
+		fmt.Println("Stored inline in its DABPT entry")
+	}
+	fmt.Printf("Last Modified: %s\n", st.LastModified.Format(time.RFC3339))
+	fmt.Printf("Owner: %s\n", st.Owner)
+	fmt.Printf("Mode: %s\n", st.Mode)
+}
+
+func (c *CLI) resize(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Check if a block count argument is provided
+	if len(args) < 2 {
+		c.fail(codeUsage, "Usage: resize <blocks>")
+		return
+	}
+
+	numBlocks, err := strconv.Atoi(args[1])
+	if err != nil || numBlocks <= 0 {
+		c.fail(codeInvalid, "Error: Number of blocks must be a positive integer!")
+		return
+	}
+
+	// Call ResizeFS function to grow or shrink the disk
+	oldBlocks := c.fs.TotalBlocks
+	err = filesystem.ResizeFS(c.fs, numBlocks)
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to resize filesystem: %v", err)
+		return
+	}
+
+	c.set("old_blocks", oldBlocks)
+	c.set("blocks", numBlocks)
+	c.say("File system resized from %d to %d blocks. Use savefs to write it to disk.", oldBlocks, numBlocks)
+}
+
+func (c *CLI) tune(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Check if an entry count argument is provided
+	if len(args) < 2 {
+		c.fail(codeUsage, "Usage: tune <entries>")
+		return
+	}
+
+	numEntries, err := strconv.Atoi(args[1])
+	if err != nil || numEntries <= 0 {
+		c.fail(codeInvalid, "Error: Number of entries must be a positive integer!")
+		return
+	}
+
+	// Call TuneFS function to enlarge both tables
+	err = filesystem.TuneFS(c.fs, numEntries, max(numEntries, len(c.fs.DABPT)))
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to tune filesystem: %v", err)
+		return
+	}
+
+	c.set("names", len(c.fs.FNT))
+	c.set("dabpt_entries", len(c.fs.DABPT))
+	c.say("File system now has %d filename and %d DABPT entries.", len(c.fs.FNT), len(c.fs.DABPT))
+}
+
+func (c *CLI) defrag(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Show the current layout of every file
+	report, err := filesystem.FragmentationFS(c.fs)
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to compute fragmentation: %v", err)
+		return
+	}
+	type jsonFragmentation struct {
+		Name    string `json:"name"`
+		Blocks  int    `json:"blocks"`
+		Extents int    `json:"extents"`
+	}
+	fragmented := 0
+	files := make([]jsonFragmentation, 0, len(report))
+	for _, file := range report {
+		if file.Extents > 1 {
+			fragmented++
+		}
+		files = append(files, jsonFragmentation{file.Name, file.Blocks, file.Extents})
+		if !c.jsonOutput() {
+			fmt.Printf("File: %s, Blocks: %d, Extents: %d\n", file.Name, file.Blocks, file.Extents)
+		}
+	}
+	c.set("files", files)
+	c.set("fragmented", fragmented)
+	c.say("%d of %d files are fragmented.", fragmented, len(report))
+
+	if len(args) > 1 && args[1] == "report" {
+		return
+	}
+
+	// Call DefragFS function to make every file contiguous
+	moved, err := filesystem.DefragFS(c.fs, func(p filesystem.DefragProgress) {
+		if !c.jsonOutput() {
+			fmt.Printf("[%d/%d] %s (%d blocks moved)\n", p.Done, p.Total, p.File, p.BlocksMoved)
+		}
+	})
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to defragment filesystem: %v", err)
+		return
+	}
+
+	c.set("moved", moved)
+	c.say("Defragmentation complete, %d blocks moved. Use savefs to write it to disk.", moved)
+}
+
+// txOpen tells the user to finish the open transaction, if there is one
+func (c *CLI) txOpen() bool {
+	if c.tx == nil {
+		return false
+	}
+	c.fail(codeTxOpen, "A transaction is open. Please commit or rollback first.")
+	return true
+}
+
+func (c *CLI) begin() {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+	if c.txOpen() {
+		return
+	}
+
+	tx, err := c.fs.Begin()
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to begin transaction: %v", err)
+		return
+	}
+
+	c.tx = tx
+	c.say("Transaction started.")
+}
+
+func (c *CLI) commit() {
+	if c.tx == nil {
+		c.fail(codeNoTx, "No transaction is open.")
+		return
+	}
+
+	err := c.tx.Commit()
+	c.tx = nil
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to commit transaction: %v", err)
+		return
+	}
+
+	c.say("Transaction committed.")
+}
+
+func (c *CLI) rollback() {
+	if c.tx == nil {
+		c.fail(codeNoTx, "No transaction is open.")
+		return
+	}
+
+	err := c.tx.Rollback()
+	c.tx = nil
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to roll back transaction: %v", err)
+		return
+	}
+
+	c.say("Transaction rolled back.")
+}
@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// execCommands are the commands Exec can run, mapped to whether they only
+// read the image
+var execCommands = map[string]bool{
+	"list":      true,
+	"ls":        true,
+	"get":       true,
+	"cat":       true,
+	"stat":      true,
+	"export":    true,
+	"put":       false,
+	"remove":    false,
+	"rename":    false,
+	"truncate":  false,
+	"sync":      false,
+	"import":    false,
+	"mkfs":      false,
+	"serve":     false,
+	"mount":     false,
+	"nbd-serve": false,
+}
+
+// execSavesItself are the commands that save the image themselves, so Exec
+// does not save it again afterwards
+var execSavesItself = map[string]bool{
+	"put":       true,
+	"sync":      true,
+	"import":    true,
+	"serve":     true,
+	"mount":     true,
+	"nbd-serve": true,
+}
+
+// Exec runs a single command against the image named by --image and returns
+// the exit status, so the file system can be used from scripts and pipes:
+//
+//	fs put --image disk01 - archive.tar
+//	fs cat --image disk01 log.txt
+//	fs --ro mount disk01 /mnt/disk01
+//
+// --force and --ro are accepted as for openfs, but only before the command,
+// so that everything after it reaches the command as given. Errors go to
+// stderr.
+// --output json writes the result as a JSON object on stdout instead, and
+// errors as JSON objects with a stable code on stderr.
+func (c *CLI) Exec(args []string) int {
+	c.batch = true
+
+	// Pull out the image and output flags, and the open flags ahead of the
+	// command, leaving the command and its arguments
+	var image, output string
+	var opts filesystem.OpenOptions
+	var cmd []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--output" && i+1 < len(args):
+			i++
+			output = args[i]
+		case strings.HasPrefix(arg, "--output="):
+			output = strings.TrimPrefix(arg, "--output=")
+		case arg == "--image" && i+1 < len(args):
+			i++
+			image = args[i]
+		case strings.HasPrefix(arg, "--image="):
+			image = strings.TrimPrefix(arg, "--image=")
+		case arg == "--force" && len(cmd) == 0:
+			opts.Force = true
+		case (arg == "--ro" || arg == "--read-only") && len(cmd) == 0:
+			opts.ReadOnly = true
+		default:
+			cmd = append(cmd, arg)
+		}
+	}
+
+	if len(cmd) > 0 {
+		cmd[0] = strings.ToLower(cmd[0])
+		c.start(cmd[0])
+	}
+	defer c.finish()
+	if output != "" && !c.setOutput(output) {
+		c.fail(codeUsage, "Usage: fs <command> --output text|json --image <diskname> [arguments]")
+		return 2
+	}
+	if len(cmd) == 0 {
+		c.fail(codeUsage, "Usage: fs <command> --image <diskname> [arguments]")
+		return 2
+	}
+	if cmd[0] == "commands" || cmd[0] == "help" {
+		c.listoperations()
+		return 0
+	}
+	readOnly, ok := execCommands[cmd[0]]
+	if !ok {
+		c.fail(codeUnknownCommand, "Unknown command %q; run fs without arguments for the interactive shell", cmd[0])
+		return 2
+	}
+	// mount also takes the image as its first argument
+	if cmd[0] == "mount" && image == "" && len(cmd) == 3 {
+		image, cmd = cmd[1], []string{cmd[0], cmd[2]}
+	}
+	if image == "" && cmd[0] != "mkfs" {
+		c.fail(codeUsage, "Usage: fs %s --image <diskname> [arguments]", cmd[0])
+		return 2
+	}
+
+	// mkfs makes the image rather than opening it
+	if cmd[0] == "mkfs" {
+		if image != "" {
+			cmd = append(cmd, image)
+		}
+		c.execute(nil, cmd)
+		if c.fs != nil {
+			filesystem.CloseFS(c.fs)
+		}
+		if c.failed {
+			return 1
+		}
+		return 0
+	}
+
+	// Commands that only read share the image with other readers
+	opts.ReadOnly = opts.ReadOnly || readOnly
+	fs, err := filesystem.OpenFSWithOptions(image, opts)
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to open file system: %v", err)
+		var locked *filesystem.ImageLockedError
+		if errors.As(err, &locked) {
+			c.hint("Put --force before the command to open it anyway if the lock is stale.")
+		}
+		return 1
+	}
+	c.fs = fs
+	defer filesystem.CloseFS(fs)
+
+	c.execute(nil, cmd)
+	if c.failed {
+		return 1
+	}
+
+	// Save the changes of the other commands
+	if !fs.ReadOnly() && !execSavesItself[cmd[0]] {
+		if err := filesystem.SaveFS(fs, fs.DiskName); err != nil {
+			c.fail(filesystem.ErrorCode(err), "Failed to save filesystem: %v", err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+const lsUsage = "Usage: ls [-l] [-a] [--sort name|size|time] [-r] [--json] [dir]"
+
+func (c *CLI) ls(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Separate the flags; short ones may be combined, as in -la
+	var long, all, reverse, asJSON bool
+	sortBy := "name"
+	var dirs []string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--sort" && i+1 < len(args):
+			i++
+			sortBy = args[i]
+		case arg == "--json":
+			asJSON = true
+		case len(arg) > 1 && arg[0] == '-' && arg[1] != '-':
+			for _, flag := range arg[1:] {
+				switch flag {
+				case 'l':
+					long = true
+				case 'a':
+					all = true
+				case 'r':
+					reverse = true
+				default:
+					c.fail(codeUsage, lsUsage)
+					return
+				}
+			}
+		case strings.HasPrefix(arg, "--"):
+			c.fail(codeUsage, lsUsage)
+			return
+		default:
+			dirs = append(dirs, arg)
+		}
+	}
+	if len(dirs) > 1 {
+		c.fail(codeUsage, lsUsage)
+		return
+	}
+	dir := ""
+	if len(dirs) == 1 {
+		dir = dirs[0]
+	}
+
+	var entries []filesystem.FileStat
+	var err error
+	if c.tx != nil {
+		entries, err = c.tx.ReadDir(dir)
+	} else {
+		entries, err = filesystem.ReadDirFS(c.fs, dir)
+	}
+	if errors.Is(err, filesystem.ErrInvalid) {
+		// Not a directory, so list the file itself
+		var st *filesystem.FileStat
+		if c.tx != nil {
+			st, err = c.tx.Stat(dir)
+		} else {
+			st, err = filesystem.StatFS(c.fs, dir)
+		}
+		if err == nil {
+			entries = []filesystem.FileStat{*st}
+		}
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to list directory: %v", err)
+		return
+	}
+
+	// Hide dot files unless asked for them
+	if !all {
+		shown := entries[:0]
+		for _, st := range entries {
+			if !strings.HasPrefix(path.Base(st.Name), ".") {
+				shown = append(shown, st)
+			}
+		}
+		entries = shown
+	}
+
+	// Entries come sorted by name; size and time put the largest and newest
+	// first, as ls -S and -t do
+	switch sortBy {
+	case "name":
+	case "size":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Size > entries[j].Size })
+	case "time":
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].LastModified.After(entries[j].LastModified) })
+	default:
+		c.fail(codeUsage, lsUsage)
+		return
+	}
+	if reverse {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+
+	switch {
+	case c.jsonOutput() || asJSON:
+		out := make([]jsonFile, 0, len(entries))
+		for _, st := range entries {
+			out = append(out, fileJSON(st))
+		}
+		if c.jsonOutput() {
+			c.set("entries", out)
+			break
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(out)
+	case long:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		for _, st := range entries {
+			inode, owner := "-", "-"
+			if !st.IsDir() {
+				inode, owner = fmt.Sprint(st.Inode), st.Owner
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n",
+				st.Mode, inode, st.AllocatedBlocks, owner, st.Size,
+				st.LastModified.Format("2006-01-02 15:04"), lsName(st))
+		}
+		w.Flush()
+	default:
+		for _, st := range entries {
+			fmt.Println(lsName(st))
+		}
+	}
+}
+
+// lsName is the name ls shows for an entry, with a '/' after directories
+func lsName(st filesystem.FileStat) string {
+	if st.IsDir() {
+		return path.Base(st.Name) + "/"
+	}
+	return path.Base(st.Name)
+}
@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/fuse"
+	"github.com/allim132/filesystem/internal/vfs"
+)
+
+func (c *CLI) mount(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+	if !c.batch {
+		c.fail(codeBatchOnly, "mount runs until interrupted and is only available when running a single command, e.g. fs mount disk01 /mnt/disk01")
+		return
+	}
+	if len(args) != 2 {
+		c.fail(codeUsage, "Usage: mount (diskname) (dir)")
+		return
+	}
+	dir := args[1]
+
+	dev, err := fuse.Mount(dir, fuse.MountOptions{FSName: c.fs.DiskName, ReadOnly: c.fs.ReadOnly()})
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to mount: %v", err)
+		return
+	}
+	defer dev.Close()
+
+	// Unmount when interrupted; if files are still in use, keep serving
+	// until the next interrupt
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for range signals {
+			if err := dev.Unmount(); err != nil {
+				c.warn("busy", "Failed to unmount: %v", err)
+				continue
+			}
+			return
+		}
+	}()
+
+	mode := ""
+	if c.fs.ReadOnly() {
+		mode = " read-only"
+	}
+	c.set("dir", dir)
+	c.say("Mounted %s%s on %s; interrupt to unmount", c.fs.DiskName, mode, dir)
+	c.emit()
+	if err := fuse.NewServer(vfs.New(c.fs)).Serve(dev); err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to serve mount: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/nbd"
+)
+
+func (c *CLI) nbdServe(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+	if !c.batch {
+		c.fail(codeBatchOnly, "nbd-serve runs until interrupted and is only available when running a single command, e.g. fs nbd-serve --image disk01")
+		return
+	}
+
+	addr := "127.0.0.1:10809"
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "--addr" && i+1 < len(args):
+			i++
+			addr = args[i]
+		default:
+			c.fail(codeUsage, "Usage: nbd-serve [--addr host:port|unix:path]")
+			return
+		}
+	}
+	// Stop serving when interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	listener, ok := c.listenLocal(ctx, addr, "NBD has no authentication")
+	if !ok {
+		return
+	}
+
+	mode := ""
+	if c.fs.ReadOnly() {
+		mode = " read-only"
+	}
+	server := nbd.NewServer(c.fs)
+	c.serving("nbd", listener)
+	c.say("Serving the blocks of %s%s over NBD on %s %s", c.fs.DiskName, mode, listener.Addr().Network(), listener.Addr())
+	c.emit()
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		c.fail(filesystem.ErrorCode(err), "Failed to serve: %v", err)
+	}
+	if err := server.Sync(); err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to save filesystem: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// Output formats, chosen with --output or set output
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// jsonFile describes a file or directory in JSON results
+type jsonFile struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Type     string    `json:"type"` // "file" or "dir"
+	Mode     string    `json:"mode"`
+	Size     int64     `json:"size"`
+	Blocks   int       `json:"blocks"`
+	Inode    int       `json:"inode"`
+	Inline   bool      `json:"inline"`
+	Modified time.Time `json:"modified"`
+	Owner    string    `json:"owner"`
+}
+
+func fileJSON(st filesystem.FileStat) jsonFile {
+	typ := "file"
+	if st.IsDir() {
+		typ = "dir"
+	}
+	return jsonFile{
+		Name:     path.Base(st.Name),
+		Path:     st.Name,
+		Type:     typ,
+		Mode:     fmt.Sprintf("%04o", st.Mode.Perm()),
+		Size:     st.Size,
+		Blocks:   st.AllocatedBlocks,
+		Inode:    st.Inode,
+		Inline:   st.Inline,
+		Modified: st.LastModified.UTC(),
+		Owner:    st.Owner,
+	}
+}
+
+// Codes of failures that no file system error is behind, for JSON output.
+// Like the codes of filesystem.ErrorCode, they do not change between
+// releases.
+const (
+	codeUsage            = "usage"
+	codeUnknownCommand   = "unknown_command"
+	codeNoFilesystem     = "no_filesystem"
+	codeFilesystemLoaded = "filesystem_loaded"
+	codeTxOpen           = "tx_open"
+	codeNoTx             = "no_tx"
+	codeConflict         = "conflict"
+	codeBatchOnly        = "batch_only"
+	codeInvalid          = "invalid"
+)
+
+// jsonError is written to stderr for every failure in JSON mode
+type jsonError struct {
+	Command string `json:"command"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// jsonOutput reports whether results are written as JSON
+func (c *CLI) jsonOutput() bool {
+	return c.output == outputJSON
+}
+
+// start prepares for running the command name
+func (c *CLI) start(name string) {
+	c.command = name
+	c.failed = false
+	c.streamed = false
+	c.emitted = false
+	c.result = make(map[string]any)
+}
+
+// finish writes the JSON result of the command to standard output: one
+// object holding "command", "ok" and the fields the command set. Commands
+// whose output is the data itself, like cat, have no result object.
+func (c *CLI) finish() {
+	if !c.jsonOutput() || c.streamed || c.emitted {
+		return
+	}
+	c.emit()
+}
+
+// emit writes the JSON result now, for commands that keep running after
+// they have started, like serve
+func (c *CLI) emit() {
+	if !c.jsonOutput() {
+		return
+	}
+	c.result["command"] = c.command
+	c.result["ok"] = !c.failed
+	writeJSON(os.Stdout, c.result)
+	c.emitted = true
+	c.result = make(map[string]any)
+}
+
+// writeJSON writes v as one line of JSON
+func writeJSON(w io.Writer, v any) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
+
+// say reports what the command did. In JSON mode the messages of a command
+// are joined into the "message" field of its result instead.
+func (c *CLI) say(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	if !c.jsonOutput() {
+		fmt.Println(msg)
+		return
+	}
+	if prev, ok := c.result["message"].(string); ok {
+		msg = prev + "\n" + msg
+	}
+	c.result["message"] = msg
+}
+
+// set adds a field to the JSON result of the command
+func (c *CLI) set(key string, value any) {
+	c.result[key] = value
+}
+
+// prompt asks the user for input. In JSON mode it goes to standard error,
+// so that standard output only carries results.
+func (c *CLI) prompt(format string, a ...any) {
+	var w io.Writer = os.Stdout
+	if c.jsonOutput() {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, format, a...)
+}
+
+// hint follows a failure with advice for people; JSON mode leaves it out
+func (c *CLI) hint(msg string) {
+	if !c.jsonOutput() {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+// fail reports an error on standard error and marks the command as failed.
+// In JSON mode the error is an object carrying code, which is one of the
+// code constants, or filesystem.ErrorCode of the error behind the failure.
+func (c *CLI) fail(code, format string, a ...any) {
+	c.failed = true
+	msg := fmt.Sprintf(format, a...)
+	if !c.jsonOutput() {
+		fmt.Fprintln(os.Stderr, msg)
+		return
+	}
+	writeJSON(os.Stderr, jsonError{Command: c.command, Code: code, Message: msg})
+}
+
+// warn reports a problem that does not fail the command, such as a busy
+// unmount that is tried again later. JSON mode uses the given code.
+func (c *CLI) warn(code, format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	if !c.jsonOutput() {
+		fmt.Fprintln(os.Stderr, msg)
+		return
+	}
+	writeJSON(os.Stderr, jsonError{Command: c.command, Code: code, Message: msg})
+}
+
+// setOutput chooses the output format and reports whether it is known
+func (c *CLI) setOutput(format string) bool {
+	if format != outputText && format != outputJSON {
+		return false
+	}
+	c.output = format
+	return true
+}
+
+// setting changes a setting of the interactive shell
+func (c *CLI) setting(args []string) {
+	if len(args) != 3 || args[1] != "output" {
+		c.fail(codeUsage, "Usage: set output text|json")
+		return
+	}
+	if !c.setOutput(args[2]) {
+		c.fail(codeUsage, "Usage: set output text|json")
+		return
+	}
+	c.set("output", c.output)
+	c.say("Output is now %s.", c.output)
+}
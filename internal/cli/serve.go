@@ -0,0 +1,252 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/allim132/filesystem/internal/api"
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/ninep"
+	"github.com/allim132/filesystem/internal/vfs"
+	"github.com/allim132/filesystem/internal/webdav"
+)
+
+const serveUsage = "Usage: serve [--protocol webdav|9p|api] [--addr host:port|unix:path] [--users file] [--tls-cert file --tls-key file]"
+
+func (c *CLI) serve(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+	if !c.batch {
+		c.fail(codeBatchOnly, "serve runs until interrupted and is only available when running a single command, e.g. fs serve --image disk01")
+		return
+	}
+
+	// Separate the flags
+	protocol := "webdav"
+	var addr, usersFile, certFile, keyFile string
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "--protocol" && i+1 < len(args):
+			i++
+			protocol = strings.ToLower(args[i])
+		case args[i] == "--addr" && i+1 < len(args):
+			i++
+			addr = args[i]
+		case args[i] == "--users" && i+1 < len(args):
+			i++
+			usersFile = args[i]
+		case args[i] == "--tls-cert" && i+1 < len(args):
+			i++
+			certFile = args[i]
+		case args[i] == "--tls-key" && i+1 < len(args):
+			i++
+			keyFile = args[i]
+		default:
+			c.fail(codeUsage, serveUsage)
+			return
+		}
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		c.fail(codeInvalid, "--tls-cert and --tls-key must be given together")
+		return
+	}
+	if protocol != "webdav" && certFile != "" {
+		c.fail(codeInvalid, "--tls-cert and --tls-key only apply to WebDAV")
+		return
+	}
+
+	// Stop serving when interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mode := ""
+	if c.fs.ReadOnly() {
+		mode = " read-only"
+	}
+	switch protocol {
+	case "webdav":
+		if addr == "" {
+			addr = "127.0.0.1:8080"
+		}
+		c.serveWebDAV(ctx, addr, usersFile, certFile, keyFile, mode)
+	case "9p":
+		if addr == "" {
+			addr = "127.0.0.1:5640"
+		}
+		if usersFile != "" {
+			c.fail(codeInvalid, "9P has no authentication; --users only applies to WebDAV")
+			return
+		}
+		c.serve9P(ctx, addr, mode)
+	case "api":
+		if addr == "" {
+			addr = "127.0.0.1:8081"
+		}
+		if usersFile != "" {
+			c.fail(codeInvalid, "The API has no authentication; --users only applies to WebDAV")
+			return
+		}
+		c.serveAPI(ctx, addr, mode)
+	default:
+		c.fail(codeUsage, serveUsage)
+	}
+}
+
+// serveWebDAV serves the image over HTTP, or HTTPS when given a certificate
+// and key, until ctx is done, then lets requests in progress finish. Only
+// with both users and TLS is it safe to accept connections from other
+// machines, as basic authentication sends passwords in the clear; otherwise
+// it only listens on a loopback address or a Unix socket.
+func (c *CLI) serveWebDAV(ctx context.Context, addr, usersFile, certFile, keyFile, mode string) {
+	var users map[string]string
+	if usersFile != "" {
+		var err error
+		users, err = webdav.ReadUsers(usersFile)
+		if err != nil {
+			c.fail(filesystem.ErrorCode(err), "Failed to read users: %v", err)
+			return
+		}
+	}
+
+	var listener net.Listener
+	if usersFile != "" && certFile != "" {
+		var err error
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			c.fail(filesystem.ErrorCode(err), "Failed to serve: %v", err)
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+	} else {
+		var ok bool
+		listener, ok = c.listenLocal(ctx, addr, "WebDAV needs --users and --tls-cert to accept other machines")
+		if !ok {
+			return
+		}
+	}
+
+	server := &http.Server{Handler: webdav.NewHandler(c.fs, users)}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	scheme := "WebDAV"
+	if certFile != "" {
+		scheme = "WebDAV over TLS"
+	}
+	c.serving("webdav", listener)
+	c.say("Serving %s%s over %s on %s %s", c.fs.DiskName, mode, scheme, listener.Addr().Network(), listener.Addr())
+	c.emit()
+	var err error
+	if certFile != "" {
+		err = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		c.fail(filesystem.ErrorCode(err), "Failed to serve: %v", err)
+	}
+}
+
+// serve9P serves the image over 9P2000.L on a loopback address or a Unix
+// socket until ctx is done, then saves what clients still connected changed
+func (c *CLI) serve9P(ctx context.Context, addr, mode string) {
+	listener, ok := c.listenLocal(ctx, addr, "9P has no authentication")
+	if !ok {
+		return
+	}
+
+	server := ninep.NewServer(vfs.New(c.fs))
+	c.serving("9p", listener)
+	c.say("Serving %s%s over 9P2000.L on %s %s", c.fs.DiskName, mode, listener.Addr().Network(), listener.Addr())
+	c.emit()
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		c.fail(filesystem.ErrorCode(err), "Failed to serve: %v", err)
+	}
+	if err := server.Sync(); err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to save filesystem: %v", err)
+	}
+}
+
+// serveAPI serves the HTTP+JSON API on a loopback address or a Unix socket
+// until ctx is done, then lets requests in progress finish
+func (c *CLI) serveAPI(ctx context.Context, addr, mode string) {
+	listener, ok := c.listenLocal(ctx, addr, "The API has no authentication")
+	if !ok {
+		return
+	}
+
+	server := &http.Server{Handler: api.NewHandler(c.fs)}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	c.serving("api", listener)
+	c.say("Serving %s%s over the HTTP API on %s %s", c.fs.DiskName, mode, listener.Addr().Network(), listener.Addr())
+	c.emit()
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		c.fail(filesystem.ErrorCode(err), "Failed to serve: %v", err)
+	}
+}
+
+// listenLocal listens on addr for a server that other machines must not
+// reach, for the reason given by why, so addr must be a loopback address or
+// a Unix socket given as unix:path. The listener is closed once ctx is done.
+func (c *CLI) listenLocal(ctx context.Context, addr, why string) (net.Listener, bool) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	} else if !loopback(addr) {
+		c.fail(codeInvalid, "%s; listen on a loopback address or a Unix socket, e.g. --addr unix:/tmp/fs.sock", why)
+		return nil, false
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to serve: %v", err)
+		return nil, false
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	return listener, true
+}
+
+// serving records where a server listens in the JSON result
+func (c *CLI) serving(protocol string, l net.Listener) {
+	c.set("protocol", protocol)
+	c.set("network", l.Addr().Network())
+	c.set("address", l.Addr().String())
+}
+
+// loopback reports whether a host:port address only accepts connections
+// from this machine
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
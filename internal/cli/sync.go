@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+func (c *CLI) sync(args []string) {
+	// Check if the filesystem is loaded
+	if c.fs == nil {
+		c.fail(codeNoFilesystem, "No filesystem loaded. Please create or open a filesystem first.")
+		return
+	}
+
+	// Separate the flags from the directory names
+	var opts filesystem.SyncOptions
+	var names []string
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--delete":
+			opts.Delete = true
+		case "--dry-run":
+			opts.DryRun = true
+		case "--checksum":
+			opts.Checksum = true
+		default:
+			names = append(names, arg)
+		}
+	}
+	if len(names) != 2 {
+		c.fail(codeUsage, "Usage: sync [--delete] [--dry-run] [--checksum] <hostdir> <internaldir|.>")
+		return
+	}
+
+	// Call SyncFS function to copy changes in both directions
+	result, err := filesystem.SyncFS(c.fs, names[0], names[1], opts)
+	if result != nil {
+		type jsonAction struct {
+			Op   string `json:"op"`
+			Name string `json:"name"`
+		}
+		conflicts := 0
+		actions := make([]jsonAction, 0, len(result.Actions))
+		for _, action := range result.Actions {
+			actions = append(actions, jsonAction{action.Op.String(), action.Name})
+			if action.Op == filesystem.SyncConflict {
+				conflicts++
+				c.fail(codeConflict, "Conflict: %s changed on both sides; copy it by hand to resolve", action.Name)
+				continue
+			}
+			if !c.jsonOutput() {
+				fmt.Printf("%s: %s\n", action.Op, action.Name)
+			}
+		}
+		for _, failure := range result.Failed {
+			c.fail(filesystem.ErrorCode(failure), "Failed: %v", failure)
+		}
+		changes := len(result.Actions) - conflicts - len(result.Failed)
+		c.set("actions", actions)
+		c.set("changes", changes)
+		c.set("conflicts", conflicts)
+		c.set("failed", len(result.Failed))
+		c.set("dry_run", opts.DryRun)
+		if opts.DryRun {
+			c.say("Dry run: %d changes, %d conflicts.", changes, conflicts)
+		} else {
+			c.say("%d changes, %d conflicts, %d failed.", changes, conflicts, len(result.Failed))
+		}
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to sync: %v", err)
+	}
+}
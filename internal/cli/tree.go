@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// copyArgs holds the flags shared by put and get, and their other arguments
+type copyArgs struct {
+	recursive bool
+	tree      filesystem.TreeOptions
+	names     []string
+}
+
+// parseCopyArgs separates -r, --include, --exclude and the overwrite flags
+// from the file names. It returns false if a pattern is missing.
+func parseCopyArgs(args []string) (copyArgs, bool) {
+	var parsed copyArgs
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-r" || arg == "--recursive":
+			parsed.recursive = true
+		case arg == "--overwrite" || arg == "-f":
+			parsed.tree.Mode = filesystem.PutOverwrite
+		case arg == "--no-clobber" || arg == "-n":
+			parsed.tree.Mode = filesystem.PutNoClobber
+		case arg == "--include" || arg == "--exclude":
+			if i+1 == len(args) {
+				return parsed, false
+			}
+			i++
+			if arg == "--include" {
+				parsed.tree.Include = append(parsed.tree.Include, args[i])
+			} else {
+				parsed.tree.Exclude = append(parsed.tree.Exclude, args[i])
+			}
+		case strings.HasPrefix(arg, "--include="):
+			parsed.tree.Include = append(parsed.tree.Include, strings.TrimPrefix(arg, "--include="))
+		case strings.HasPrefix(arg, "--exclude="):
+			parsed.tree.Exclude = append(parsed.tree.Exclude, strings.TrimPrefix(arg, "--exclude="))
+		default:
+			parsed.names = append(parsed.names, arg)
+		}
+	}
+	return parsed, true
+}
+
+// putTree stores a host directory under an internal directory, which
+// defaults to the host directory's own name
+func (c *CLI) putTree(parsed copyArgs) {
+	if len(parsed.names) < 1 || len(parsed.names) > 2 {
+		c.fail(codeUsage, "Usage: put -r [--include pattern] [--exclude pattern] [--overwrite|--no-clobber] <hostdir> [internaldir]")
+		return
+	}
+	hostDir := parsed.names[0]
+	dir := filepath.Base(filepath.Clean(hostDir))
+	if len(parsed.names) == 2 {
+		dir = parsed.names[1]
+	}
+	if dir == "." || dir == "/" {
+		dir = ""
+	}
+
+	// Call PutTreeFS function to store the whole tree
+	var summary *filesystem.TreeSummary
+	var err error
+	if c.tx != nil {
+		summary, err = c.tx.PutTree(hostDir, dir, parsed.tree)
+	} else {
+		summary, err = filesystem.PutTreeFS(c.fs, hostDir, dir, parsed.tree)
+	}
+	c.treeSummary(summary, err)
+}
+
+// getTree copies an internal directory, or the whole image, to a host
+// directory
+func (c *CLI) getTree(parsed copyArgs) {
+	if len(parsed.names) != 2 {
+		c.fail(codeUsage, "Usage: get -r [--include pattern] [--exclude pattern] [--no-clobber] <internaldir|.> <hostdir>")
+		return
+	}
+
+	// Call GetTreeFS function to copy the whole tree out
+	var summary *filesystem.TreeSummary
+	var err error
+	if c.tx != nil {
+		summary, err = c.tx.GetTree(parsed.names[0], parsed.names[1], parsed.tree)
+	} else {
+		summary, err = filesystem.GetTreeFS(c.fs, parsed.names[0], parsed.names[1], parsed.tree)
+	}
+	c.treeSummary(summary, err)
+}
+
+// treeSummary reports every file that failed and the totals of a tree copy,
+// import or mkfs
+func (c *CLI) treeSummary(summary *filesystem.TreeSummary, err error) {
+	if summary != nil {
+		for _, failure := range summary.Failed {
+			c.fail(filesystem.ErrorCode(failure), "Failed: %v", failure)
+		}
+		c.set("copied", summary.Copied)
+		c.set("skipped", summary.Skipped)
+		c.set("failed", len(summary.Failed))
+		c.say("%d copied, %d skipped, %d failed.", summary.Copied, summary.Skipped, len(summary.Failed))
+	}
+	if err != nil {
+		c.fail(filesystem.ErrorCode(err), "Failed to copy files: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat is a kind of archive ExportFS can write
+type ArchiveFormat string
+
+const (
+	ArchiveTar   ArchiveFormat = "tar"
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	ArchiveZip   ArchiveFormat = "zip"
+)
+
+// ArchiveFormatFor picks the archive format from a file name's extension,
+// returning "" if it is not one ExportFS knows
+func ArchiveFormatFor(name string) ArchiveFormat {
+	switch lower := strings.ToLower(name); {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTarGz
+	case strings.HasSuffix(lower, ".tar"):
+		return ArchiveTar
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip
+	}
+	return ""
+}
+
+// ExportFS writes every file in the file system to w as an archive, streaming
+// each file straight from its blocks. Entries keep the file's name, size and
+// modification time; tar entries also name the owner, which zip has no field
+// for, so zip entries carry it in their comment.
+func ExportFS(fs *FileSystem, w io.Writer, format ArchiveFormat) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	switch format {
+	case ArchiveTar:
+		return fs.exportTar(w)
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		if err := fs.exportTar(gz); err != nil {
+			return err
+		}
+		return gz.Close()
+	case ArchiveZip:
+		return fs.exportZip(w)
+	}
+	return fmt.Errorf("%w: unknown archive format %q", ErrInvalid, format)
+}
+
+// exportTar writes every file to a tar stream
+func (fs *FileSystem) exportTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, file := range fs.files() {
+		entry, err := fs.exportEntry(file)
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Size:     int64(entry.FileSize),
+			Mode:     0644,
+			ModTime:  time.Unix(int64(entry.LastModified), 0),
+			Uname:    string(bytes.Trim(entry.Username[:], "\x00")),
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write archive entry for %s: %w", file.name, err)
+		}
+		if err := fs.copyOut(int(file.inode), tw); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", file.name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// exportZip writes every file to a zip archive
+func (fs *FileSystem) exportZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, file := range fs.files() {
+		entry, err := fs.exportEntry(file)
+		if err != nil {
+			return err
+		}
+		header := &zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: time.Unix(int64(entry.LastModified), 0),
+		}
+		if owner := string(bytes.Trim(entry.Username[:], "\x00")); owner != "" {
+			header.Comment = "owner: " + owner
+		}
+		header.SetMode(0644)
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("failed to write archive entry for %s: %w", file.name, err)
+		}
+		if err := fs.copyOut(int(file.inode), fw); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", file.name, err)
+		}
+	}
+	return zw.Close()
+}
+
+// exportEntry returns the DABPT entry of a file being exported
+func (fs *FileSystem) exportEntry(file fileEntry) (DABPTEntry, error) {
+	if file.inode < 0 || int(file.inode) >= len(fs.DABPT) {
+		return DABPTEntry{}, fmt.Errorf("%w: invalid DABPT index for file %s", ErrCorrupt, file.name)
+	}
+	return fs.DABPT[file.inode], nil
+}
+
+// archiveEntry describes a file read from an archive
+type archiveEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Owner   string
+	Regular bool
+}
+
+// walkArchive calls fn with every entry of the archive file name, in order,
+// along with a reader for the entry's contents
+func walkArchive(name string, format ArchiveFormat, fn func(archiveEntry, io.Reader) error) error {
+	if format == ArchiveZip {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			entry := archiveEntry{
+				Name:    f.Name,
+				Size:    int64(f.UncompressedSize64),
+				ModTime: f.Modified,
+				Owner:   strings.TrimPrefix(f.Comment, "owner: "),
+				Regular: f.Mode().IsRegular(),
+			}
+			if f.Comment == entry.Owner {
+				entry.Owner = "" // Not a comment written by ExportFS
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			err = fn(entry, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	switch format {
+	case ArchiveTarGz:
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ArchiveTar:
+	default:
+		return fmt.Errorf("%w: unknown archive format %q", ErrInvalid, format)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := archiveEntry{
+			Name:    hdr.Name,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			Owner:   hdr.Uname,
+			Regular: hdr.Typeflag == tar.TypeReg,
+		}
+		if err := fn(entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveName turns the path of an archive entry into a file name, dropping
+// any leading "/" or "./"
+func archiveName(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// ImportFS stores every regular file in an archive written by ExportFS, or by
+// tar or zip, keeping each entry's name, modification time and owner. mode
+// decides what happens to files that already exist. Entries that are not
+// regular files are skipped, and files that fail are reported in the summary
+// while the rest are still imported. The image is saved once at the end.
+func ImportFS(fs *FileSystem, archive string, format ArchiveFormat, mode PutMode) (*TreeSummary, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.beginWrite(); err != nil {
+		return nil, err
+	}
+
+	summary := &TreeSummary{}
+	err := walkArchive(archive, format, func(entry archiveEntry, r io.Reader) error {
+		name := archiveName(entry.Name)
+		if !entry.Regular || name == "" {
+			summary.Skipped++
+			return nil
+		}
+		clean, err := fs.cleanName(name)
+		if err == nil && mode == PutNoClobber {
+			if _, err := fs.lookup(clean); err == nil {
+				summary.Skipped++
+				return nil
+			}
+		}
+
+		opts := PutOptions{Name: name, Mode: mode, Owner: entry.Owner, AllowEmpty: true}
+		err = fs.put(r, opts, entry.Size, entry.ModTime)
+		if err != nil {
+			summary.Failed = append(summary.Failed, fmt.Errorf("%s: %w", entry.Name, err))
+			return nil
+		}
+		summary.Copied++
+		return nil
+	})
+	if err != nil {
+		return summary, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	if summary.Copied > 0 {
+		return summary, fs.autosave()
+	}
+	return summary, nil
+}
+
+// BuildOptions control how CreateFSFromArchive builds a file system
+type BuildOptions struct {
+	User         string    // Owner of files the archive names no owner for
+	Reproducible bool      // Canonicalize the result, see CanonicalizeFS
+	Epoch        time.Time // Time stamp of a reproducible build
+}
+
+// CreateFSFromArchive creates and formats a file system just big enough to
+// hold every regular file in an archive, then imports them. The caller saves
+// the result under the image name of its choice. With opts.Reproducible the
+// image only depends on the archive's files and opts, not on the order of
+// the entries or the time of the build.
+func CreateFSFromArchive(archive string, format ArchiveFormat, opts BuildOptions) (*FileSystem, *TreeSummary, error) {
+	// Work out how many FNT entries, inodes and blocks the files need
+	numFilenames, numFiles, dataBlocks := 0, 0, 0
+	err := walkArchive(archive, format, func(entry archiveEntry, r io.Reader) error {
+		name := archiveName(entry.Name)
+		if !entry.Regular || name == "" {
+			return nil
+		}
+		numFilenames += nameEntries(len(name))
+		numFiles++
+		if entry.Size > MaxInlineSize {
+			blocks := blocksForSize(entry.Size)
+			dataBlocks += blocks + (blocks+PointersPerBPT-1)/PointersPerBPT
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	// Tables come in whole metadata blocks, with an inode for every name
+	roundUp := func(n, perBlock int) int {
+		return max(1, (n+perBlock-1)/perBlock) * perBlock
+	}
+	numFilenames = roundUp(numFilenames, fntEntriesPerBlock)
+	numDABPTEntries := roundUp(max(numFiles, numFilenames), dabptEntriesPerBlock)
+	metaBlocks := metaBlocksFor(numFilenames, numDABPTEntries)
+
+	fs := CreateFS(metaBlocks+dataBlocks, opts.User)
+	fs.staging = true // Nothing to save to until the caller names the image
+	if opts.Reproducible {
+		fs.Clock = func() time.Time { return opts.Epoch }
+	}
+	if err := FormatFS(fs, numFilenames, numDABPTEntries); err != nil {
+		return nil, nil, err
+	}
+	summary, err := ImportFS(fs, archive, format, PutCreate)
+	if err == nil && opts.Reproducible {
+		err = CanonicalizeFS(fs, opts.Epoch)
+	}
+	fs.staging = false
+	if err != nil {
+		return nil, summary, err
+	}
+	return fs, summary, nil
+}
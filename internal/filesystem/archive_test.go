@@ -0,0 +1,80 @@
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	files := map[string][]byte{
+		"tiny.txt":    []byte("tiny"),
+		"dir/big.bin": bytes.Repeat([]byte("0123456789"), 100),
+		"dir/empty":   {},
+	}
+	fs := newTestImage(t, 256)
+	for name, data := range files {
+		opts := PutOptions{Name: name, AllowEmpty: true}
+		if _, err := PutReaderFS(fs, bytes.NewReader(data), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, format := range []ArchiveFormat{ArchiveTar, ArchiveTarGz, ArchiveZip} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := ExportFS(fs, &buf, format); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(t.TempDir(), "files."+string(format))
+			if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			imported := newTestImage(t, 256)
+			summary, err := ImportFS(imported, archive, format, PutCreate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.Copied != len(files) || len(summary.Failed) != 0 {
+				t.Fatalf("import copied %d and failed %v, want %d copied", summary.Copied, summary.Failed, len(files))
+			}
+			checkFiles(t, imported, files)
+
+			built, summary, err := CreateFSFromArchive(archive, format, BuildOptions{User: "tester"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.Copied != len(files) || len(summary.Failed) != 0 {
+				t.Fatalf("build copied %d and failed %v, want %d copied", summary.Copied, summary.Failed, len(files))
+			}
+			checkFiles(t, built, files)
+		})
+	}
+}
+
+// checkFiles fails unless fs holds exactly the given files
+func checkFiles(t *testing.T, fs *FileSystem, files map[string][]byte) {
+	t.Helper()
+	stats, err := FilesFS(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(files) {
+		t.Fatalf("image holds %d files, want %d", len(stats), len(files))
+	}
+	for _, st := range stats {
+		want, ok := files[st.Name]
+		if !ok {
+			t.Fatalf("image holds unexpected file %s", st.Name)
+		}
+		var got bytes.Buffer
+		if err := GetWriterFS(fs, st.Name, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("%s holds %q, want %q", st.Name, got.Bytes(), want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// HoleBlock marks a Block Pointer Table slot that has no data block
+	// behind it. Holes read back as zeros and take no space on disk.
+	HoleBlock = -1
+
+	// PointersPerBPT is the number of data block pointers held by one
+	// Block Pointer Table block; the next slot chains to the following table.
+	PointersPerBPT = 7
+
+	bptChainSlot = PointersPerBPT
+
+	// maxFileSize is the largest size DABPTEntry.FileSize can represent
+	maxFileSize = 1<<31 - 1
+)
+
+// blocksForSize returns how many logical blocks a file of size bytes spans
+func blocksForSize(size int64) int {
+	return int((size + BlockSize - 1) / BlockSize)
+}
+
+// isZeroBlock reports whether every byte of data is zero
+func isZeroBlock(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validBlock reports whether index refers to a block of the disk
+func (fs *FileSystem) validBlock(index int32) bool {
+	return index >= 0 && int(index) < len(fs.DataBlocks)
+}
+
+// bptSlot reads pointer slot of the Block Pointer Table stored in block bpt
+func (fs *FileSystem) bptSlot(bpt, slot int) int32 {
+	return int32(binary.LittleEndian.Uint32(fs.DataBlocks[bpt][4+slot*4:]))
+}
+
+// setBPTSlot writes pointer slot of the Block Pointer Table stored in block bpt
+func (fs *FileSystem) setBPTSlot(bpt, slot int, value int32) {
+	binary.LittleEndian.PutUint32(fs.DataBlocks[bpt][4+slot*4:], uint32(value))
+}
+
+// bptChain returns the Block Pointer Table blocks of an inode in chain order
+func (fs *FileSystem) bptChain(inode int) ([]int, error) {
+	var chain []int
+	bpt := fs.DABPT[inode].BlockPointerTableIndex
+	for bpt != HoleBlock {
+		if !fs.validBlock(bpt) || len(chain) >= len(fs.DataBlocks) {
+			return nil, fmt.Errorf("%w: Block Pointer Table chain of inode %d leaves the disk or loops", ErrCorrupt, inode)
+		}
+		chain = append(chain, int(bpt))
+		bpt = fs.bptSlot(int(bpt), bptChainSlot)
+	}
+	return chain, nil
+}
+
+// fileBlocks returns the physical block behind every logical block of an
+// inode. Logical blocks without storage are reported as HoleBlock.
+func (fs *FileSystem) fileBlocks(inode int) ([]int32, error) {
+	if inode < 0 || inode >= len(fs.DABPT) {
+		return nil, fmt.Errorf("%w: invalid inode %d", ErrCorrupt, inode)
+	}
+	chain, err := fs.bptChain(inode)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]int32, blocksForSize(int64(fs.DABPT[inode].FileSize)))
+	for i := range blocks {
+		blocks[i] = HoleBlock
+		if i/PointersPerBPT >= len(chain) {
+			continue
+		}
+		ptr := fs.bptSlot(chain[i/PointersPerBPT], i%PointersPerBPT)
+		if ptr != HoleBlock && !fs.validBlock(ptr) {
+			return nil, fmt.Errorf("%w: block pointer %d of inode %d is outside the disk", ErrCorrupt, ptr, inode)
+		}
+		blocks[i] = ptr
+	}
+	return blocks, nil
+}
+
+// allocatedBlocks returns how many blocks an inode occupies on disk,
+// counting both data blocks and Block Pointer Table blocks
+func (fs *FileSystem) allocatedBlocks(inode int) (int, error) {
+	chain, err := fs.bptChain(inode)
+	if err != nil {
+		return 0, err
+	}
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return 0, err
+	}
+	count := len(chain)
+	for _, blk := range blocks {
+		if blk != HoleBlock {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// readAt reads len(p) bytes of an inode starting at off. Holes read as zeros.
+func (fs *FileSystem) readAt(inode int, p []byte, off int64) (int, error) {
+	size := int64(fs.DABPT[inode].FileSize)
+	if off >= size {
+		return 0, nil
+	}
+	if remaining := size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if fs.DABPT[inode].Flags&InodeInline != 0 {
+		return copy(p, fs.DABPT[inode].Inline[off:size]), nil
+	}
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		inBlock := int(pos % BlockSize)
+		chunk := min(len(p)-n, BlockSize-inBlock)
+		if blk := blocks[pos/BlockSize]; blk == HoleBlock {
+			clear(p[n : n+chunk])
+		} else {
+			copy(p[n:n+chunk], fs.DataBlocks[blk][inBlock:])
+		}
+		n += chunk
+	}
+	return n, nil
+}
+
+// writeAt writes p into an inode starting at off, growing the file when the
+// write ends past EOF. Any gap between the old EOF and off is left as a hole,
+// and chunks of zeros that land on a hole do not allocate a block.
+func (fs *FileSystem) writeAt(inode int, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%w: negative offset", ErrInvalid)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	entry := &fs.DABPT[inode]
+	end := off + int64(len(p))
+	if end > maxFileSize {
+		return 0, fmt.Errorf("%w: file would exceed maximum size", ErrInvalid)
+	}
+	if entry.Flags&InodeInline != 0 {
+		if end <= MaxInlineSize {
+			copy(entry.Inline[off:], p)
+			entry.FileSize = int32(max(end, int64(entry.FileSize)))
+			return len(p), nil
+		}
+		if err := fs.promoteInline(inode); err != nil {
+			return 0, err
+		}
+	}
+	if entry.BlockPointerTableIndex == HoleBlock {
+		bpt, err := fs.allocateBlockPointerTable(blocksForSize(end))
+		if err != nil {
+			return 0, err
+		}
+		entry.BlockPointerTableIndex = int32(bpt)
+	}
+	if end > int64(entry.FileSize) {
+		entry.FileSize = int32(end)
+	}
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		logical := int(pos / BlockSize)
+		inBlock := int(pos % BlockSize)
+		chunk := min(len(p)-n, BlockSize-inBlock)
+		data := p[n : n+chunk]
+
+		blk := blocks[logical]
+		if blk == HoleBlock {
+			if isZeroBlock(data) {
+				n += chunk
+				continue
+			}
+			newBlock, err := fs.allocateDataBlock()
+			if err != nil {
+				return n, err
+			}
+			err = fs.updateBlockPointerTable(int(entry.BlockPointerTableIndex), logical, newBlock)
+			if err != nil {
+				fs.freeBlock(newBlock)
+				return n, err
+			}
+			blk = int32(newBlock)
+			blocks[logical] = blk
+		}
+		copy(fs.DataBlocks[blk][inBlock:], data)
+		n += chunk
+	}
+	return n, nil
+}
+
+// truncate changes the size of an inode. Growing a file only records the new
+// size, leaving the extension as a hole; shrinking it releases every block
+// past the new end and zeroes the slack of the last block kept.
+func (fs *FileSystem) truncate(inode int, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%w: negative size", ErrInvalid)
+	}
+	if size > maxFileSize {
+		return fmt.Errorf("%w: file would exceed maximum size", ErrInvalid)
+	}
+	entry := &fs.DABPT[inode]
+	if entry.Flags&InodeInline != 0 {
+		if size <= MaxInlineSize {
+			if size < int64(entry.FileSize) {
+				clear(entry.Inline[size:])
+			}
+			entry.FileSize = int32(size)
+			return nil
+		}
+		if err := fs.promoteInline(inode); err != nil {
+			return err
+		}
+	}
+	if size >= int64(entry.FileSize) {
+		entry.FileSize = int32(size)
+		return nil
+	}
+
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return err
+	}
+	chain, err := fs.bptChain(inode)
+	if err != nil {
+		return err
+	}
+
+	keep := blocksForSize(size)
+	for i := keep; i < len(blocks); i++ {
+		if blocks[i] != HoleBlock {
+			fs.freeBlock(int(blocks[i]))
+		}
+	}
+	if keep > 0 && blocks[keep-1] != HoleBlock {
+		clear(fs.DataBlocks[blocks[keep-1]][size-int64(keep-1)*BlockSize:])
+	}
+
+	// Drop pointers past the new end and release tables that are now empty
+	keepTables := (keep + PointersPerBPT - 1) / PointersPerBPT
+	for t, bpt := range chain {
+		if t >= keepTables {
+			fs.freeBlock(bpt)
+			continue
+		}
+		for slot := 0; slot < PointersPerBPT; slot++ {
+			if t*PointersPerBPT+slot >= keep {
+				fs.setBPTSlot(bpt, slot, HoleBlock)
+			}
+		}
+		if t == keepTables-1 {
+			fs.setBPTSlot(bpt, bptChainSlot, HoleBlock)
+		}
+	}
+	if keepTables == 0 {
+		entry.BlockPointerTableIndex = HoleBlock
+	}
+
+	entry.FileSize = int32(size)
+	return nil
+}
+
+// promoteInline moves the contents of an inline file into data blocks so the
+// file can grow past MaxInlineSize. The inode is left unchanged on failure.
+func (fs *FileSystem) promoteInline(inode int) error {
+	entry := &fs.DABPT[inode]
+	saved := *entry
+	data := make([]byte, entry.FileSize)
+	copy(data, entry.Inline[:])
+
+	entry.Flags &^= InodeInline
+	entry.Inline = [MaxInlineSize]byte{}
+	entry.FileSize = 0
+	entry.BlockPointerTableIndex = HoleBlock
+	if _, err := fs.writeAt(inode, data, 0); err != nil {
+		fs.truncate(inode, 0)
+		*entry = saved
+		return err
+	}
+
+	// Preserve the size even when the inline data ended in zeros
+	entry.FileSize = saved.FileSize
+	return nil
+}
+
+// releaseInode frees every block owned by an inode and resets its entry
+func (fs *FileSystem) releaseInode(inode int) error {
+	if err := fs.truncate(inode, 0); err != nil {
+		return err
+	}
+	fs.DABPT[inode] = DABPTEntry{BlockPointerTableIndex: HoleBlock}
+	return nil
+}
+
+// freeBlock zeroes a block and returns it to the free pool
+func (fs *FileSystem) freeBlock(blockIndex int) {
+	clear(fs.DataBlocks[blockIndex])
+	fs.FreeBlocks[blockIndex] = true
+}
@@ -0,0 +1,258 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestImage returns a formatted file system saved to an image in a
+// temporary directory, closed when the test ends
+func newTestImage(t *testing.T, numBlocks int) *FileSystem {
+	t.Helper()
+	fs := CreateFS(numBlocks, "tester")
+	if err := FormatFS(fs, 16, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveFS(fs, filepath.Join(t.TempDir(), "disk")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseFS(fs) })
+	return fs
+}
+
+// TestConcurrentOperations runs every kind of operation from many goroutines
+// on one image. Run it with -race to check the locking.
+func TestConcurrentOperations(t *testing.T) {
+	fs := newTestImage(t, 4096)
+	host := t.TempDir()
+
+	// A shared file too large to be inline, for WriteAtFS
+	shared := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	if err := os.WriteFile(filepath.Join(host, "shared"), shared, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutFS(fs, filepath.Join(host, "shared")); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	const rounds = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds+1)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				errs <- worker(fs, host, w, i, len(shared))
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		// Transactions race with everything else and may conflict
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			external := filepath.Join(host, fmt.Sprintf("tx-%d", i))
+			if err := os.WriteFile(external, []byte(external), 0644); err != nil {
+				errs <- err
+				return
+			}
+			tx, err := fs.Begin()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := tx.Put(external); err != nil {
+				errs <- err
+				return
+			}
+			if err := tx.Commit(); err != nil && !errors.Is(err, ErrTxConflict) {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every worker leaves exactly its renamed files behind
+	names, err := ListFS(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for _, name := range names {
+		if strings.HasPrefix(name, "File: kept-") {
+			kept++
+		}
+	}
+	if kept != workers*rounds {
+		t.Fatalf("found %d renamed files, want %d, in %v", kept, workers*rounds, names)
+	}
+
+	// The image saved last holds the same files
+	if err := SaveFS(fs, fs.DiskName); err != nil {
+		t.Fatal(err)
+	}
+	CloseFS(fs)
+	reopened, err := OpenFS(fs.DiskName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseFS(reopened)
+	after, err := ListFS(reopened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, after) {
+		t.Fatalf("reopened image lists %v, want %v", after, names)
+	}
+}
+
+// worker does one round of changes and reads for TestConcurrentOperations
+func worker(fs *FileSystem, host string, w, i, sharedSize int) error {
+	// Put a file of its own, read it back and check the contents
+	data := bytes.Repeat([]byte{byte('a' + w)}, 100+i*37)
+	external := filepath.Join(host, fmt.Sprintf("w%d-%d", w, i))
+	if err := os.WriteFile(external, data, 0644); err != nil {
+		return err
+	}
+	if err := PutFS(fs, external); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	name := filepath.Base(external)
+	out := external + ".out"
+	if err := GetFS(fs, name, out); err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("%s: read back %d bytes that differ from the %d stored", name, len(got), len(data))
+	}
+
+	// Rename it away and store and remove a second one
+	if err := RenameFS(fs, name, "kept-"+name); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	temp := filepath.Join(host, fmt.Sprintf("temp-%d-%d", w, i))
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	if err := PutFS(fs, temp); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	if err := RemoveFS(fs, filepath.Base(temp)); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+
+	// Overwrite part of the shared file and read all of it back
+	chunk := []byte(fmt.Sprintf("%x", w))
+	if _, err := WriteAtFS(fs, "shared", chunk, int64((w*61+i*17)%sharedSize)); err != nil {
+		return fmt.Errorf("write at: %w", err)
+	}
+	st, err := StatFS(fs, "shared")
+	if err != nil || st.Size != int64(sharedSize) {
+		return fmt.Errorf("stat: %+v, %v", st, err)
+	}
+
+	_, err = ListFS(fs)
+	return err
+}
+
+// stalledReader returns one chunk of data, then blocks until release is
+// closed before reporting the end
+type stalledReader struct {
+	data    []byte
+	release chan struct{}
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	<-r.release
+	return 0, io.EOF
+}
+
+// stalledWriter blocks every write until release is closed
+type stalledWriter struct {
+	buf     bytes.Buffer
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+// TestSlowClientsDoNotBlock checks that a put from a reader, or a get to a
+// writer, that stalls part way does not hold up other operations
+func TestSlowClientsDoNotBlock(t *testing.T) {
+	fs := newTestImage(t, 256)
+	data := bytes.Repeat([]byte("slow"), 100)
+	if _, err := PutReaderFS(fs, bytes.NewReader(data), PutOptions{Name: "old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := &stalledReader{data: data, release: make(chan struct{})}
+	writer := &stalledWriter{release: make(chan struct{})}
+	done := make(chan error, 2)
+	go func() {
+		_, err := PutReaderFS(fs, reader, PutOptions{Name: "new"})
+		done <- err
+	}()
+	go func() { done <- GetWriterFS(fs, "old", writer) }()
+
+	// Both are stalled, yet reads and writes still go through
+	other := make(chan error, 1)
+	go func() {
+		if _, err := ListFS(fs); err != nil {
+			other <- err
+			return
+		}
+		_, err := PutReaderFS(fs, bytes.NewReader(data), PutOptions{Name: "other"})
+		other <- err
+	}()
+	select {
+	case err := <-other:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled client holds up other operations")
+	}
+
+	close(reader.release)
+	close(writer.release)
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(writer.buf.Bytes(), data) {
+		t.Fatalf("get wrote %d bytes, want %d", writer.buf.Len(), len(data))
+	}
+	if st, err := StatFS(fs, "new"); err != nil || st.Size != int64(len(data)) {
+		t.Fatalf("stat new = %+v, %v", st, err)
+	}
+}
@@ -0,0 +1,168 @@
+package filesystem
+
+import "fmt"
+
+// FileFragmentation describes how a file is laid out on disk. A file is
+// contiguous when Extents is 1: its Block Pointer Tables followed by its data
+// blocks occupy consecutive blocks.
+type FileFragmentation struct {
+	Name    string
+	Blocks  int // Data and Block Pointer Table blocks in use
+	Extents int // Runs of consecutive blocks
+}
+
+// DefragProgress is reported to the DefragFS callback for each file
+type DefragProgress struct {
+	File        string
+	Done        int
+	Total       int
+	BlocksMoved int // Blocks moved so far
+}
+
+// fileLayout returns the blocks of an inode in the order defrag lays them
+// out: the Block Pointer Table chain, then the data blocks in logical order
+func (fs *FileSystem) fileLayout(inode int) ([]int, error) {
+	chain, err := fs.bptChain(inode)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := fs.fileBlocks(inode)
+	if err != nil {
+		return nil, err
+	}
+	layout := append([]int{}, chain...)
+	for _, blk := range blocks {
+		if blk != HoleBlock {
+			layout = append(layout, int(blk))
+		}
+	}
+	return layout, nil
+}
+
+// countExtents returns the number of runs of consecutive blocks in layout
+func countExtents(layout []int) int {
+	extents := 0
+	for i, blk := range layout {
+		if i == 0 || blk != layout[i-1]+1 {
+			extents++
+		}
+	}
+	return extents
+}
+
+// FragmentationFS reports the layout of every file in the file system
+func FragmentationFS(fs *FileSystem) ([]FileFragmentation, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var report []FileFragmentation
+	for _, file := range fs.files() {
+		if file.inode < 0 || int(file.inode) >= len(fs.DABPT) {
+			return nil, fmt.Errorf("%w: invalid DABPT index for file %s", ErrCorrupt, file.name)
+		}
+		layout, err := fs.fileLayout(int(file.inode))
+		if err != nil {
+			return nil, err
+		}
+		report = append(report, FileFragmentation{
+			Name:    file.name,
+			Blocks:  len(layout),
+			Extents: countExtents(layout),
+		})
+	}
+	return report, nil
+}
+
+// DefragFS rewrites the data area so that every file is contiguous, packing
+// files one after another from the first data block in FNT order. Blocks that
+// are marked used but belong to no file are reclaimed. Each move copies the
+// block before repointing the table that references it, so the chains stay
+// consistent at every step. progress, if not nil, is called after each file
+// while the file system is still locked, so it must not call back into fs.
+// DefragFS returns the number of blocks moved.
+func DefragFS(fs *FileSystem, progress func(DefragProgress)) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.defrag(progress)
+}
+
+// defrag does the work of DefragFS; the caller must hold fs.mu
+func (fs *FileSystem) defrag(progress func(DefragProgress)) (int, error) {
+	if err := fs.beginWrite(); err != nil {
+		return 0, err
+	}
+
+	refs, err := fs.blockRefs()
+	if err != nil {
+		return 0, err
+	}
+	// Blocks move one at a time from here on, so even a defrag that fails
+	// part way has changed the layout
+	defer fs.changed()
+
+	// Reclaim blocks leaked by files that no longer exist
+	for i := fs.metaBlocks(); i < fs.TotalBlocks; i++ {
+		if _, ok := refs[i]; !ok && !fs.FreeBlocks[i] {
+			fs.freeBlock(i)
+		}
+	}
+
+	var files []fileEntry
+	for _, file := range fs.files() {
+		if file.inode >= 0 && int(file.inode) < len(fs.DABPT) {
+			files = append(files, file)
+		}
+	}
+
+	moved := 0
+	cursor := fs.metaBlocks()
+	for done, file := range files {
+		layout, err := fs.fileLayout(int(file.inode))
+		if err != nil {
+			return moved, err
+		}
+
+		for k := range layout {
+			target := cursor
+			cursor++
+			if layout[k] == target {
+				continue
+			}
+
+			// Move whatever occupies the target out of the way first
+			if !fs.FreeBlocks[target] {
+				spare := fs.lastFreeBlock()
+				if spare < 0 {
+					return moved, fmt.Errorf("%w: defrag needs at least one free block", ErrNoSpace)
+				}
+				fs.moveBlock(refs, target, spare)
+				moved++
+				for j := k + 1; j < len(layout); j++ {
+					if layout[j] == target {
+						layout[j] = spare
+					}
+				}
+			}
+
+			fs.moveBlock(refs, layout[k], target)
+			layout[k] = target
+			moved++
+		}
+
+		if progress != nil {
+			progress(DefragProgress{File: file.name, Done: done + 1, Total: len(files), BlocksMoved: moved})
+		}
+	}
+	return moved, nil
+}
+
+// lastFreeBlock returns the highest free block, or -1 if the disk is full
+func (fs *FileSystem) lastFreeBlock() int {
+	for i := len(fs.FreeBlocks) - 1; i >= 0; i-- {
+		if fs.FreeBlocks[i] {
+			return i
+		}
+	}
+	return -1
+}
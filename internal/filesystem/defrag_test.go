@@ -0,0 +1,79 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestDefrag(t *testing.T) {
+	fs := newTestImage(t, 256)
+
+	// Interleave two growing files, then free the gaps between them
+	files := make(map[string][]byte)
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 3*BlockSize)
+		name := fmt.Sprintf("f%d", i)
+		if _, err := PutReaderFS(fs, bytes.NewReader(data), PutOptions{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = data
+	}
+	for _, name := range []string{"f1", "f3"} {
+		if err := RemoveFS(fs, name); err != nil {
+			t.Fatal(err)
+		}
+		delete(files, name)
+	}
+	for _, name := range []string{"f0", "f2"} {
+		tail := bytes.Repeat([]byte("z"), 2*BlockSize)
+		if _, err := WriteAtFS(fs, name, tail, int64(len(files[name]))); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = append(files[name], tail...)
+	}
+
+	if extents := fragments(t, fs); extents == len(files) {
+		t.Fatal("no file is fragmented before the defrag")
+	}
+
+	// Progress comes for each file in turn, while the defrag runs
+	var steps []DefragProgress
+	moved, err := DefragFS(fs, func(p DefragProgress) { steps = append(steps, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 {
+		t.Fatal("defrag moved no blocks")
+	}
+	if len(steps) != len(files) {
+		t.Fatalf("got %d progress reports, want %d", len(steps), len(files))
+	}
+	for i, step := range steps {
+		if step.Done != i+1 || step.Total != len(files) {
+			t.Fatalf("progress report %d is %+v", i, step)
+		}
+	}
+	if last := steps[len(steps)-1]; last.BlocksMoved != moved {
+		t.Fatalf("last progress report has %d blocks moved, want %d", last.BlocksMoved, moved)
+	}
+
+	if extents := fragments(t, fs); extents != len(files) {
+		t.Fatalf("files are in %d extents after the defrag, want %d", extents, len(files))
+	}
+	checkFiles(t, fs, files)
+}
+
+// fragments returns the number of extents of all files together
+func fragments(t *testing.T, fs *FileSystem) int {
+	t.Helper()
+	report, err := FragmentationFS(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents := 0
+	for _, f := range report {
+		extents += f.Extents
+	}
+	return extents
+}
@@ -0,0 +1,71 @@
+package filesystem
+
+import "io"
+
+// Disk is the file system's data blocks seen as a single device of
+// TotalBlocks*BlockSize bytes, for tools that work with block devices. Writes
+// go straight to the blocks, around the FNT and DABPT, so they change files
+// in place and can damage them if the writer does not know the layout. Small
+// files kept inline in their DABPT entry are not on the device at all.
+type Disk struct {
+	fs *FileSystem
+}
+
+// DiskFS returns the device holding the data blocks of fs
+func DiskFS(fs *FileSystem) *Disk {
+	return &Disk{fs: fs}
+}
+
+// Size returns the size of the device in bytes
+func (d *Disk) Size() int64 {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	return int64(d.fs.TotalBlocks) * BlockSize
+}
+
+// ReadAt reads the blocks covering p, as io.ReaderAt does
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+
+	n := 0
+	for n < len(p) {
+		block, within := (off+int64(n))/BlockSize, (off+int64(n))%BlockSize
+		if block >= int64(len(d.fs.DataBlocks)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], d.fs.DataBlocks[block][within:])
+	}
+	return n, nil
+}
+
+// WriteAt writes p over the blocks it covers. Writing past the end of the
+// device fails with ErrNoSpace after writing what fits.
+func (d *Disk) WriteAt(p []byte, off int64) (int, error) {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	if off < 0 {
+		return 0, ErrInvalid
+	}
+	if err := d.fs.beginWrite(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	var err error
+	for n < len(p) {
+		block, within := (off+int64(n))/BlockSize, (off+int64(n))%BlockSize
+		if block >= int64(len(d.fs.DataBlocks)) {
+			err = ErrNoSpace
+			break
+		}
+		n += copy(d.fs.DataBlocks[block][within:], p[n:])
+	}
+	if n > 0 {
+		d.fs.changed()
+	}
+	return n, err
+}
@@ -0,0 +1,96 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	iofs "io/fs"
+)
+
+// Errors returned by the file system operations, wrapped with more detail.
+// Test for them with errors.Is. ErrNotExist, ErrExist, ErrInvalid and
+// ErrUnsupported are the io/fs and errors package values, and ErrReadOnly
+// matches fs.ErrPermission, so code written against io/fs works unchanged.
+var (
+	ErrNotExist    = iofs.ErrNotExist
+	ErrExist       = iofs.ErrExist
+	ErrInvalid     = iofs.ErrInvalid
+	ErrUnsupported = errors.ErrUnsupported
+	ErrNoSpace     = errors.New("not enough space in the file system")
+	ErrNoInodes    = errors.New("no free FNT entries")
+	ErrNameTooLong = errors.New("file name too long")
+	ErrCorrupt     = errors.New("file system is corrupt")
+	ErrLocked      = errors.New("image is locked by another process")
+	ErrReadOnly    = fmt.Errorf("file system is read-only: %w", iofs.ErrPermission)
+
+	// ErrTxDone is returned when using a transaction after Commit or Rollback
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+	// ErrTxConflict is returned by Commit when the file system was changed
+	// outside the transaction after Begin. The transaction is discarded.
+	ErrTxConflict = errors.New("file system changed since the transaction began")
+)
+
+// pathError attaches the operation and internal file name to err, in the
+// form used by os and io/fs. It returns nil if err is nil.
+func pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+// checkWritable returns ErrReadOnly for read-only file systems
+func (fs *FileSystem) checkWritable() error {
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// beginWrite is called with fs.mu held by every operation that changes the
+// contents of the file system, and refuses changes to read-only file systems
+func (fs *FileSystem) beginWrite() error {
+	return fs.checkWritable()
+}
+
+// changed is called with fs.mu held once an operation has changed the
+// contents of the file system. It bumps the generation so that open
+// transactions notice the change; operations that fail before changing
+// anything leave them be.
+func (fs *FileSystem) changed() {
+	fs.generation++
+}
+
+// ErrorCode returns a short name for the kind of error err is, such as
+// "not_exist" or "no_space", for reporting errors to other programs. The
+// names do not change between releases. Errors other than the Err values of
+// this package are "internal".
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrReadOnly):
+		return "read_only"
+	case errors.Is(err, ErrNotExist):
+		return "not_exist"
+	case errors.Is(err, ErrExist):
+		return "exist"
+	case errors.Is(err, ErrNameTooLong):
+		return "name_too_long"
+	case errors.Is(err, ErrInvalid):
+		return "invalid"
+	case errors.Is(err, ErrUnsupported):
+		return "unsupported"
+	case errors.Is(err, ErrNoSpace):
+		return "no_space"
+	case errors.Is(err, ErrNoInodes):
+		return "no_inodes"
+	case errors.Is(err, ErrCorrupt):
+		return "corrupt"
+	case errors.Is(err, ErrLocked):
+		return "locked"
+	case errors.Is(err, ErrTxDone):
+		return "tx_done"
+	case errors.Is(err, ErrTxConflict):
+		return "tx_conflict"
+	}
+	return "internal"
+}
@@ -0,0 +1,79 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ImageLockedError is returned when another process holds the lock on a disk
+// image. PID is zero when the holder could not be determined.
+type ImageLockedError struct {
+	Name string
+	PID  int
+}
+
+func (e *ImageLockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("image %s is in use by another process", e.Name)
+	}
+	return fmt.Sprintf("image %s is in use by PID %d", e.Name, e.PID)
+}
+
+// Is makes errors.Is(err, ErrLocked) report true for an *ImageLockedError
+func (e *ImageLockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// imageLock is an advisory lock on a disk image, held on a lock file next to
+// the image so that rewriting the image itself does not drop it. file is nil
+// when the image is used without a lock.
+type imageLock struct {
+	name      string
+	file      *os.File
+	exclusive bool
+}
+
+// lockPath returns the lock file used for the image name
+func lockPath(name string) string {
+	return name + ".lock"
+}
+
+// readLockPID returns the PID recorded in a lock file, or zero
+func readLockPID(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// lockImage takes the lock for the image name. A held lock is an error unless
+// force is set, in which case the image is used without a lock.
+func lockImage(name string, exclusive, force bool) (*imageLock, error) {
+	lock, err := acquireImageLock(name, exclusive)
+	if err != nil {
+		if _, held := err.(*ImageLockedError); held && force {
+			return &imageLock{name: name, exclusive: exclusive}, nil
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+// CloseFS releases the lock held on the file system's disk image. The file
+// system must not be used afterwards.
+func CloseFS(fs *FileSystem) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.lock == nil {
+		return nil
+	}
+	err := fs.lock.release()
+	fs.lock = nil
+	return err
+}
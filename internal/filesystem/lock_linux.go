@@ -0,0 +1,62 @@
+//go:build linux
+
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// acquireImageLock takes a flock on the lock file of the image name, shared
+// for readers and exclusive for writers. Exclusive holders record their PID
+// in the lock file so that other processes can report who is using it.
+// Readers only need read access, and go without a lock when the lock file
+// cannot be created, as happens for images on read-only media.
+func acquireImageLock(name string, exclusive bool) (*imageLock, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if !exclusive {
+		flag = os.O_RDONLY | os.O_CREATE
+	}
+	file, err := os.OpenFile(lockPath(name), flag, 0644)
+	if err != nil && !exclusive {
+		return &imageLock{name: name}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		pid := readLockPID(file)
+		file.Close()
+		return nil, &ImageLockedError{Name: name, PID: pid}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock image: %w", err)
+	}
+
+	if exclusive {
+		file.Truncate(0)
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &imageLock{name: name, file: file, exclusive: exclusive}, nil
+}
+
+// release drops the lock and closes the lock file
+func (l *imageLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+	if l.exclusive {
+		l.file.Truncate(0)
+	}
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	return l.file.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package filesystem
+
+// acquireImageLock does not lock anything on platforms without flock support
+func acquireImageLock(name string, exclusive bool) (*imageLock, error) {
+	return &imageLock{name: name, exclusive: exclusive}, nil
+}
+
+// release has nothing to do when no lock was taken
+func (l *imageLock) release() error {
+	return nil
+}
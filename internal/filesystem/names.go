@@ -0,0 +1,179 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxNameLength is the longest file name, in bytes, that can be stored.
+	// Names longer than MaxFilename continue in the FNT entries that follow.
+	MaxNameLength = 255
+
+	// fntContinuation is the InodePointer of an FNT entry that holds the next
+	// MaxFilename bytes of the name started in the entry before it
+	fntContinuation = -2
+)
+
+// fileEntry is a file found in the FNT
+type fileEntry struct {
+	fnt   int // Index of the FNT entry the name starts in
+	name  string
+	inode int32
+}
+
+// files returns every file in the FNT, in FNT order
+func (fs *FileSystem) files() []fileEntry {
+	var files []fileEntry
+	for i := 0; i < len(fs.FNT); i++ {
+		entry := fs.FNT[i]
+		if entry.Filename == [MaxFilename]byte{} || entry.InodePointer == fntContinuation {
+			continue
+		}
+		start := i
+		name := append([]byte{}, entry.Filename[:]...)
+		for i+1 < len(fs.FNT) && fs.FNT[i+1].InodePointer == fntContinuation {
+			i++
+			name = append(name, fs.FNT[i].Filename[:]...)
+		}
+		files = append(files, fileEntry{
+			fnt:   start,
+			name:  string(bytes.Trim(name, "\x00")),
+			inode: entry.InodePointer,
+		})
+	}
+	return files
+}
+
+// nameEntries returns how many FNT entries a name of n bytes takes up
+func nameEntries(n int) int {
+	return max(1, (n+MaxFilename-1)/MaxFilename)
+}
+
+// cleanName validates a file name and returns the form it is stored under,
+// after applying the file system's NameNormalizer. The FNT is flat, but names
+// may contain '/' to stand for a path in a directory tree, so every element
+// between slashes must itself be a valid name.
+func (fs *FileSystem) cleanName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: name is not valid UTF-8", ErrInvalid)
+	}
+	if fs.NameNormalizer != nil {
+		name = fs.NameNormalizer(name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return "", fmt.Errorf("%w: %q is not a valid name", ErrInvalid, name)
+		}
+	}
+	if len(name) > MaxNameLength {
+		return "", ErrNameTooLong
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return "", fmt.Errorf("%w: name contains %q", ErrInvalid, r)
+		}
+	}
+	return name, nil
+}
+
+// checkPath refuses a name that would make a file and a directory of the same
+// name coexist: a file cannot sit below another file, nor take the name of a
+// directory that already holds files. ignore is the FNT index of a file that
+// is being renamed and so does not count, or -1.
+func (fs *FileSystem) checkPath(name string, ignore int) error {
+	for _, file := range fs.files() {
+		if file.fnt == ignore {
+			continue
+		}
+		if strings.HasPrefix(name, file.name+"/") {
+			return fmt.Errorf("%w: %s is a file, not a directory", ErrExist, file.name)
+		}
+		if strings.HasPrefix(file.name, name+"/") {
+			return fmt.Errorf("%w: %s is a directory", ErrExist, name)
+		}
+	}
+	return nil
+}
+
+// storeName writes a name into free FNT entries and returns the index of the
+// first one. The entries are consecutive, so the FNT is grown when there is
+// no long enough run of free entries. The inode pointer is left unset.
+func (fs *FileSystem) storeName(name string) (int, error) {
+	need := nameEntries(len(name))
+	start := fs.freeRun(need)
+	if start < 0 {
+		// Grow by whole metadata blocks, counting free entries already at the end
+		trailing := 0
+		for i := len(fs.FNT) - 1; i >= 0 && fs.FNT[i].Filename == [MaxFilename]byte{}; i-- {
+			trailing++
+		}
+		grow := (need - trailing + fntEntriesPerBlock - 1) / fntEntriesPerBlock * fntEntriesPerBlock
+		err := fs.growTables(len(fs.FNT)+grow, max(len(fs.FNT)+grow, len(fs.DABPT)))
+		if err != nil {
+			return -1, fmt.Errorf("%w and the FNT cannot grow: %w", ErrNoInodes, err)
+		}
+		start = fs.freeRun(need)
+	}
+
+	for k := 0; k < need; k++ {
+		entry := FNTEntry{InodePointer: fntContinuation}
+		if k == 0 {
+			entry.InodePointer = -1
+		}
+		copy(entry.Filename[:], name[min(len(name), k*MaxFilename):])
+		fs.FNT[start+k] = entry
+	}
+	return start, nil
+}
+
+// freeRun returns the first index of n consecutive free FNT entries, or -1
+func (fs *FileSystem) freeRun(n int) int {
+	run := 0
+	for i, entry := range fs.FNT {
+		if entry.Filename != [MaxFilename]byte{} {
+			run = 0
+			continue
+		}
+		run++
+		if run == n {
+			return i - n + 1
+		}
+	}
+	return -1
+}
+
+// clearName frees the FNT entries of the name starting at index
+func (fs *FileSystem) clearName(index int) {
+	fs.FNT[index] = FNTEntry{InodePointer: -1}
+	for i := index + 1; i < len(fs.FNT) && fs.FNT[i].InodePointer == fntContinuation; i++ {
+		fs.FNT[i] = FNTEntry{InodePointer: -1}
+	}
+}
+
+// allocateInode returns a DABPT entry no file uses, preferring index prefer
+// so that short names keep the FNT index and inode in step; pass -1 for no
+// preference. The DABPT is grown when every entry is taken.
+func (fs *FileSystem) allocateInode(prefer int) (int, error) {
+	used := make(map[int]bool)
+	for _, inode := range fs.liveInodes() {
+		used[inode] = true
+	}
+	if prefer >= 0 && prefer < len(fs.DABPT) && !used[prefer] {
+		return prefer, nil
+	}
+	for i := range fs.DABPT {
+		if !used[i] {
+			return i, nil
+		}
+	}
+
+	inode := len(fs.DABPT)
+	err := fs.growTables(len(fs.FNT), len(fs.DABPT)+dabptEntriesPerBlock)
+	if err != nil {
+		return -1, fmt.Errorf("%w and the DABPT cannot grow: %w", ErrNoInodes, err)
+	}
+	return inode, nil
+}
@@ -0,0 +1,97 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestLongNames stores names that span continuation entries, removes them
+// and checks that the entries they took are used again
+func TestLongNames(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want error
+	}{
+		{"a", nil},
+		{strings.Repeat("b", MaxFilename), nil},
+		{strings.Repeat("c", MaxFilename+1), nil},
+		{strings.Repeat("d", 2*MaxFilename+1), nil},
+		{"dir/" + strings.Repeat("e", 200), nil},
+		{"f" + strings.Repeat("é", 100), nil}, // Characters split across entries
+		{strings.Repeat("g", MaxNameLength), nil},
+		{strings.Repeat("h", MaxNameLength+1), ErrNameTooLong},
+	} {
+		t.Run(fmt.Sprintf("%d bytes", len(c.name)), func(t *testing.T) {
+			fs := newTestImage(t, 256)
+			put := func(name string) {
+				t.Helper()
+				if _, err := PutReaderFS(fs, bytes.NewReader([]byte(name)), PutOptions{Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			put("before")
+			_, err := PutReaderFS(fs, bytes.NewReader([]byte(c.name)), PutOptions{Name: c.name})
+			if !errors.Is(err, c.want) || (err == nil) != (c.want == nil) {
+				t.Fatalf("storing a %d byte name = %v, want %v", len(c.name), err, c.want)
+			}
+			if err != nil {
+				checkFiles(t, fs, map[string][]byte{"before": []byte("before")})
+				return
+			}
+			put("after")
+
+			// The name takes consecutive entries right after the first file
+			entries := nameEntries(len(c.name))
+			index, err := fs.lookup(c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index != 1 {
+				t.Fatalf("name starts in entry %d, want 1", index)
+			}
+			for k := 1; k < entries; k++ {
+				if fs.FNT[index+k].InodePointer != fntContinuation {
+					t.Fatalf("entry %d of the name is not a continuation", k)
+				}
+			}
+			if fs.FNT[index+entries].InodePointer == fntContinuation {
+				t.Fatalf("name runs on past %d entries", entries)
+			}
+			checkFiles(t, fs, map[string][]byte{"before": []byte("before"), c.name: []byte(c.name), "after": []byte("after")})
+
+			// Removing it frees every entry it took
+			if err := RemoveFS(fs, c.name); err != nil {
+				t.Fatal(err)
+			}
+			for k := 0; k < entries; k++ {
+				if entry := fs.FNT[index+k]; entry != (FNTEntry{InodePointer: -1}) {
+					t.Fatalf("entry %d of the removed name still holds %q, %d", k, entry.Filename, entry.InodePointer)
+				}
+			}
+			checkFiles(t, fs, map[string][]byte{"before": []byte("before"), "after": []byte("after")})
+
+			// and a name as long takes them again rather than growing the FNT
+			size := len(fs.FNT)
+			reused := "Z" + c.name[1:]
+			put(reused)
+			if index, err := fs.lookup(reused); err != nil || index != 1 {
+				t.Fatalf("new name starts in entry %d (%v), want 1", index, err)
+			}
+			if len(fs.FNT) != size {
+				t.Fatalf("FNT grew from %d to %d entries", size, len(fs.FNT))
+			}
+
+			image := fs.DiskName
+			CloseFS(fs)
+			fs, err = OpenFS(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer CloseFS(fs)
+			checkFiles(t, fs, map[string][]byte{"before": []byte("before"), reused: []byte(reused), "after": []byte("after")})
+		})
+	}
+}
@@ -3,9 +3,9 @@ package filesystem
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"path/filepath"
 	"time"
@@ -46,10 +46,16 @@ func CreateFS(numBlocks int, currentUser string) *FileSystem {
 }
 
 func FormatFS(fs *FileSystem, numFilenames, numDABPTEntries int) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return err
+    }
+
     // Validate input parameters
-    totalMetaBlocks := (numFilenames + 3) / 4 + (numDABPTEntries + 3) / 4 // 4 entries per block
+    totalMetaBlocks := metaBlocksFor(numFilenames, numDABPTEntries)
     if totalMetaBlocks > fs.TotalBlocks {
-        return fmt.Errorf("not enough blocks for %d filenames and %d DABPT entries", numFilenames, numDABPTEntries)
+        return fmt.Errorf("%w: not enough blocks for %d filenames and %d DABPT entries", ErrNoSpace, numFilenames, numDABPTEntries)
     }
 
     // Set up FNT
@@ -66,7 +72,7 @@ func FormatFS(fs *FileSystem, numFilenames, numDABPTEntries int) error {
     for i := range fs.DABPT {
         fs.DABPT[i] = DABPTEntry{
             FileSize:               0,
-            LastModified:           uint32(time.Now().Unix()),
+            LastModified:           uint32(fs.now().Unix()),
             BlockPointerTableIndex: -1, // Invalid pointer
             Username:               [MaxUsername]byte{},
         }
@@ -88,46 +94,74 @@ func FormatFS(fs *FileSystem, numFilenames, numDABPTEntries int) error {
         }
     }
 
+    fs.changed()
     return nil // nil = no error
 }
 
 // Save the "Disk" in a file "name"
 func SaveFS(fs *FileSystem, name string) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.checkWritable(); err != nil {
+        return err
+    }
+
+    return fs.save(name)
+}
+
+// save writes the file system to name; the caller must hold fs.mu
+func (fs *FileSystem) save(name string) error {
+    // Writers must hold the lock of the image they write, so take it when
+    // saving to a new name
+    if fs.lock == nil || fs.lock.name != name {
+        lock, err := lockImage(name, true, false)
+        if err != nil {
+            return err
+        }
+        if fs.lock != nil {
+            fs.lock.release()
+        }
+        fs.lock = lock
+    }
+
     // Open file
-    fmt.Printf("Attempting to create file with name: %s\n", name)
     file, err := os.Create(name)
     if err != nil {
-        return fmt.Errorf("failed to create file: %v", err)
+        return fmt.Errorf("failed to create file: %w", err)
     }
     defer file.Close()
 
-    // Write total number of blocks
+    // Write image version, then total number of blocks
+    err = binary.Write(file, binary.LittleEndian, int32(-imageVersion))
+    if err != nil {
+        return fmt.Errorf("failed to write image version: %w", err)
+    }
     err = binary.Write(file, binary.LittleEndian, int32(fs.TotalBlocks))
     if err != nil {
-        return fmt.Errorf("failed to write total blocks: %v", err)
+        return fmt.Errorf("failed to write total blocks: %w", err)
     }
 
     // Write FNT
     err = binary.Write(file, binary.LittleEndian, int32(len(fs.FNT)))
     if err != nil {
-        return fmt.Errorf("failed to write FNT length: %v", err)
+        return fmt.Errorf("failed to write FNT length: %w", err)
     }
     for _, entry := range fs.FNT {
         err := binary.Write(file, binary.LittleEndian, entry)
         if err != nil {
-            return fmt.Errorf("failed to write FNT entry: %v", err)
+            return fmt.Errorf("failed to write FNT entry: %w", err)
         }
     }
 
     // Write DABPT
     err = binary.Write(file, binary.LittleEndian, int32(len(fs.DABPT)))
     if err != nil {
-        return fmt.Errorf("failed to write DABPT length: %v", err)
+        return fmt.Errorf("failed to write DABPT length: %w", err)
     }
     for _, entry := range fs.DABPT {
         err := binary.Write(file, binary.LittleEndian, entry)
         if err != nil {
-            return fmt.Errorf("failed to write DABPT entry: %v", err)
+            return fmt.Errorf("failed to write DABPT entry: %w", err)
         }
     }
 
@@ -135,7 +169,7 @@ func SaveFS(fs *FileSystem, name string) error {
     for _, block := range fs.DataBlocks {
         _, err := file.Write(block)
         if err != nil {
-            return fmt.Errorf("failed to write DataBlock: %v", err)
+            return fmt.Errorf("failed to write DataBlock: %w", err)
         }
     }
 
@@ -143,20 +177,20 @@ func SaveFS(fs *FileSystem, name string) error {
     for _, isFree := range fs.FreeBlocks {
         err := binary.Write(file, binary.LittleEndian, isFree)
         if err != nil {
-            return fmt.Errorf("failed to write FreeBlocks entry: %v", err)
+            return fmt.Errorf("failed to write FreeBlocks entry: %w", err)
         }
     }
 
     // Set current user to NULL
     _, err = file.Write(fs.CurrentUser[:])
     if err != nil {
-        return fmt.Errorf("failed to write CurrentUser: %v", err)
+        return fmt.Errorf("failed to write CurrentUser: %w", err)
     }
 
     // Write current user
     _, err = file.WriteString(fs.DiskName)
     if err != nil {
-        return fmt.Errorf("failed to write DiskName: %v", err)
+        return fmt.Errorf("failed to write DiskName: %w", err)
     }
 
     fs.DiskName = name
@@ -165,20 +199,72 @@ func SaveFS(fs *FileSystem, name string) error {
 
 // Use an existing disk image
 func OpenFS(name string) (*FileSystem, error) {
+    return OpenFSWithOptions(name, OpenOptions{})
+}
+
+// OpenFSWithOptions opens an existing disk image and locks it against other
+// processes until CloseFS. Opening an image another process holds fails with
+// an *ImageLockedError unless opts.Force is set. Read-only opens take a shared
+// lock, so any number of readers can use an image no writer holds.
+func OpenFSWithOptions(name string, opts OpenOptions) (*FileSystem, error) {
+    if _, err := os.Stat(name); err != nil {
+        return nil, fmt.Errorf("failed to open file: %w", err)
+    }
+
+    // Lock the image before reading it
+    lock, err := lockImage(name, !opts.ReadOnly, opts.Force)
+    if err != nil {
+        return nil, err
+    }
+
+    fs, err := loadFS(name)
+    if err != nil {
+        lock.release()
+        if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+            err = fmt.Errorf("%w: image is truncated: %w", ErrCorrupt, err)
+        }
+        return nil, err
+    }
+    fs.lock = lock
+    fs.readOnly = opts.ReadOnly
+    fs.DiskName = name // Save back to the image that was opened
+    return fs, nil
+}
+
+// loadFS reads a disk image into memory
+func loadFS(name string) (*FileSystem, error) {
     // Open file
     file, err := os.Open(name)
     if err != nil {
-        return nil, fmt.Errorf("failed to open file: %v", err)
+        return nil, fmt.Errorf("failed to open file: %w", err)
     }
     defer file.Close()
 
     fs := &FileSystem{}
 
-    // Read total number of blocks
-    var totalNumberOfBlocks int32
-    err = binary.Read(file, binary.LittleEndian, &totalNumberOfBlocks)
+    // Read image version. Legacy images have no version and start with the
+    // (positive) total number of blocks instead.
+    var header int32
+    err = binary.Read(file, binary.LittleEndian, &header)
     if err != nil {
-        return nil, fmt.Errorf("failed to read total blocks: %v", err)
+        return nil, fmt.Errorf("failed to read image header: %w", err)
+    }
+    version := 1
+    totalNumberOfBlocks := header
+    if header < 0 {
+        version = int(-header)
+        if version > imageVersion {
+            return nil, fmt.Errorf("%w: image version %d", ErrUnsupported, version)
+        }
+
+        // Read total number of blocks
+        err = binary.Read(file, binary.LittleEndian, &totalNumberOfBlocks)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read total blocks: %w", err)
+        }
+    }
+    if totalNumberOfBlocks < 0 {
+        return nil, fmt.Errorf("%w: negative block count", ErrCorrupt)
     }
     fs.TotalBlocks = int(totalNumberOfBlocks)
 
@@ -186,7 +272,11 @@ func OpenFS(name string) (*FileSystem, error) {
     var fntLength int32
     err = binary.Read(file, binary.LittleEndian, &fntLength)
     if err != nil {
-        return nil, fmt.Errorf("failed to read FNT length: %v", err)
+        return nil, fmt.Errorf("failed to read FNT length: %w", err)
+    }
+
+    if fntLength < 0 {
+        return nil, fmt.Errorf("%w: negative FNT length", ErrCorrupt)
     }
 
     // Read FNT
@@ -194,7 +284,7 @@ func OpenFS(name string) (*FileSystem, error) {
     for i := range fs.FNT {
         err = binary.Read(file, binary.LittleEndian, &fs.FNT[i])
         if err != nil {
-            return nil, fmt.Errorf("failed to read FNT entry: %v", err)
+            return nil, fmt.Errorf("failed to read FNT entry: %w", err)
         }
     }
 
@@ -202,15 +292,30 @@ func OpenFS(name string) (*FileSystem, error) {
     var dabptLength int32
     err = binary.Read(file, binary.LittleEndian, &dabptLength)
     if err != nil {
-        return nil, fmt.Errorf("failed to read DABPT length: %v", err)
+        return nil, fmt.Errorf("failed to read DABPT length: %w", err)
+    }
+
+    if dabptLength < 0 {
+        return nil, fmt.Errorf("%w: negative DABPT length", ErrCorrupt)
     }
 
     // Read DABPT
     fs.DABPT = make([]DABPTEntry, dabptLength)
     for i := range fs.DABPT {
-        err = binary.Read(file, binary.LittleEndian, &fs.DABPT[i])
+        if version == 1 {
+            var legacy legacyDABPTEntry
+            err = binary.Read(file, binary.LittleEndian, &legacy)
+            fs.DABPT[i] = DABPTEntry{
+                FileSize:               legacy.FileSize,
+                LastModified:           legacy.LastModified,
+                BlockPointerTableIndex: legacy.BlockPointerTableIndex,
+                Username:               legacy.Username,
+            }
+        } else {
+            err = binary.Read(file, binary.LittleEndian, &fs.DABPT[i])
+        }
         if err != nil {
-            return nil, fmt.Errorf("failed to read DABPT entry: %v", err)
+            return nil, fmt.Errorf("failed to read DABPT entry: %w", err)
         }
     }
 
@@ -220,7 +325,7 @@ func OpenFS(name string) (*FileSystem, error) {
         fs.DataBlocks[i] = make([]byte, BlockSize)
         _, err = file.Read(fs.DataBlocks[i])
         if err != nil {
-            return nil, fmt.Errorf("failed to read DataBlock entry: %v", err)
+            return nil, fmt.Errorf("failed to read DataBlock entry: %w", err)
         }
     }
 
@@ -229,7 +334,7 @@ func OpenFS(name string) (*FileSystem, error) {
     for i := range fs.FreeBlocks {
         err = binary.Read(file, binary.LittleEndian, &fs.FreeBlocks[i])
         if err != nil {
-            return nil, fmt.Errorf("failed to read FreeBlock entry: %v", err)
+            return nil, fmt.Errorf("failed to read FreeBlock entry: %w", err)
         }
     }
 
@@ -237,42 +342,47 @@ func OpenFS(name string) (*FileSystem, error) {
     fs.CurrentUser = [MaxUsername]byte{}
     _, err = file.Read(fs.CurrentUser[:])
     if err != nil {
-        return nil, fmt.Errorf("failed to read CurrentUser: %v", err)
+        return nil, fmt.Errorf("failed to read CurrentUser: %w", err)
     }
 
     // Read DiskName
     diskName, err := io.ReadAll(file)
     if err != nil {
-        return nil, fmt.Errorf("failed to read DiskName: %v", err)
+        return nil, fmt.Errorf("failed to read DiskName: %w", err)
     }
     fs.DiskName = string(diskName)
 
+    // Images written while DABPT entries were smaller reserved fewer blocks
+    // for the tables. Move file blocks out of the area the tables take up
+    // now; if there is no room for them, or the image is corrupt, they stay
+    // where they are.
+    fs.growTables(len(fs.FNT), len(fs.DABPT))
+
     return fs, nil
 }
 
 // Implement other operations (List, Remove, Rename, Put, Get, User)
 func ListFS(fs *FileSystem) ([]string, error) {
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+
     var fileList []string
     
-    for _, entry := range fs.FNT {
-        if entry.Filename != [MaxFilename]byte{} {
-            filename := string(bytes.Trim(entry.Filename[:], "\x00"))
-            
-            // Get corresponding DABPT entry
-            if int(entry.InodePointer) < len(fs.DABPT) {
-                dabptEntry := fs.DABPT[entry.InodePointer]
-                
-                // Format file information
-                fileInfo := fmt.Sprintf("File: %s, Size: %d bytes, Last Modified: %s, Owner: %s",
-                    filename,
-                    dabptEntry.FileSize,
-                    time.Unix(int64(dabptEntry.LastModified), 0).Format(time.RFC3339),
-                    string(bytes.Trim(dabptEntry.Username[:], "\x00")))
-                
-                fileList = append(fileList, fileInfo)
-            } else {
-                return nil, fmt.Errorf("invalid DABPT index for file %s", filename)
-            }
+    for _, file := range fs.files() {
+        // Get corresponding DABPT entry
+        if file.inode >= 0 && int(file.inode) < len(fs.DABPT) {
+            dabptEntry := fs.DABPT[file.inode]
+
+            // Format file information
+            fileInfo := fmt.Sprintf("File: %s, Size: %d bytes, Last Modified: %s, Owner: %s",
+                file.name,
+                dabptEntry.FileSize,
+                time.Unix(int64(dabptEntry.LastModified), 0).Format(time.RFC3339),
+                string(bytes.Trim(dabptEntry.Username[:], "\x00")))
+
+            fileList = append(fileList, fileInfo)
+        } else {
+            return nil, fmt.Errorf("%w: invalid DABPT index for file %s", ErrCorrupt, file.name)
         }
     }
 
@@ -280,15 +390,29 @@ func ListFS(fs *FileSystem) ([]string, error) {
 }
 
 func PutFS(fs *FileSystem, externalFileName string) error {
+    return PutFSWithOptions(fs, externalFileName, PutOptions{})
+}
+
+// PutFSWithOptions stores an external file under opts.Name, or under its base
+// name when that is empty. If a file with that name already exists, opts.Mode
+// decides whether to fail, replace it or leave it alone. A replaced file keeps
+// its old contents until the new ones are completely written.
+func PutFSWithOptions(fs *FileSystem, externalFileName string, opts PutOptions) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return err
+    }
+
     // Check if external file exists
     if _, err := os.Stat(externalFileName); os.IsNotExist(err) {
-        return fmt.Errorf("external file does not exist: %v", err)
+        return fmt.Errorf("external file does not exist: %w", err)
     }
 
     // Open and read the external file
     externalFile, err := os.Open(externalFileName)
     if err != nil {
-        return fmt.Errorf("failed to open external file: %v", err)
+        return fmt.Errorf("failed to open external file: %w", err)
     }
     defer externalFile.Close()
 
@@ -296,108 +420,469 @@ func PutFS(fs *FileSystem, externalFileName string) error {
     // Get file info
     fileInfo, err := externalFile.Stat()
     if err != nil {
-        return fmt.Errorf("failed to get external file stats: %v", err)
+        return fmt.Errorf("failed to get external file stats: %w", err)
     }
 
-    // Validate available space in FS
-    fileSize := fileInfo.Size()
-    fmt.Printf("File size: %d bytes\n", fileSize) // Debugging
-    if fileSize == 0 {
-        return fmt.Errorf("cannot add empty file")
+    // Default the internal name to the external one
+    if opts.Name == "" {
+        opts.Name = filepath.Base(externalFileName)
+    }
+    err = fs.put(externalFile, opts, fileInfo.Size(), fileInfo.ModTime())
+    if err != nil {
+        return err
     }
-    requiredBlocks := int(math.Ceil(float64(fileSize) / float64(BlockSize)))
-    if fs.getFreeBlockCount() < requiredBlocks {
-        return fmt.Errorf("not enough space in the file system")
+    return fs.autosave()
+}
+
+// PutReaderFS stores everything read from r as the file opts.Name, which must
+// be set, and reports what became of the name. The length does not need to be
+// known in advance. r is read to the end before the file system is locked, so
+// that a slow reader such as a network client does not hold up everyone else;
+// no more than the image can hold is buffered.
+func PutReaderFS(fs *FileSystem, r io.Reader, opts PutOptions) (PutOutcome, error) {
+    if opts.Name == "" {
+        return 0, fmt.Errorf("%w: a name is needed to store data from a reader", ErrInvalid)
     }
-    // Add file entry to FNT
-    fntIndex, err := fs.addToFNT(filepath.Base(externalFileName))
+    fs.mu.RLock()
+    capacity := int64(fs.TotalBlocks) * BlockSize
+    fs.mu.RUnlock()
+    data, err := io.ReadAll(io.LimitReader(r, capacity+1))
     if err != nil {
-        return fmt.Errorf("failed to add file to FNT: %v", err)
+        return 0, pathError("put", opts.Name, err)
+    }
+    if int64(len(data)) > capacity {
+        return 0, pathError("put", opts.Name, ErrNoSpace)
     }
 
-    // Create DABPT entry with file metadata
-    dabptEntry := DABPTEntry{
-        FileSize:               int32(fileSize),
-        LastModified:           uint32(fileInfo.ModTime().Unix()),
-        BlockPointerTableIndex: 0, // Will be set later
-        Username:               fs.CurrentUser,
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return 0, err
     }
 
-    // Allocate and update Block Pointer Table
-    bptIndex, err := fs.allocateBlockPointerTable(requiredBlocks)
+    // Whether the name is taken cannot change before put, as the lock is held
+    outcome := PutCreated
+    if name, err := fs.cleanName(opts.Name); err == nil {
+        if _, err := fs.lookup(name); err == nil {
+            outcome = PutReplaced
+            if opts.Mode == PutNoClobber {
+                outcome = PutKept
+            }
+        }
+    }
+    err = fs.put(bytes.NewReader(data), opts, int64(len(data)), fs.now())
     if err != nil {
-        return fmt.Errorf("failed to allocate Block Pointer Table: %v", err)
+        return 0, err
     }
-    dabptEntry.BlockPointerTableIndex = int32(bptIndex)
+    return outcome, fs.autosave()
+}
 
-    // Write file content to data blocks
-    buffer := make([]byte, BlockSize)
-    for i := 0; i < requiredBlocks; i++ {
-        n, err := externalFile.Read(buffer)
-        if err != nil && err != io.EOF {
-            return fmt.Errorf("failed to read external file: %v", err)
-        }
-        
-        // Allocate a data block for writing
-        blockIndex, err := fs.allocateDataBlock()
+// put stores the contents of r under opts.Name. size is the expected length,
+// or -1 when unknown, and is only used to check for space and lay out the
+// Block Pointer Table up front.
+func (fs *FileSystem) put(r io.Reader, opts PutOptions, size int64, modTime time.Time) error {
+    // Check the internal name and whether it is taken
+    internalFileName, err := fs.cleanName(opts.Name)
+    if err != nil {
+        return pathError("put", opts.Name, err)
+    }
+    fntIndex, err := fs.lookup(internalFileName)
+    exists := err == nil
+    if exists && opts.Mode == PutNoClobber {
+        return nil
+    }
+    if exists && opts.Mode != PutOverwrite {
+        return pathError("put", internalFileName, ErrExist)
+    }
+
+    // Validate available space in FS. A replaced file's blocks are only freed
+    // once the new contents are in place.
+    if size == 0 && !opts.AllowEmpty {
+        return fmt.Errorf("%w: cannot add empty file", ErrInvalid)
+    }
+    requiredBlocks := blocksForSize(size)
+    if size > MaxInlineSize && fs.getFreeBlockCount() < requiredBlocks {
+        return pathError("put", internalFileName, ErrNoSpace)
+    }
+
+    // Add file entry to FNT, or get a fresh inode for the replacement contents
+    var inode int
+    if exists {
+        inode, err = fs.allocateInode(-1)
         if err != nil {
-            return fmt.Errorf("failed to allocate data block: %v", err)
+            return pathError("put", internalFileName, err)
         }
-        
-        // Write the read data into the allocated block
-        err = fs.writeBlock(blockIndex, buffer[:n])
+    } else {
+        fntIndex, err = fs.addToFNT(internalFileName)
         if err != nil {
-            return fmt.Errorf("failed to write data block: %v", err)
+            return pathError("put", internalFileName, err)
         }
-        
-        // Update the Block Pointer Table with this block index
-        err = fs.updateBlockPointerTable(bptIndex, i, blockIndex)
-        if err != nil {
-            return fmt.Errorf("failed to update Block Pointer Table: %v", err)
+        inode = int(fs.FNT[fntIndex].InodePointer)
+    }
+
+    // Undo everything if the file cannot be stored completely
+    stored := false
+    defer func() {
+        if stored {
+            return
         }
+        fs.releaseInode(inode)
+        if !exists {
+            fs.clearName(fntIndex)
+        }
+    }()
 
-        // Mark this block as used
-        fs.FreeBlocks[blockIndex] = false
+    // Start with an empty inline file. When the size is known and too big to
+    // be inline, allocate the whole Block Pointer Table ahead of the data.
+    fs.DABPT[inode] = DABPTEntry{
+        BlockPointerTableIndex: HoleBlock,
+        Username:               fs.CurrentUser,
+        Flags:                  InodeInline,
+    }
+    if opts.Owner != "" {
+        fs.DABPT[inode].Username = [MaxUsername]byte{}
+        copy(fs.DABPT[inode].Username[:], opts.Owner)
+    }
+    if size > MaxInlineSize {
+        bptIndex, err := fs.allocateBlockPointerTable(requiredBlocks)
+        if err != nil {
+            return fmt.Errorf("failed to allocate Block Pointer Table: %w", err)
+        }
+        fs.DABPT[inode].Flags &^= InodeInline
+        fs.DABPT[inode].BlockPointerTableIndex = int32(bptIndex)
+    }
 
-        // If this is the last read (EOF), break out of the loop
-        if n == BlockSize {
+    // Write file content a block at a time. Blocks that are entirely zero are
+    // left as holes so they do not take up space on the disk.
+    buffer := make([]byte, BlockSize)
+    var written int64
+    for {
+        n, err := io.ReadFull(r, buffer)
+        if n > 0 {
+            _, werr := fs.writeAt(inode, buffer[:n], written)
+            if werr != nil {
+                return pathError("put", internalFileName, werr)
+            }
+            written += int64(n)
+        }
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
             break
         }
+        if err != nil {
+            return fmt.Errorf("failed to read external file: %w", err)
+        }
+    }
+    if written == 0 && !opts.AllowEmpty {
+        return fmt.Errorf("%w: cannot add empty file", ErrInvalid)
     }
+    fs.DABPT[inode].FileSize = int32(written)
+    fs.DABPT[inode].LastModified = uint32(modTime.Unix())
+    stored = true
+    fs.changed()
+
+    // Point the name at the new contents and free the old ones
+    if exists {
+        oldInode := int(fs.FNT[fntIndex].InodePointer)
+        fs.FNT[fntIndex].InodePointer = int32(inode)
+        err = fs.releaseInode(oldInode)
+        if err != nil {
+            return fmt.Errorf("failed to release replaced file: %w", err)
+        }
+    }
+    return nil
+}
 
-    // Update DABPT
-    err = fs.updateDABPT(fntIndex, dabptEntry)
-    if err != nil {
-        return fmt.Errorf("failed to update DABPT: %v", err)
+// autosave writes the file system back to its image after a put
+func (fs *FileSystem) autosave() error {
+    // Transactions save their changes on Commit
+    if fs.staging {
+        return nil
     }
 
     // Save updated filesystem state (ensure this does not overwrite existing files incorrectly)
     diskImageName := fs.DiskName // Ensure DiskName is set appropriately before saving
     if diskImageName == "" {
-        return fmt.Errorf("disk name is not set; cannot save filesystem state")
+        return fmt.Errorf("%w: disk name is not set; cannot save filesystem state", ErrInvalid)
     }
 
-    err = SaveFS(fs, diskImageName)
+    err := fs.save(diskImageName)
     if err != nil {
-        return fmt.Errorf("failed to save updated filesystem state: %v", err)
+        return fmt.Errorf("failed to save updated filesystem state: %w", err)
     }
     return nil
 }
 
 func RemoveFS(fs *FileSystem, internalFileName string) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return err
+    }
+
+    return fs.removeFile(internalFileName)
+}
+
+// removeFile deletes a file and frees its blocks
+func (fs *FileSystem) removeFile(internalFileName string) error {
     // Check if file exists in FNT
-    for i, entry := range fs.FNT {
+    fntIndex, err := fs.lookup(internalFileName)
+    if err != nil {
+        return pathError("remove", internalFileName, err)
+    }
+
+    // Release the file's blocks and inode, then remove its FNT entry
+    err = fs.releaseInode(int(fs.FNT[fntIndex].InodePointer))
+    if err != nil {
+        return fmt.Errorf("failed to release file blocks: %w", err)
+    }
+    fs.clearName(fntIndex)
+    fs.changed()
+    return nil
+}
+
+func GetFS(fs *FileSystem, internalFileName, externalFileName string) error {
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+
+    // Find the file in FNT
+    fntIndex, err := fs.lookup(internalFileName)
+    if err != nil {
+        return pathError("get", internalFileName, err)
+    }
+    inode := int(fs.FNT[fntIndex].InodePointer)
+
+    // Read the whole file, filling holes with zeros
+    data := make([]byte, fs.DABPT[inode].FileSize)
+    _, err = fs.readAt(inode, data, 0)
+    if err != nil {
+        return fmt.Errorf("failed to read file: %w", err)
+    }
+
+    // Write it to the host file system
+    err = os.WriteFile(externalFileName, data, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to write external file: %w", err)
+    }
+
+    modTime := time.Unix(int64(fs.DABPT[inode].LastModified), 0)
+    return os.Chtimes(externalFileName, modTime, modTime)
+}
+
+// GetWriterFS writes the contents of a file to w. The file is copied out
+// before anything is written, so that a slow writer such as a network client
+// does not hold the file system locked.
+func GetWriterFS(fs *FileSystem, internalFileName string, w io.Writer) error {
+    var buf bytes.Buffer
+    err := func() error {
+        fs.mu.RLock()
+        defer fs.mu.RUnlock()
+
+        // Find the file in FNT
+        fntIndex, err := fs.lookup(internalFileName)
+        if err != nil {
+            return pathError("get", internalFileName, err)
+        }
+        return fs.copyOut(int(fs.FNT[fntIndex].InodePointer), &buf)
+    }()
+    if err != nil {
+        return err
+    }
+    _, err = buf.WriteTo(w)
+    return err
+}
+
+// ReadAtFS reads len(p) bytes of a file starting at offset, filling holes with
+// zeros. As with io.ReaderAt, it returns io.EOF when the file ends first.
+func ReadAtFS(fs *FileSystem, internalFileName string, p []byte, offset int64) (int, error) {
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+
+    fntIndex, err := fs.lookup(internalFileName)
+    if err != nil {
+        return 0, pathError("read", internalFileName, err)
+    }
+    inode := int(fs.FNT[fntIndex].InodePointer)
+
+    if offset < 0 {
+        return 0, pathError("read", internalFileName, ErrInvalid)
+    }
+    n, err := fs.readAt(inode, p, offset)
+    if err != nil {
+        return n, pathError("read", internalFileName, err)
+    }
+    if n < len(p) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+// copyOut writes the contents of an inode to w, filling holes with zeros
+func (fs *FileSystem) copyOut(inode int, w io.Writer) error {
+    buffer := make([]byte, BlockSize)
+    size := int64(fs.DABPT[inode].FileSize)
+    for off := int64(0); off < size; off += BlockSize {
+        n, err := fs.readAt(inode, buffer[:min(BlockSize, size-off)], off)
+        if err != nil {
+            return fmt.Errorf("failed to read file: %w", err)
+        }
+        if _, err := w.Write(buffer[:n]); err != nil {
+            return fmt.Errorf("failed to write output: %w", err)
+        }
+    }
+    return nil
+}
+
+// WriteAtFS writes data into an existing file starting at offset. Writing past
+// the end of the file grows it, leaving any gap as an unallocated hole.
+func WriteAtFS(fs *FileSystem, internalFileName string, data []byte, offset int64) (int, error) {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return 0, err
+    }
+
+    fntIndex, err := fs.lookup(internalFileName)
+    if err != nil {
+        return 0, pathError("write", internalFileName, err)
+    }
+    inode := int(fs.FNT[fntIndex].InodePointer)
+
+    n, err := fs.writeAt(inode, data, offset)
+    if n > 0 {
+        fs.DABPT[inode].LastModified = uint32(fs.now().Unix())
+        fs.changed()
+    }
+    if err != nil {
+        return n, pathError("write", internalFileName, err)
+    }
+    return n, nil
+}
+
+// TruncateFS sets the size of a file. Extending a file does not allocate any
+// blocks; the new region reads back as zeros.
+func TruncateFS(fs *FileSystem, internalFileName string, size int64) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return err
+    }
+
+    fntIndex, err := fs.lookup(internalFileName)
+    if err != nil {
+        return pathError("truncate", internalFileName, err)
+    }
+    inode := int(fs.FNT[fntIndex].InodePointer)
+
+    err = fs.truncate(inode, size)
+    if err != nil {
+        return pathError("truncate", internalFileName, err)
+    }
+    fs.DABPT[inode].LastModified = uint32(fs.now().Unix())
+    fs.changed()
+    return nil
+}
+
+// ChtimesFS sets the modification time of a file
+func ChtimesFS(fs *FileSystem, internalFileName string, modTime time.Time) error {
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return err
+    }
+
+    fntIndex, err := fs.lookup(internalFileName)
+    if err != nil {
+        return pathError("chtimes", internalFileName, err)
+    }
+    fs.DABPT[fs.FNT[fntIndex].InodePointer].LastModified = uint32(modTime.Unix())
+    fs.changed()
+    return nil
+}
+
+// StatFS describes a single file, including how much of it is backed by disk
+func StatFS(fs *FileSystem, internalFileName string) (*FileStat, error) {
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+
+    fntIndex, err := fs.lookup(internalFileName)
+    if err != nil {
+        return nil, pathError("stat", internalFileName, err)
+    }
+    return fs.stat(internalFileName, int(fs.FNT[fntIndex].InodePointer))
+}
+
+// stat describes the file name stored in inode
+func (fs *FileSystem) stat(name string, inode int) (*FileStat, error) {
+    entry := fs.DABPT[inode]
+    allocated, err := fs.allocatedBlocks(inode)
+    if err != nil {
+        return nil, err
+    }
+
+    return &FileStat{
+        Name:            name,
+        Inode:           inode,
+        Size:            int64(entry.FileSize),
+        AllocatedBlocks: allocated,
+        AllocatedSize:   int64(allocated) * BlockSize,
+        Inline:          entry.Flags&InodeInline != 0,
+        LastModified:    time.Unix(int64(entry.LastModified), 0),
+        Owner:           string(bytes.Trim(entry.Username[:], "\x00")),
+        Mode:            FileMode,
+    }, nil
+}
+
+// FilesFS describes every file in the file system, in FNT order
+func FilesFS(fs *FileSystem) ([]FileStat, error) {
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+
+    var stats []FileStat
+    for _, file := range fs.files() {
+        if file.inode < 0 || int(file.inode) >= len(fs.DABPT) {
+            return nil, fmt.Errorf("%w: invalid DABPT index for file %s", ErrCorrupt, file.name)
+        }
+        st, err := fs.stat(file.name, int(file.inode))
+        if err != nil {
+            return nil, err
+        }
+        stats = append(stats, *st)
+    }
+    return stats, nil
+}
+
+// UsageFS reports the free space and free FNT entries
+func UsageFS(fs *FileSystem) Usage {
+    fs.mu.RLock()
+    defer fs.mu.RUnlock()
+
+    usage := Usage{
+        TotalBlocks: fs.TotalBlocks,
+        FreeBlocks:  fs.getFreeBlockCount(),
+        Names:       len(fs.FNT),
+    }
+    for _, entry := range fs.FNT {
         if entry.Filename == [MaxFilename]byte{} {
-            continue
+            usage.FreeNames++
         }
-        filename := string(bytes.Trim(entry.Filename[:], "\x00"))
-        if filename == internalFileName {
-            // Remove file entry from FNT
-            fs.FNT[i] = FNTEntry{}
-            return nil
+    }
+    return usage
+}
+
+// lookup returns the index of the FNT entry a file's name starts in
+func (fs *FileSystem) lookup(internalFileName string) (int, error) {
+    if fs.NameNormalizer != nil {
+        internalFileName = fs.NameNormalizer(internalFileName)
+    }
+    for _, file := range fs.files() {
+        if file.name == internalFileName {
+            if file.inode < 0 || int(file.inode) >= len(fs.DABPT) {
+                return -1, fmt.Errorf("%w: invalid DABPT index for file %s", ErrCorrupt, file.name)
+            }
+            return file.fnt, nil
         }
     }
-    return fmt.Errorf("file not found in FNT")
+    return -1, ErrNotExist
 }
 
 // getFreeBlockCount returns the number of free blocks in the filesystem
@@ -411,16 +896,23 @@ func (fs *FileSystem) getFreeBlockCount() int {
     return count
 }
 
-// addToFNT adds a new file entry to the FileNameTable
+// addToFNT adds a new file entry to the FileNameTable and gives it an inode,
+// growing the FNT and DABPT into free blocks when there is no room
 func (fs *FileSystem) addToFNT(filename string) (int, error) {
-    for i, entry := range fs.FNT {
-        if entry.Filename == [MaxFilename]byte{} {
-            copy(fs.FNT[i].Filename[:], filename)
-            fs.FNT[i].InodePointer = int32(i) // Assuming DABPT index matches FNT index
-            return i, nil
-        }
+    if err := fs.checkPath(filename, -1); err != nil {
+        return -1, err
+    }
+    fntIndex, err := fs.storeName(filename)
+    if err != nil {
+        return -1, err
     }
-    return -1, fmt.Errorf("FNT is full")
+    inode, err := fs.allocateInode(fntIndex)
+    if err != nil {
+        fs.clearName(fntIndex)
+        return -1, err
+    }
+    fs.FNT[fntIndex].InodePointer = int32(inode)
+    return fntIndex, nil
 }
 
 // allocateBlockPointerTable allocates a new Block Pointer Table
@@ -439,7 +931,7 @@ func (fs *FileSystem) allocateBlockPointerTable(requiredBlocks int) (int, error)
             return i, nil
         }
     }
-    return -1, fmt.Errorf("no free blocks for Block Pointer Table")
+    return -1, fmt.Errorf("%w: no free blocks for Block Pointer Table", ErrNoSpace)
 }
 
 // allocateDataBlock finds and allocates a free data block
@@ -447,111 +939,87 @@ func (fs *FileSystem) allocateDataBlock() (int, error) {
     for i := 0; i < len(fs.DataBlocks); i++ {
         if fs.FreeBlocks[i] {
             fs.FreeBlocks[i] = false
+            clear(fs.DataBlocks[i])
             return i, nil
         }
     }
-    return -1, fmt.Errorf("no free data blocks")
+    return -1, fmt.Errorf("%w: no free data blocks", ErrNoSpace)
 }
 
 // writeBlock writes data to a specific block
 func (fs *FileSystem) writeBlock(blockIndex int, data []byte) error {
     if blockIndex < 0 || blockIndex >= len(fs.DataBlocks) {
-        return fmt.Errorf("invalid block index")
+        return fmt.Errorf("%w: invalid block index", ErrCorrupt)
     }
     copy(fs.DataBlocks[blockIndex], data)
     return nil
 }
 
-// updateBlockPointerTable updates a Block Pointer Table entry
+// updateBlockPointerTable points logical block entryIndex of the file whose
+// first Block Pointer Table lives in bptIndex at blockIndex, following the
+// chaining pointers and allocating further tables when the chain is too short
 func (fs *FileSystem) updateBlockPointerTable(bptIndex, entryIndex, blockIndex int) error {
     if bptIndex < 0 || bptIndex >= len(fs.DataBlocks) {
-        return fmt.Errorf("invalid BPT index")
-    }
-
-    // Calculate entry offset
-    entryOffset := 4 + (entryIndex % 7) * 4
-    if entryOffset+4 > len(fs.DataBlocks[bptIndex]) {
-        return fmt.Errorf("entry offset out of bounds")
+        return fmt.Errorf("%w: invalid BPT index", ErrCorrupt)
     }
 
-    // Write block index to the specified offset
-    binary.LittleEndian.PutUint32(fs.DataBlocks[bptIndex][entryOffset:], uint32(blockIndex))
-
-    // Check if we need to set a chaining pointer
-    if entryIndex%7 == 6 { // If this is the last pointer in the group
-        nextBPTCount := binary.LittleEndian.Uint32(fs.DataBlocks[bptIndex][:4]) // Assuming first 4 bytes store count
-        if entryIndex/7+1 < int(nextBPTCount) { // Check if there are more entries needed
-            nextBPTIndex, err := fs.allocateBlockPointerTable((entryIndex + 1) / 7)
+    // Walk the chain to the table holding this entry
+    for i := 0; i < entryIndex/PointersPerBPT; i++ {
+        next := fs.bptSlot(bptIndex, bptChainSlot)
+        if next == HoleBlock {
+            newBPT, err := fs.allocateBlockPointerTable(entryIndex + 1 - (i+1)*PointersPerBPT)
             if err != nil {
                 return err
             }
-            // Set chaining pointer at the end of current block pointer table
-            binary.LittleEndian.PutUint32(fs.DataBlocks[bptIndex][32:], uint32(nextBPTIndex))
+            fs.setBPTSlot(bptIndex, bptChainSlot, int32(newBPT))
+            next = int32(newBPT)
+        }
+        if !fs.validBlock(next) {
+            return fmt.Errorf("%w: invalid BPT index", ErrCorrupt)
         }
+        bptIndex = int(next)
     }
 
-    return nil
-}
-
-// updateDABPT updates a DABPT entry
-func (fs *FileSystem) updateDABPT(fntIndex int, entry DABPTEntry) error {
-    if fntIndex < 0 || fntIndex >= len(fs.DABPT) {
-        return fmt.Errorf("invalid FNT index")
-    }
-    fs.DABPT[fntIndex] = entry
+    // Write block index to the slot for this entry
+    fs.setBPTSlot(bptIndex, entryIndex%PointersPerBPT, int32(blockIndex))
     return nil
 }
 
 func RenameFS(fs *FileSystem, currentFileName string, newFileName string) error {
-    // Convert currentFileName and newFileName to byte
-    /*
-// Convert currentUser to bytes
-    var username [MaxUsername]byte
-    copy(username[:], currentUser)
-
-    if len(currentUser) > MaxUsername {
-        username = [MaxUsername]byte{}
-        copy(username[:], currentUser[:MaxUsername])
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    if err := fs.beginWrite(); err != nil {
+        return err
     }
-    */
 
-
-    var currentFileNameBytes [MaxFilename]byte
-    var newFileNameBytes [MaxFilename]byte
-    copy(currentFileNameBytes[:], currentFileName)
-    copy(newFileNameBytes[:], newFileName)
-    if (len(currentFileNameBytes) > MaxFilename) {
-        currentFileNameBytes = [MaxFilename]byte{}
-        copy(currentFileNameBytes[:], currentFileName[:MaxFilename])
+    // Validate the new name and find the file
+    newName, err := fs.cleanName(newFileName)
+    if err != nil {
+        return pathError("rename", newFileName, err)
     }
-    if (len(newFileNameBytes) > MaxFilename) {
-        newFileNameBytes = [MaxFilename]byte{}
-        copy(newFileNameBytes[:], newFileName[:MaxFilename])
+    fntIndex, err := fs.lookup(currentFileName)
+    if err != nil {
+        return pathError("rename", currentFileName, err)
     }
 
     // Check if the new filename already exists (case-sensitive)
-    for _, entry := range fs.FNT {
-        if entry.Filename == newFileNameBytes {
-            return fmt.Errorf("file with name '%s' already exists", newFileName)
-        }
+    if existing, err := fs.lookup(newName); err == nil && existing != fntIndex {
+        return pathError("rename", newFileName, ErrExist)
     }
-
-    // Find the index of the current file in FNT
-    var fntIndex int = -1
-    for i, entry := range fs.FNT {
-        if entry.Filename == currentFileNameBytes {
-            fntIndex = i
-            break
-        }
+    if err := fs.checkPath(newName, fntIndex); err != nil {
+        return pathError("rename", newFileName, err)
     }
 
-    // If file not found, return an error
-    if fntIndex == -1 {
-        return fmt.Errorf("file '%s' not found in filesystem", currentFileName)
+    // Store the new name before freeing the old one, so a failure leaves the
+    // file untouched
+    newIndex, err := fs.storeName(newName)
+    if err != nil {
+        return pathError("rename", currentFileName, err)
     }
-
-    // Update the filename in FNT
-    fs.FNT[fntIndex].Filename = newFileNameBytes
+    inode := fs.FNT[fntIndex].InodePointer
+    fs.clearName(fntIndex)
+    fs.FNT[newIndex].InodePointer = inode
+    fs.changed()
 
     return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,69 @@
+package filesystem
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReadDirFS describes the files and directories directly inside dir, sorted
+// by name. The file system is flat, so a directory is every name sharing its
+// prefix up to a '/'; "" is the top. Directories report the time the newest
+// file below them was modified.
+func ReadDirFS(fs *FileSystem, dir string) ([]FileStat, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	dir = strings.Trim(dir, "/")
+	if dir == "." {
+		dir = ""
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	var entries []FileStat
+	dirs := make(map[string]int) // Index in entries
+	found, isFile := dir == "", false
+	for _, file := range fs.files() {
+		isFile = isFile || file.name == dir
+		rel, ok := strings.CutPrefix(file.name, prefix)
+		if !ok {
+			continue
+		}
+		found = true
+		if file.inode < 0 || int(file.inode) >= len(fs.DABPT) {
+			return nil, pathError("readdir", file.name, ErrCorrupt)
+		}
+
+		child, _, below := strings.Cut(rel, "/")
+		if !below {
+			st, err := fs.stat(file.name, int(file.inode))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, *st)
+			continue
+		}
+		i, seen := dirs[child]
+		if !seen {
+			i = len(entries)
+			dirs[child] = i
+			entries = append(entries, FileStat{Name: prefix + child, Inode: -1, Mode: DirMode})
+		}
+		modTime := time.Unix(int64(fs.DABPT[file.inode].LastModified), 0)
+		if modTime.After(entries[i].LastModified) {
+			entries[i].LastModified = modTime
+		}
+	}
+	switch {
+	case !found && isFile:
+		return nil, pathError("readdir", dir, ErrInvalid) // Not a directory
+	case !found:
+		return nil, pathError("readdir", dir, ErrNotExist)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
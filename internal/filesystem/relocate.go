@@ -0,0 +1,113 @@
+package filesystem
+
+import "fmt"
+
+// blockRef records where a block in use by a file is referenced from: either
+// the head of an inode's Block Pointer Table chain (bpt == -1), or a slot of
+// another Block Pointer Table.
+type blockRef struct {
+	inode int
+	bpt   int
+	slot  int
+}
+
+// isBPT reports whether the referenced block holds a Block Pointer Table
+func (r blockRef) isBPT() bool {
+	return r.bpt == -1 || r.slot == bptChainSlot
+}
+
+// metaBlocks returns the number of leading blocks reserved for the FNT and
+// DABPT, matching the reservation made by FormatFS
+func (fs *FileSystem) metaBlocks() int {
+	return metaBlocksFor(len(fs.FNT), len(fs.DABPT))
+}
+
+// metaBlocksFor returns the number of blocks an FNT and DABPT of the given
+// lengths take up
+func metaBlocksFor(numFilenames, numDABPTEntries int) int {
+	return (numFilenames+fntEntriesPerBlock-1)/fntEntriesPerBlock +
+		(numDABPTEntries+dabptEntriesPerBlock-1)/dabptEntriesPerBlock
+}
+
+// liveInodes returns the inodes referenced by the FNT, in FNT order
+func (fs *FileSystem) liveInodes() []int {
+	var inodes []int
+	for _, file := range fs.files() {
+		if file.inode >= 0 && int(file.inode) < len(fs.DABPT) {
+			inodes = append(inodes, int(file.inode))
+		}
+	}
+	return inodes
+}
+
+// blockRefs maps every block used by a live file to the place it is
+// referenced from
+func (fs *FileSystem) blockRefs() (map[int]blockRef, error) {
+	refs := make(map[int]blockRef)
+	add := func(block int, ref blockRef) error {
+		if prev, ok := refs[block]; ok {
+			return fmt.Errorf("%w: block %d is shared by inodes %d and %d", ErrCorrupt, block, prev.inode, ref.inode)
+		}
+		refs[block] = ref
+		return nil
+	}
+
+	for _, inode := range fs.liveInodes() {
+		chain, err := fs.bptChain(inode)
+		if err != nil {
+			return nil, err
+		}
+		blocks, err := fs.fileBlocks(inode)
+		if err != nil {
+			return nil, err
+		}
+		for t, bpt := range chain {
+			ref := blockRef{inode: inode, bpt: -1}
+			if t > 0 {
+				ref = blockRef{inode: inode, bpt: chain[t-1], slot: bptChainSlot}
+			}
+			if err := add(bpt, ref); err != nil {
+				return nil, err
+			}
+		}
+		for i, blk := range blocks {
+			if blk == HoleBlock {
+				continue
+			}
+			ref := blockRef{inode: inode, bpt: chain[i/PointersPerBPT], slot: i % PointersPerBPT}
+			if err := add(int(blk), ref); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return refs, nil
+}
+
+// moveBlock copies a block used by a file to the free block to, repoints its
+// reference and frees the old block. refs is kept up to date, including the
+// references held by a moved Block Pointer Table.
+func (fs *FileSystem) moveBlock(refs map[int]blockRef, from, to int) {
+	ref := refs[from]
+	copy(fs.DataBlocks[to], fs.DataBlocks[from])
+	fs.FreeBlocks[to] = false
+
+	if ref.bpt == -1 {
+		fs.DABPT[ref.inode].BlockPointerTableIndex = int32(to)
+	} else {
+		fs.setBPTSlot(ref.bpt, ref.slot, int32(to))
+	}
+
+	if ref.isBPT() {
+		for slot := 0; slot <= bptChainSlot; slot++ {
+			child := int(fs.bptSlot(to, slot))
+			if childRef, ok := refs[child]; ok && childRef.bpt == from && childRef.slot == slot {
+				childRef.bpt = to
+				refs[child] = childRef
+			}
+		}
+	}
+
+	delete(refs, from)
+	refs[to] = ref
+	fs.freeBlock(from)
+}
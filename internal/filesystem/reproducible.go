@@ -0,0 +1,110 @@
+package filesystem
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpoch returns the time given by the SOURCE_DATE_EPOCH environment
+// variable, the convention reproducible builds use to fix timestamps. It
+// reports false if the variable is not set.
+func SourceDateEpoch() (time.Time, bool, error) {
+	value, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok || value == "" {
+		return time.Time{}, false, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false, fmt.Errorf("%w: SOURCE_DATE_EPOCH=%q is not a number of seconds", ErrInvalid, value)
+	}
+	return time.Unix(seconds, 0), true, nil
+}
+
+// CanonicalizeFS rewrites the file system so that its image depends only on
+// the files it holds and not on the order they were stored in. The tables
+// and disk keep their sizes; files are laid out again in name order with
+// contiguous blocks and no blocks for runs of zeros, every time stamp after
+// epoch is clamped to it, unused entries are stamped with epoch, and all
+// slack bytes are zero. From then on the Clock is fixed at epoch.
+func CanonicalizeFS(fs *FileSystem, epoch time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.beginWrite(); err != nil {
+		return err
+	}
+
+	clock := func() time.Time { return epoch }
+	out := CreateFS(fs.TotalBlocks, "")
+	out.CurrentUser = fs.CurrentUser
+	out.Clock = clock
+	out.staging = true
+	if err := FormatFS(out, len(fs.FNT), len(fs.DABPT)); err != nil {
+		return err
+	}
+
+	files := fs.files()
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	for _, file := range files {
+		if file.inode < 0 || int(file.inode) >= len(fs.DABPT) {
+			return fmt.Errorf("%w: invalid DABPT index for file %s", ErrCorrupt, file.name)
+		}
+		entry := fs.DABPT[file.inode]
+		modTime := time.Unix(int64(entry.LastModified), 0)
+		if modTime.After(epoch) {
+			modTime = epoch
+		}
+
+		var err error
+		if entry.FileSize == 0 {
+			// put refuses empty files, but truncate can leave one behind
+			_, err = out.addToFNT(file.name)
+		} else {
+			r := &inodeReader{fs: fs, inode: int(file.inode)}
+			err = out.put(r, PutOptions{Name: file.name}, int64(entry.FileSize), modTime)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to rewrite %s: %w", file.name, err)
+		}
+
+		fntIndex, err := out.lookup(file.name)
+		if err != nil {
+			return err
+		}
+		inode := out.FNT[fntIndex].InodePointer
+		if entry.FileSize == 0 {
+			out.DABPT[inode] = DABPTEntry{BlockPointerTableIndex: HoleBlock, Flags: InodeInline}
+		}
+		out.DABPT[inode].LastModified = uint32(modTime.Unix())
+		out.DABPT[inode].Username = entry.Username
+	}
+
+	fs.FNT = out.FNT
+	fs.DABPT = out.DABPT
+	fs.DataBlocks = out.DataBlocks
+	fs.FreeBlocks = out.FreeBlocks
+	fs.Clock = clock
+	fs.changed()
+	return nil
+}
+
+// inodeReader reads the contents of an inode from the start
+type inodeReader struct {
+	fs    *FileSystem
+	inode int
+	off   int64
+}
+
+func (r *inodeReader) Read(p []byte) (int, error) {
+	size := int64(r.fs.DABPT[r.inode].FileSize)
+	if r.off >= size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), size-r.off)]
+	n, err := r.fs.readAt(r.inode, p, r.off)
+	r.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,66 @@
+package filesystem
+
+import "fmt"
+
+// ResizeFS changes the number of blocks in the file system. Growing adds free
+// blocks at the end of the disk. Shrinking first moves every file block out
+// of the blocks being removed, and fails without changing anything if the
+// remaining free space cannot hold them.
+func ResizeFS(fs *FileSystem, numBlocks int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.beginWrite(); err != nil {
+		return err
+	}
+
+	if numBlocks < fs.metaBlocks() || numBlocks <= 0 {
+		return fmt.Errorf("%w: cannot resize to %d blocks, %d blocks are reserved for the FNT and DABPT", ErrInvalid, numBlocks, fs.metaBlocks())
+	}
+
+	if numBlocks >= fs.TotalBlocks {
+		for i := fs.TotalBlocks; i < numBlocks; i++ {
+			fs.DataBlocks = append(fs.DataBlocks, make([]byte, BlockSize))
+			fs.FreeBlocks = append(fs.FreeBlocks, true)
+		}
+		fs.TotalBlocks = numBlocks
+		fs.changed()
+		return nil
+	}
+
+	refs, err := fs.blockRefs()
+	if err != nil {
+		return err
+	}
+
+	// Make sure everything in the tail fits into the free blocks that remain
+	var tail []int
+	for i := numBlocks; i < fs.TotalBlocks; i++ {
+		if _, ok := refs[i]; ok {
+			tail = append(tail, i)
+		}
+	}
+	free := 0
+	for i := 0; i < numBlocks; i++ {
+		if fs.FreeBlocks[i] {
+			free++
+		}
+	}
+	if free < len(tail) {
+		return fmt.Errorf("%w: %d blocks in use past block %d but only %d free blocks before it", ErrNoSpace, len(tail), numBlocks, free)
+	}
+
+	// Relocate tail blocks into the lowest free blocks
+	next := 0
+	for _, from := range tail {
+		for !fs.FreeBlocks[next] {
+			next++
+		}
+		fs.moveBlock(refs, from, next)
+	}
+
+	fs.DataBlocks = fs.DataBlocks[:numBlocks]
+	fs.FreeBlocks = fs.FreeBlocks[:numBlocks]
+	fs.TotalBlocks = numBlocks
+	fs.changed()
+	return nil
+}
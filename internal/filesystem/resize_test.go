@@ -0,0 +1,80 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		blocks int
+		want   error
+	}{
+		{"grow", 200, nil},
+		{"keep", 128, nil},
+		{"shrink past used blocks", 64, nil},
+		{"shrink without room", 50, ErrNoSpace},
+		{"shrink into the tables", 8, ErrInvalid},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fs := newTestImage(t, 128)
+			files := map[string][]byte{
+				"first":  bytes.Repeat([]byte("1"), 20*BlockSize),
+				"second": bytes.Repeat([]byte("2"), 20*BlockSize),
+				"third":  bytes.Repeat([]byte("3"), 20*BlockSize),
+			}
+			for _, name := range []string{"first", "second", "third"} {
+				if _, err := PutReaderFS(fs, bytes.NewReader(files[name]), PutOptions{Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Leave a gap at the front for the tail to move into
+			if err := RemoveFS(fs, "first"); err != nil {
+				t.Fatal(err)
+			}
+			delete(files, "first")
+
+			refs, err := fs.blockRefs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := 0
+			for block := range refs {
+				last = max(last, block)
+			}
+			if c.blocks < fs.TotalBlocks && c.blocks > fs.metaBlocks() && last < c.blocks {
+				t.Fatalf("no file block past block %d to move", c.blocks)
+			}
+
+			err = ResizeFS(fs, c.blocks)
+			if !errors.Is(err, c.want) || (err == nil) != (c.want == nil) {
+				t.Fatalf("ResizeFS(%d) = %v, want %v", c.blocks, err, c.want)
+			}
+			if err != nil {
+				if fs.TotalBlocks != 128 {
+					t.Errorf("failed resize left %d blocks", fs.TotalBlocks)
+				}
+				checkFiles(t, fs, files)
+				return
+			}
+
+			image := fs.DiskName
+			if err := SaveFS(fs, image); err != nil {
+				t.Fatal(err)
+			}
+			CloseFS(fs)
+			fs, err = OpenFS(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer CloseFS(fs)
+			if fs.TotalBlocks != c.blocks || len(fs.DataBlocks) != c.blocks || len(fs.FreeBlocks) != c.blocks {
+				t.Fatalf("reopened image has %d blocks, want %d", fs.TotalBlocks, c.blocks)
+			}
+			checkMetaArea(t, fs)
+			checkFiles(t, fs, files)
+		})
+	}
+}
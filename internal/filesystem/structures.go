@@ -1,10 +1,34 @@
 package filesystem
 
+import (
+	"encoding/binary"
+	iofs "io/fs"
+	"sync"
+	"time"
+)
+
 const (
-	BlockSize            = 256
-	MaxFilename          = 56
-	MaxUsername          = 40
-	EntriesPerDABPTBlock = 4
+	BlockSize     = 256
+	MaxFilename   = 56
+	MaxUsername   = 40
+	MaxInlineSize = 72 // Files up to this size live inside their DABPT entry
+)
+
+// Number of table entries that fit in one metadata block, going by the size
+// of an entry as SaveFS writes it
+var (
+	fntEntriesPerBlock   = BlockSize / binary.Size(FNTEntry{})
+	dabptEntriesPerBlock = BlockSize / binary.Size(DABPTEntry{})
+)
+
+// imageVersion is the on-disk format written by SaveFS. It is stored negated
+// ahead of the block count so that legacy images, which begin directly with a
+// positive block count, can still be told apart and opened.
+const imageVersion = 2
+
+// DABPT entry flags
+const (
+	InodeInline uint32 = 1 << iota // File data is stored in DABPTEntry.Inline
 )
 
 type FNTEntry struct {
@@ -17,13 +41,29 @@ type DABPTEntry struct {
 	LastModified           uint32 // Unix timestamp in seconds
 	BlockPointerTableIndex int32
 	Username               [MaxUsername]byte
+	Flags                  uint32
+	Inline                 [MaxInlineSize]byte // Contents of small files, see InodeInline
+}
+
+// legacyDABPTEntry is the DABPT record used by images written before
+// entries carried flags and inline data
+type legacyDABPTEntry struct {
+	FileSize               int32
+	LastModified           uint32
+	BlockPointerTableIndex int32
+	Username               [MaxUsername]byte
 }
 
 type BlockPointerTable struct {
 	Pointers [8]int32 // 7 data block pointers + 1 chaining pointer
 }
 
+// FileSystem is an in-memory disk image. The package functions that take a
+// *FileSystem are safe for concurrent use; the exported fields are not
+// synchronized and must not be accessed while other goroutines use it.
 type FileSystem struct {
+	mu sync.RWMutex // Guards every field below
+
 	FNT         []FNTEntry
 	DABPT       []DABPTEntry
 	DataBlocks  [][]byte
@@ -31,4 +71,101 @@ type FileSystem struct {
 	FreeBlocks  []bool
 	CurrentUser [MaxUsername]byte
 	DiskName    string
-}
\ No newline at end of file
+
+	// NameNormalizer, if set, maps every file name to the form it is stored
+	// and looked up under, e.g. norm.NFC.String from golang.org/x/text, so
+	// that names differing only in Unicode composition cannot coexist. Set it
+	// before storing any file and use the same one every time an image is
+	// opened.
+	NameNormalizer func(string) string
+
+	// Clock, if set, supplies the time stamped on new and changed files and
+	// on unused DABPT entries in place of time.Now, e.g. to build images that
+	// do not depend on when they were built
+	Clock func() time.Time
+
+	lock       *imageLock // Lock on the image at DiskName, see OpenFSWithOptions
+	readOnly   bool
+	generation uint64 // Bumped on every change, see changed
+	staging    bool   // Set on transaction copies, which are only saved by Commit
+}
+
+// now returns the current time according to Clock
+func (fs *FileSystem) now() time.Time {
+	if fs.Clock != nil {
+		return fs.Clock()
+	}
+	return time.Now()
+}
+
+// ReadOnly reports whether the file system was opened with OpenOptions.ReadOnly
+func (fs *FileSystem) ReadOnly() bool {
+	return fs.readOnly
+}
+
+// PutMode decides what PutFSWithOptions does when the name is already taken
+type PutMode int
+
+const (
+	PutCreate    PutMode = iota // Fail with ErrExist
+	PutOverwrite                // Replace the existing file's contents
+	PutNoClobber                // Keep the existing file and report success
+)
+
+// PutOutcome tells what storing a file did with the name it was stored under
+type PutOutcome int
+
+const (
+	PutCreated  PutOutcome = iota + 1 // A new file was created
+	PutReplaced                       // The existing file's contents were replaced
+	PutKept                           // The existing file was left alone, see PutNoClobber
+)
+
+// PutOptions control how PutFSWithOptions stores a file
+type PutOptions struct {
+	Name       string // Internal name; defaults to the base name of the external file
+	Mode       PutMode
+	Owner      string // Owner of the stored file; defaults to CurrentUser
+	AllowEmpty bool   // Store empty files instead of rejecting them
+}
+
+// OpenOptions control how OpenFSWithOptions opens a disk image
+type OpenOptions struct {
+	Force    bool // Open the image even if another process has it locked
+	ReadOnly bool // Share the image with other readers and refuse all changes
+}
+
+// FileStat describes a stored file, or a directory listed by ReadDirFS. Size
+// is the logical length of the file, while AllocatedSize only counts blocks
+// actually backed by the disk, so a sparse file reports less allocated space
+// than its size.
+type FileStat struct {
+	Name            string
+	Inode           int // DABPT index, which changes when a put replaces the file; -1 for directories
+	Size            int64
+	AllocatedBlocks int
+	AllocatedSize   int64
+	Inline          bool
+	LastModified    time.Time
+	Owner           string
+	Mode            iofs.FileMode // FileMode or DirMode, as there are no permissions
+}
+
+// Modes reported for files and directories
+const (
+	FileMode iofs.FileMode = 0644
+	DirMode                = iofs.ModeDir | 0755
+)
+
+// IsDir reports whether st describes a directory
+func (st *FileStat) IsDir() bool {
+	return st.Mode.IsDir()
+}
+
+// Usage reports how much of the disk and the file name table is taken
+type Usage struct {
+	TotalBlocks int
+	FreeBlocks  int
+	Names       int // FNT entries, which grow into free blocks when full
+	FreeNames   int
+}
@@ -0,0 +1,325 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SyncStateFile is the file in the host directory where SyncFS remembers what
+// both sides looked like after the last sync, so it can tell which side
+// changed since
+const SyncStateFile = ".fssync"
+
+// SyncOptions control SyncFS
+type SyncOptions struct {
+	Delete   bool // Propagate files deleted on one side since the last sync
+	DryRun   bool // Only report what would be done, leaving both sides and the saved state alone
+	Checksum bool // Compare contents when sizes match but times differ
+}
+
+// SyncOp is what SyncFS does with one file
+type SyncOp int
+
+const (
+	SyncPut         SyncOp = iota // Copy from the host into the image
+	SyncGet                       // Copy from the image to the host
+	SyncDeleteImage               // Remove from the image
+	SyncDeleteHost                // Remove from the host
+	SyncConflict                  // Both sides changed; nothing is copied
+)
+
+func (op SyncOp) String() string {
+	switch op {
+	case SyncPut:
+		return "put"
+	case SyncGet:
+		return "get"
+	case SyncDeleteImage:
+		return "delete from image"
+	case SyncDeleteHost:
+		return "delete from host"
+	case SyncConflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("SyncOp(%d)", int(op))
+}
+
+// SyncAction is one step of a sync, named by the path relative to both trees
+type SyncAction struct {
+	Name string
+	Op   SyncOp
+}
+
+// SyncResult lists the actions taken, or planned for a dry run, in name order
+type SyncResult struct {
+	Actions []SyncAction
+	Failed  []error // One error per action that could not be carried out
+}
+
+// syncFile is what one side of a sync knows about a file
+type syncFile struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix seconds, the precision of LastModified
+	exists  bool   // Only set for the current state of a side
+	hostAt  string // Host path, for the host side
+	inode   int    // Inode, for the image side
+}
+
+// syncState is the content of SyncStateFile
+type syncState struct {
+	Image string              `json:"image"`
+	Dir   string              `json:"dir"`
+	Files map[string]syncFile `json:"files"`
+}
+
+// SyncFS brings the host directory hostDir and the internal directory dir (""
+// for the whole image) in step. Files are compared by size and modification
+// time against the state saved by the previous sync: a file that changed on
+// one side only is copied to the other, and one that changed on both is
+// reported as a conflict and left alone. Files deleted on one side are
+// copied back unless opts.Delete is set, in which case the deletion is
+// carried over. The first sync has no saved state, so files present on both
+// sides that differ are conflicts.
+func SyncFS(fs *FileSystem, hostDir, dir string, opts SyncOptions) (*SyncResult, error) {
+	if opts.DryRun {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+	} else {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if err := fs.beginWrite(); err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := ""
+	if dir != "" && dir != "." {
+		clean, err := fs.cleanName(strings.TrimSuffix(dir, "/"))
+		if err != nil {
+			return nil, pathError("sync", dir, err)
+		}
+		dir = clean
+		prefix = clean + "/"
+	} else {
+		dir = ""
+	}
+
+	host, err := hostFiles(hostDir)
+	if err != nil {
+		return nil, err
+	}
+	image := make(map[string]syncFile)
+	for _, file := range fs.files() {
+		rel, ok := strings.CutPrefix(file.name, prefix)
+		if !ok || file.inode < 0 || int(file.inode) >= len(fs.DABPT) {
+			continue
+		}
+		entry := fs.DABPT[file.inode]
+		image[rel] = syncFile{Size: int64(entry.FileSize), ModTime: int64(entry.LastModified), exists: true, inode: int(file.inode)}
+	}
+
+	// Saved state only applies to the same image and directory
+	statePath := filepath.Join(hostDir, SyncStateFile)
+	state, err := readSyncState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	if state.Image != filepath.Base(fs.DiskName) || state.Dir != dir {
+		state = syncState{Files: make(map[string]syncFile)}
+	}
+
+	names := make(map[string]bool)
+	for _, set := range []map[string]syncFile{host, image, state.Files} {
+		for name := range set {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	result := &SyncResult{}
+	next := syncState{Image: filepath.Base(fs.DiskName), Dir: dir, Files: make(map[string]syncFile)}
+	imageChanged := false
+	for _, name := range sorted {
+		h, i := host[name], image[name]
+		last, known := state.Files[name]
+		op, act := syncDecide(h, i, last, known, opts.Delete, func() bool {
+			return opts.Checksum && fs.sameContents(h, i)
+		})
+		if !act {
+			if h.exists && i.exists {
+				next.Files[name] = syncFile{Size: h.Size, ModTime: h.ModTime}
+			}
+			continue
+		}
+
+		result.Actions = append(result.Actions, SyncAction{Name: name, Op: op})
+		if op == SyncConflict || opts.DryRun {
+			if known {
+				next.Files[name] = last
+			}
+			continue
+		}
+
+		internal := path.Join(dir, name)
+		switch op {
+		case SyncPut:
+			err = fs.putHostFile(h.hostAt, PutOptions{Name: internal, Mode: PutOverwrite})
+			imageChanged = imageChanged || err == nil
+		case SyncGet:
+			var target string
+			if target, err = hostPath(hostDir, name); err == nil {
+				err = fs.getHostFile(i.inode, target)
+			}
+		case SyncDeleteImage:
+			err = fs.removeFile(internal)
+			imageChanged = imageChanged || err == nil
+		case SyncDeleteHost:
+			err = os.Remove(h.hostAt)
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, fmt.Errorf("%s %s: %w", op, name, err))
+			if known {
+				next.Files[name] = last
+			}
+			continue
+		}
+		if op == SyncPut {
+			next.Files[name] = syncFile{Size: h.Size, ModTime: h.ModTime}
+		} else if op == SyncGet {
+			next.Files[name] = syncFile{Size: i.Size, ModTime: i.ModTime}
+		}
+	}
+
+	if opts.DryRun {
+		return result, nil
+	}
+	if imageChanged {
+		if err := fs.autosave(); err != nil {
+			return result, err
+		}
+	}
+	return result, writeSyncState(statePath, next)
+}
+
+// syncDecide works out what to do with a file given its state on the host,
+// in the image and after the last sync. It returns false when both sides are
+// already in step.
+func syncDecide(h, i, last syncFile, known, propagateDelete bool, sameContents func() bool) (SyncOp, bool) {
+	hostChanged := h.exists != known || (h.exists && !h.same(last))
+	imageChanged := i.exists != known || (i.exists && !i.same(last))
+
+	switch {
+	case !h.exists && !i.exists:
+		return 0, false
+	case h.exists && i.exists && (h.same(i) || sameContents()):
+		return 0, false
+	case hostChanged && imageChanged:
+		// Includes a file deleted on one side and changed on the other
+		return SyncConflict, true
+	case !h.exists && known && propagateDelete:
+		return SyncDeleteImage, true
+	case !i.exists && known && propagateDelete:
+		return SyncDeleteHost, true
+	case !i.exists || (hostChanged && h.exists):
+		return SyncPut, true
+	default:
+		return SyncGet, true
+	}
+}
+
+// same reports whether two sides of a file have the same size and time
+func (f syncFile) same(other syncFile) bool {
+	return f.Size == other.Size && f.ModTime == other.ModTime
+}
+
+// sameContents compares a host file with an image file byte for byte by hash
+func (fs *FileSystem) sameContents(h, i syncFile) bool {
+	if h.Size != i.Size {
+		return false
+	}
+	f, err := os.Open(h.hostAt)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	hostHash, imageHash := sha256.New(), sha256.New()
+	if _, err := io.Copy(hostHash, f); err != nil {
+		return false
+	}
+	if err := fs.copyOut(i.inode, imageHash); err != nil {
+		return false
+	}
+	return bytes.Equal(hostHash.Sum(nil), imageHash.Sum(nil))
+}
+
+// hostFiles returns the regular files below hostDir by slash separated
+// relative path, leaving out the sync state file
+func hostFiles(hostDir string) (map[string]syncFile, error) {
+	files := make(map[string]syncFile)
+	err := filepath.WalkDir(hostDir, func(hostPath string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(hostDir, hostPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == SyncStateFile {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = syncFile{Size: info.Size(), ModTime: info.ModTime().Unix(), exists: true, hostAt: hostPath}
+		return nil
+	})
+	return files, err
+}
+
+// readSyncState loads the saved sync state, which is empty before the first
+// sync
+func readSyncState(name string) (syncState, error) {
+	state := syncState{Files: make(map[string]syncFile)}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("%w: %s: %w", ErrCorrupt, name, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]syncFile)
+	}
+	return state, nil
+}
+
+// writeSyncState saves the sync state for the next sync
+func writeSyncState(name string, state syncState) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
@@ -0,0 +1,68 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncRefusesEscapingNames(t *testing.T) {
+	fs := newTestImage(t, 256)
+	for _, name := range []string{"safe.txt", "a"} {
+		if _, err := PutReaderFS(fs, bytes.NewReader([]byte(name)), PutOptions{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeRawName(t, fs, "a", "../escaped")
+
+	top := t.TempDir()
+	hostDir := filepath.Join(top, "host")
+	if err := os.Mkdir(hostDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	result, err := SyncFS(fs, hostDir, "", SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) != 1 || !errors.Is(result.Failed[0], ErrInvalid) {
+		t.Fatalf("sync failed with %v, want one ErrInvalid", result.Failed)
+	}
+	if _, err := os.Stat(filepath.Join(top, "escaped")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("../escaped was written outside the host directory: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(hostDir, "safe.txt")); err != nil || string(data) != "safe.txt" {
+		t.Fatalf("safe.txt holds %q, %v", data, err)
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	fs := newTestImage(t, 256)
+	if _, err := PutReaderFS(fs, bytes.NewReader([]byte("image")), PutOptions{Name: "image.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	hostDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(hostDir, "host.txt"), []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := SyncFS(fs, hostDir, "", SyncOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SyncAction{{Name: "host.txt", Op: SyncPut}, {Name: "image.txt", Op: SyncGet}}
+	if len(result.Actions) != len(want) || result.Actions[0] != want[0] || result.Actions[1] != want[1] {
+		t.Fatalf("dry run planned %v, want %v", result.Actions, want)
+	}
+
+	// Neither side nor the saved state changed
+	if _, err := StatFS(fs, "host.txt"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("dry run put host.txt: %v", err)
+	}
+	for _, name := range []string{"image.txt", SyncStateFile} {
+		if _, err := os.Stat(filepath.Join(hostDir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("dry run wrote %s: %v", name, err)
+		}
+	}
+}
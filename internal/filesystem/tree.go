@@ -0,0 +1,238 @@
+package filesystem
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TreeOptions control how PutTreeFS and GetTreeFS copy a directory tree.
+// Patterns use path.Match syntax and are tried against both the slash
+// separated path relative to the top of the tree and its last element.
+type TreeOptions struct {
+	Include []string // Only copy files matching one of these, if any are given
+	Exclude []string // Leave out files and directories matching any of these
+	Mode    PutMode  // What to do with files that already exist at the target
+}
+
+// TreeSummary reports the outcome of copying a directory tree
+type TreeSummary struct {
+	Copied  int
+	Skipped int     // Left out by the patterns or Mode, or not a regular file
+	Failed  []error // One error per file that could not be copied
+}
+
+// check rejects malformed patterns before anything is copied
+func (o TreeOptions) check() error {
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: bad pattern %q", ErrInvalid, pattern)
+		}
+	}
+	return nil
+}
+
+// selected reports whether the file at rel should be copied. A file is left
+// out when it or any directory above it is excluded.
+func (o TreeOptions) selected(rel string) bool {
+	for dir := rel; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if matchAny(o.Exclude, dir) {
+			return false
+		}
+	}
+	return len(o.Include) == 0 || matchAny(o.Include, rel)
+}
+
+// matchAny reports whether rel or its last element matches one of patterns
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PutTreeFS stores every regular file below hostDir, naming each one by its
+// path relative to hostDir under the internal directory dir ("" for none).
+// Modification times are kept; permissions are not, as the image has nowhere
+// to record them. Files that fail are reported in the summary and the rest
+// are still copied. The image is saved once at the end.
+func PutTreeFS(fs *FileSystem, hostDir, dir string, opts TreeOptions) (*TreeSummary, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.beginWrite(); err != nil {
+		return nil, err
+	}
+
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(hostDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, pathError("put", hostDir, fmt.Errorf("%w: not a directory", ErrInvalid))
+	}
+
+	summary := &TreeSummary{}
+	err = filepath.WalkDir(hostDir, func(hostPath string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			summary.Failed = append(summary.Failed, err)
+			return nil
+		}
+		rel, err := filepath.Rel(hostDir, hostPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if matchAny(opts.Exclude, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !opts.selected(rel) {
+			summary.Skipped++
+			return nil
+		}
+
+		name := path.Join(dir, rel)
+		if opts.Mode == PutNoClobber {
+			if clean, err := fs.cleanName(name); err == nil {
+				if _, err := fs.lookup(clean); err == nil {
+					summary.Skipped++
+					return nil
+				}
+			}
+		}
+		if err := fs.putHostFile(hostPath, PutOptions{Name: name, Mode: opts.Mode}); err != nil {
+			summary.Failed = append(summary.Failed, fmt.Errorf("%s: %w", hostPath, err))
+			return nil
+		}
+		summary.Copied++
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	if summary.Copied > 0 {
+		return summary, fs.autosave()
+	}
+	return summary, nil
+}
+
+// putHostFile stores one host file without saving the image
+func (fs *FileSystem) putHostFile(hostPath string, opts PutOptions) error {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return fs.put(f, opts, info.Size(), info.ModTime())
+}
+
+// GetTreeFS copies every file in the internal directory dir ("" for the whole
+// image) to hostDir, creating host directories as needed and setting each
+// file's modification time. Existing host files are replaced unless Mode is
+// PutNoClobber.
+func GetTreeFS(fs *FileSystem, dir, hostDir string, opts TreeOptions) (*TreeSummary, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if dir != "" && dir != "." {
+		clean, err := fs.cleanName(strings.TrimSuffix(dir, "/"))
+		if err != nil {
+			return nil, pathError("get", dir, err)
+		}
+		prefix = clean + "/"
+	}
+
+	summary := &TreeSummary{}
+	found := false
+	for _, file := range fs.files() {
+		rel, ok := strings.CutPrefix(file.name, prefix)
+		if !ok {
+			continue
+		}
+		found = true
+		target, err := hostPath(hostDir, rel)
+		if err != nil {
+			summary.Failed = append(summary.Failed, fmt.Errorf("%s: %w", file.name, err))
+			continue
+		}
+		if !opts.selected(rel) {
+			summary.Skipped++
+			continue
+		}
+		if opts.Mode == PutNoClobber {
+			if _, err := os.Lstat(target); err == nil {
+				summary.Skipped++
+				continue
+			}
+		}
+		if err := fs.getHostFile(int(file.inode), target); err != nil {
+			summary.Failed = append(summary.Failed, fmt.Errorf("%s: %w", file.name, err))
+			continue
+		}
+		summary.Copied++
+	}
+	if !found && prefix != "" {
+		return nil, pathError("get", dir, ErrNotExist)
+	}
+	return summary, nil
+}
+
+// hostPath returns the host path of the file rel below hostDir. Names read
+// from an image need not have passed cleanName, as legacy images never
+// checked them, so a name that leads outside hostDir is refused.
+func hostPath(hostDir, rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: %q leads outside %s", ErrInvalid, rel, hostDir)
+	}
+	return filepath.Join(hostDir, local), nil
+}
+
+// getHostFile writes the contents of an inode to a host file
+func (fs *FileSystem) getHostFile(inode int, hostPath string) error {
+	if inode < 0 || inode >= len(fs.DABPT) {
+		return fmt.Errorf("%w: invalid DABPT index %d", ErrCorrupt, inode)
+	}
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(hostPath)
+	if err != nil {
+		return err
+	}
+	if err := fs.copyOut(inode, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	modTime := time.Unix(int64(fs.DABPT[inode].LastModified), 0)
+	return os.Chtimes(hostPath, modTime, modTime)
+}
@@ -0,0 +1,54 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storeRawName renames a file by writing its FNT entry directly, to store
+// names as a legacy or crafted image may hold them, which cleanName refuses
+func storeRawName(t *testing.T, fs *FileSystem, name, stored string) {
+	t.Helper()
+	index, err := fs.lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.FNT[index].Filename = [MaxFilename]byte{}
+	copy(fs.FNT[index].Filename[:], stored)
+}
+
+func TestGetTreeRefusesEscapingNames(t *testing.T) {
+	fs := newTestImage(t, 256)
+	for _, name := range []string{"safe.txt", "a", "b"} {
+		if _, err := PutReaderFS(fs, bytes.NewReader([]byte(name)), PutOptions{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storeRawName(t, fs, "a", "../escaped")
+	storeRawName(t, fs, "b", "/absolute")
+
+	top := t.TempDir()
+	hostDir := filepath.Join(top, "out")
+	summary, err := GetTreeFS(fs, "", hostDir, TreeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Copied != 1 || len(summary.Failed) != 2 {
+		t.Fatalf("copied %d and failed %v, want 1 copied and 2 failed", summary.Copied, summary.Failed)
+	}
+	for _, err := range summary.Failed {
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("failure %v is not ErrInvalid", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(top, "escaped")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("../escaped was written outside the target: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(hostDir, "safe.txt")); err != nil || string(data) != "safe.txt" {
+		t.Fatalf("safe.txt holds %q, %v", data, err)
+	}
+}
@@ -0,0 +1,83 @@
+package filesystem
+
+import "fmt"
+
+// TuneFS enlarges the FNT and DABPT of a formatted file system. The extra
+// metadata blocks are taken from the start of the data area; file blocks
+// found there are moved to free blocks further along the disk. Nothing is
+// changed if the tables would shrink or the moved blocks do not fit.
+func TuneFS(fs *FileSystem, numFilenames, numDABPTEntries int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.beginWrite(); err != nil {
+		return err
+	}
+
+	if numFilenames < len(fs.FNT) || numDABPTEntries < len(fs.DABPT) {
+		return fmt.Errorf("%w: cannot shrink tables from %d filenames and %d DABPT entries", ErrInvalid, len(fs.FNT), len(fs.DABPT))
+	}
+	if numDABPTEntries < numFilenames {
+		return fmt.Errorf("%w: need at least as many DABPT entries as filenames", ErrInvalid)
+	}
+	if err := fs.growTables(numFilenames, numDABPTEntries); err != nil {
+		return err
+	}
+	fs.changed()
+	return nil
+}
+
+// growTables resizes the FNT and DABPT and reserves the metadata blocks they
+// need, relocating any file blocks in the way. Blocks are checked from the
+// start of the disk rather than from the end of the current reservation, as
+// images written while DABPT entries were smaller reserved fewer blocks.
+func (fs *FileSystem) growTables(numFilenames, numDABPTEntries int) error {
+	newMeta := metaBlocksFor(numFilenames, numDABPTEntries)
+	if newMeta > fs.TotalBlocks {
+		return fmt.Errorf("%w: not enough blocks for %d filenames and %d DABPT entries", ErrNoSpace, numFilenames, numDABPTEntries)
+	}
+
+	refs, err := fs.blockRefs()
+	if err != nil {
+		return err
+	}
+
+	// Every file block inside the new metadata area needs a free block past it
+	var inTheWay []int
+	for i := 0; i < newMeta; i++ {
+		if _, ok := refs[i]; ok {
+			inTheWay = append(inTheWay, i)
+		}
+	}
+	free := 0
+	for i := newMeta; i < fs.TotalBlocks; i++ {
+		if fs.FreeBlocks[i] {
+			free++
+		}
+	}
+	if free < len(inTheWay) {
+		return fmt.Errorf("%w: cannot move %d blocks out of the metadata area", ErrNoSpace, len(inTheWay))
+	}
+
+	next := newMeta
+	for _, from := range inTheWay {
+		for !fs.FreeBlocks[next] {
+			next++
+		}
+		fs.moveBlock(refs, from, next)
+	}
+	for i := 0; i < newMeta; i++ {
+		clear(fs.DataBlocks[i])
+		fs.FreeBlocks[i] = false // Metadata blocks are not free
+	}
+
+	for len(fs.FNT) < numFilenames {
+		fs.FNT = append(fs.FNT, FNTEntry{InodePointer: -1})
+	}
+	for len(fs.DABPT) < numDABPTEntries {
+		fs.DABPT = append(fs.DABPT, DABPTEntry{
+			LastModified:           uint32(fs.now().Unix()),
+			BlockPointerTableIndex: -1, // Invalid pointer
+		})
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// checkMetaArea fails the test if the blocks reserved for the tables are
+// free or hold file data
+func checkMetaArea(t *testing.T, fs *FileSystem) {
+	t.Helper()
+	refs, err := fs.blockRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < fs.metaBlocks(); i++ {
+		if fs.FreeBlocks[i] {
+			t.Fatalf("metadata block %d is free", i)
+		}
+		if ref, ok := refs[i]; ok {
+			t.Fatalf("metadata block %d holds data of inode %d", i, ref.inode)
+		}
+	}
+}
+
+func TestEntriesPerBlock(t *testing.T) {
+	if got := fntEntriesPerBlock * binary.Size(FNTEntry{}); got > BlockSize || BlockSize-got >= binary.Size(FNTEntry{}) {
+		t.Errorf("%d FNT entries per block do not fill a block", fntEntriesPerBlock)
+	}
+	if got := dabptEntriesPerBlock * binary.Size(DABPTEntry{}); got > BlockSize || BlockSize-got >= binary.Size(DABPTEntry{}) {
+		t.Errorf("%d DABPT entries per block do not fill a block", dabptEntriesPerBlock)
+	}
+	if got, want := metaBlocksFor(16, 16), 16/fntEntriesPerBlock+16/dabptEntriesPerBlock; got != want {
+		t.Errorf("metaBlocksFor(16, 16) = %d, want %d", got, want)
+	}
+}
+
+// TestTuneReopen grows the tables over blocks in use, then checks the files
+// and the reservation survive saving and opening the image again
+func TestTuneReopen(t *testing.T) {
+	fs := newTestImage(t, 256)
+	files := map[string][]byte{
+		"small": []byte("inline"),
+		"large": bytes.Repeat([]byte("0123456789abcdef"), 200),
+		"other": bytes.Repeat([]byte("fedcba9876543210"), 50),
+	}
+	for name, data := range files {
+		if _, err := PutReaderFS(fs, bytes.NewReader(data), PutOptions{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := fs.metaBlocks()
+
+	if err := TuneFS(fs, 32, 48); err != nil {
+		t.Fatal(err)
+	}
+	if fs.metaBlocks() <= before {
+		t.Fatalf("tuning kept %d metadata blocks", fs.metaBlocks())
+	}
+	checkMetaArea(t, fs)
+	checkFiles(t, fs, files)
+
+	image := fs.DiskName
+	if err := SaveFS(fs, image); err != nil {
+		t.Fatal(err)
+	}
+	CloseFS(fs)
+	fs, err := OpenFS(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseFS(fs)
+	if len(fs.FNT) != 32 || len(fs.DABPT) != 48 {
+		t.Fatalf("reopened image has %d FNT and %d DABPT entries, want 32 and 48", len(fs.FNT), len(fs.DABPT))
+	}
+	checkMetaArea(t, fs)
+	checkFiles(t, fs, files)
+}
+
+// TestOpenMovesBlocksOutOfTables opens an image laid out with the smaller
+// reservation made before DABPT entries grew, with file data right after it
+func TestOpenMovesBlocksOutOfTables(t *testing.T) {
+	fs := newTestImage(t, 64)
+	old := 16/4 + 16/4 // Four entries per block in both tables
+	for i := old; i < fs.metaBlocks(); i++ {
+		fs.FreeBlocks[i] = true
+	}
+	files := map[string][]byte{"large": bytes.Repeat([]byte("0123456789abcdef"), 100)}
+	if _, err := PutReaderFS(fs, bytes.NewReader(files["large"]), PutOptions{Name: "large"}); err != nil {
+		t.Fatal(err)
+	}
+	if fs.FreeBlocks[old] {
+		t.Fatal("the file did not take the blocks after the old reservation")
+	}
+
+	image := fs.DiskName
+	CloseFS(fs)
+	fs, err := OpenFS(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseFS(fs)
+	checkMetaArea(t, fs)
+	checkFiles(t, fs, files)
+}
+
+// TestTablesGrow stores more names than the formatted tables hold, growing
+// them into free blocks until the disk is full
+func TestTablesGrow(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		blocks  int
+		nameLen int // Bytes in each file name
+		count   int // Files to store
+		want    error
+	}{
+		{"short names", 256, 8, 40, nil},
+		{"long names", 256, 3*MaxFilename + 1, 20, nil},
+		{"until full", 24, 8, 1000, ErrNoInodes},
+		{"long names until full", 24, 3*MaxFilename + 1, 1000, ErrNoInodes},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fs := newTestImage(t, c.blocks)
+			files := make(map[string][]byte)
+			for i := 0; i < c.count; i++ {
+				name := fmt.Sprintf("%0*d", c.nameLen, i)
+				_, err := PutReaderFS(fs, bytes.NewReader([]byte(name[len(name)-8:])), PutOptions{Name: name})
+				if err != nil {
+					if c.want == nil || !errors.Is(err, c.want) {
+						t.Fatalf("storing file %d: %v", i, err)
+					}
+					break
+				}
+				files[name] = []byte(name[len(name)-8:])
+			}
+			if c.want != nil {
+				if len(files) == c.count {
+					t.Fatalf("stored all %d files, want %v", c.count, c.want)
+				}
+				if free := fs.getFreeBlockCount(); free != 0 {
+					t.Errorf("tables stopped growing with %d free blocks", free)
+				}
+			}
+
+			if len(fs.DABPT) < len(files) || len(fs.FNT) < len(files)*nameEntries(c.nameLen) {
+				t.Fatalf("%d files in %d FNT and %d DABPT entries", len(files), len(fs.FNT), len(fs.DABPT))
+			}
+			if len(fs.FNT)%fntEntriesPerBlock != 0 || len(fs.DABPT)%dabptEntriesPerBlock != 0 {
+				t.Errorf("tables of %d and %d entries do not fill whole blocks", len(fs.FNT), len(fs.DABPT))
+			}
+			checkMetaArea(t, fs)
+			checkFiles(t, fs, files)
+
+			image := fs.DiskName
+			CloseFS(fs)
+			fs, err := OpenFS(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer CloseFS(fs)
+			checkMetaArea(t, fs)
+			checkFiles(t, fs, files)
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package filesystem
+
+import (
+	"io"
+	"time"
+)
+
+// Tx groups several operations so that they take effect all together or not
+// at all. Operations run against a private copy of the file system taken by
+// Begin; nobody else sees them until Commit installs the copy and saves it.
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	fs         *FileSystem
+	staged     *FileSystem
+	generation uint64
+	done       bool
+}
+
+// Begin starts a transaction on the file system
+func (fs *FileSystem) Begin() (*Tx, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	return &Tx{fs: fs, staged: fs.clone(), generation: fs.generation}, nil
+}
+
+// clone returns a deep copy of the file system contents for staging changes.
+// The copy holds no image lock and is never saved on its own.
+func (fs *FileSystem) clone() *FileSystem {
+	c := &FileSystem{
+		FNT:         append([]FNTEntry{}, fs.FNT...),
+		DABPT:       append([]DABPTEntry{}, fs.DABPT...),
+		DataBlocks:  make([][]byte, len(fs.DataBlocks)),
+		TotalBlocks: fs.TotalBlocks,
+		FreeBlocks:  append([]bool{}, fs.FreeBlocks...),
+		CurrentUser: fs.CurrentUser,
+		DiskName:    fs.DiskName,
+
+		NameNormalizer: fs.NameNormalizer,
+		Clock:          fs.Clock,
+		staging:        true,
+	}
+	for i, block := range fs.DataBlocks {
+		c.DataBlocks[i] = append([]byte{}, block...)
+	}
+	return c
+}
+
+// Commit installs the changes made in the transaction and saves the file
+// system to its disk image, if it has one. If the save fails the changes are
+// not installed and the transaction is discarded, as with Rollback.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	fs := tx.fs
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.checkWritable(); err != nil {
+		return err
+	}
+	if fs.generation != tx.generation {
+		return ErrTxConflict
+	}
+
+	// Install the staged copy and save it, putting the old contents back if
+	// the save fails
+	fnt, dabpt, blocks, total, free := fs.FNT, fs.DABPT, fs.DataBlocks, fs.TotalBlocks, fs.FreeBlocks
+	fs.FNT = tx.staged.FNT
+	fs.DABPT = tx.staged.DABPT
+	fs.DataBlocks = tx.staged.DataBlocks
+	fs.TotalBlocks = tx.staged.TotalBlocks
+	fs.FreeBlocks = tx.staged.FreeBlocks
+	if fs.DiskName != "" {
+		if err := fs.save(fs.DiskName); err != nil {
+			fs.FNT, fs.DABPT, fs.DataBlocks, fs.TotalBlocks, fs.FreeBlocks = fnt, dabpt, blocks, total, free
+			return err
+		}
+	}
+	fs.changed()
+	tx.staged = nil
+	return nil
+}
+
+// Rollback discards every change made in the transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.staged = nil
+	return nil
+}
+
+// stage returns the staged file system, or ErrTxDone once the transaction ended
+func (tx *Tx) stage() (*FileSystem, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.staged, nil
+}
+
+// Put stores an external file, like PutFS
+func (tx *Tx) Put(externalFileName string) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return PutFS(fs, externalFileName)
+}
+
+// PutWithOptions stores an external file, like PutFSWithOptions
+func (tx *Tx) PutWithOptions(externalFileName string, opts PutOptions) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return PutFSWithOptions(fs, externalFileName, opts)
+}
+
+// PutReader stores data read from r, like PutReaderFS
+func (tx *Tx) PutReader(r io.Reader, opts PutOptions) (PutOutcome, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return 0, err
+	}
+	return PutReaderFS(fs, r, opts)
+}
+
+// PutTree stores a host directory tree, like PutTreeFS
+func (tx *Tx) PutTree(hostDir, dir string, opts TreeOptions) (*TreeSummary, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return nil, err
+	}
+	return PutTreeFS(fs, hostDir, dir, opts)
+}
+
+// Import stores every file in an archive, like ImportFS
+func (tx *Tx) Import(archive string, format ArchiveFormat, mode PutMode) (*TreeSummary, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return nil, err
+	}
+	return ImportFS(fs, archive, format, mode)
+}
+
+// Remove deletes a file, like RemoveFS
+func (tx *Tx) Remove(internalFileName string) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return RemoveFS(fs, internalFileName)
+}
+
+// Rename renames a file, like RenameFS
+func (tx *Tx) Rename(currentFileName, newFileName string) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return RenameFS(fs, currentFileName, newFileName)
+}
+
+// WriteAt writes into a file, like WriteAtFS
+func (tx *Tx) WriteAt(internalFileName string, data []byte, offset int64) (int, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return 0, err
+	}
+	return WriteAtFS(fs, internalFileName, data, offset)
+}
+
+// Truncate sets the size of a file, like TruncateFS
+func (tx *Tx) Truncate(internalFileName string, size int64) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return TruncateFS(fs, internalFileName, size)
+}
+
+// Chtimes sets the modification time of a file, like ChtimesFS
+func (tx *Tx) Chtimes(internalFileName string, modTime time.Time) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return ChtimesFS(fs, internalFileName, modTime)
+}
+
+// Get copies a file out to the host as seen by the transaction, like GetFS
+func (tx *Tx) Get(internalFileName, externalFileName string) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return GetFS(fs, internalFileName, externalFileName)
+}
+
+// GetWriter writes a file as seen by the transaction to w, like GetWriterFS
+func (tx *Tx) GetWriter(internalFileName string, w io.Writer) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return GetWriterFS(fs, internalFileName, w)
+}
+
+// ReadAt reads part of a file as seen by the transaction, like ReadAtFS
+func (tx *Tx) ReadAt(internalFileName string, p []byte, offset int64) (int, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return 0, err
+	}
+	return ReadAtFS(fs, internalFileName, p, offset)
+}
+
+// GetTree copies a directory tree as seen by the transaction out to the
+// host, like GetTreeFS
+func (tx *Tx) GetTree(dir, hostDir string, opts TreeOptions) (*TreeSummary, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return nil, err
+	}
+	return GetTreeFS(fs, dir, hostDir, opts)
+}
+
+// Export writes the files as seen by the transaction to an archive, like
+// ExportFS
+func (tx *Tx) Export(w io.Writer, format ArchiveFormat) error {
+	fs, err := tx.stage()
+	if err != nil {
+		return err
+	}
+	return ExportFS(fs, w, format)
+}
+
+// Stat describes a file as seen by the transaction, like StatFS
+func (tx *Tx) Stat(internalFileName string) (*FileStat, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return nil, err
+	}
+	return StatFS(fs, internalFileName)
+}
+
+// List lists the files as seen by the transaction, like ListFS
+func (tx *Tx) List() ([]string, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return nil, err
+	}
+	return ListFS(fs)
+}
+
+// Files describes every file as seen by the transaction, like FilesFS
+func (tx *Tx) Files() ([]FileStat, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return nil, err
+	}
+	return FilesFS(fs)
+}
+
+// ReadDir describes the entries of a directory as seen by the transaction,
+// like ReadDirFS
+func (tx *Tx) ReadDir(dir string) ([]FileStat, error) {
+	fs, err := tx.stage()
+	if err != nil {
+		return nil, err
+	}
+	return ReadDirFS(fs, dir)
+}
@@ -0,0 +1,123 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestTx(t *testing.T) {
+	before := map[string][]byte{
+		"keep": []byte("kept"),
+		"old":  bytes.Repeat([]byte("old"), 100),
+	}
+	staged := map[string][]byte{
+		"renamed": before["old"],
+		"new":     []byte("new"),
+	}
+
+	for _, c := range []struct {
+		name string
+		// interfere runs between staging the changes and committing them
+		interfere func(t *testing.T, fs *FileSystem)
+		want      error
+		after     map[string][]byte // Files once the commit succeeded or failed
+	}{
+		{"commit", func(*testing.T, *FileSystem) {}, nil, staged},
+		{"conflict", func(t *testing.T, fs *FileSystem) {
+			if _, err := PutReaderFS(fs, bytes.NewReader([]byte("outside")), PutOptions{Name: "outside"}); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrTxConflict, map[string][]byte{"keep": before["keep"], "old": before["old"], "outside": []byte("outside")}},
+		{"failed change outside", func(t *testing.T, fs *FileSystem) {
+			if err := RemoveFS(fs, "missing"); !errors.Is(err, ErrNotExist) {
+				t.Fatalf("RemoveFS of a missing file = %v", err)
+			}
+		}, nil, staged},
+		{"save fails", func(t *testing.T, fs *FileSystem) {
+			// Put a directory where the image goes, so that it cannot be written
+			if err := os.Remove(fs.DiskName); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(fs.DiskName, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, syscall.EISDIR, before},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fs := newTestImage(t, 256)
+			for name, data := range before {
+				if _, err := PutReaderFS(fs, bytes.NewReader(data), PutOptions{Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tx, err := fs.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.PutReader(bytes.NewReader(staged["new"]), PutOptions{Name: "new"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Remove("keep"); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Rename("old", "renamed"); err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, fs, before) // Nobody else sees staged changes
+
+			c.interfere(t, fs)
+			err = tx.Commit()
+			if !errors.Is(err, c.want) || (err == nil) != (c.want == nil) {
+				t.Fatalf("Commit = %v, want %v", err, c.want)
+			}
+			checkFiles(t, fs, c.after)
+			if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+				t.Errorf("second Commit = %v, want ErrTxDone", err)
+			}
+
+			// A failed save left the file system as it was, so it can still
+			// be saved and changed once the image can be written again
+			image := fs.DiskName
+			if c.want == syscall.EISDIR {
+				if err := os.Remove(image); err != nil {
+					t.Fatal(err)
+				}
+				if err := SaveFS(fs, image); err != nil {
+					t.Fatal(err)
+				}
+			}
+			CloseFS(fs)
+			fs, err = OpenFS(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer CloseFS(fs)
+			checkFiles(t, fs, c.after)
+		})
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	fs := newTestImage(t, 256)
+	tx, err := fs.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.PutReader(bytes.NewReader([]byte("new")), PutOptions{Name: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, fs, map[string][]byte{})
+	if err := tx.Remove("new"); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Remove after Rollback = %v, want ErrTxDone", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Commit after Rollback = %v, want ErrTxDone", err)
+	}
+}
@@ -0,0 +1,584 @@
+// Package fuse mounts a vfs.FS as a directory tree using the kernel's FUSE
+// device, without any FUSE libraries. Server speaks the protocol over any
+// io.ReadWriter that delivers one request per Read and takes one reply per
+// Write, so it can be driven without a kernel; Mount, which only works on
+// Linux, provides the real /dev/fuse.
+//
+// Files report mode 0644 and directories 0755, both owned by the server's
+// own user. Changing them is accepted and ignored.
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/vfs"
+)
+
+// attrValid is how long the kernel may cache names and attributes. Only
+// the server changes the image, so a second keeps repeated stats cheap
+// without going stale for long.
+const attrValid = time.Second
+
+var (
+	errNoReply = errors.New("no reply")
+	errNoSys   = errors.New("not implemented")
+)
+
+// Server answers FUSE requests for a vfs.FS
+type Server struct {
+	fs       vfs.FS
+	uid, gid uint32
+
+	nodes  map[uint64]*node  // Nodes the kernel knows, by node ID
+	ids    map[string]uint64 // Node IDs by name
+	nextID uint64
+
+	listings map[uint64][]dirent // Listings of open directories, by handle
+	nextFh   uint64
+}
+
+// node is a file or directory the kernel has looked up
+type node struct {
+	name    string
+	lookups uint64 // Lookups not yet forgotten
+}
+
+// dirent is an entry of a directory listing
+type dirent struct {
+	name string
+	ino  uint64
+	dir  bool
+}
+
+// NewServer returns a Server for fsys
+func NewServer(fsys vfs.FS) *Server {
+	return &Server{
+		fs:       fsys,
+		uid:      uint32(os.Getuid()),
+		gid:      uint32(os.Getgid()),
+		nodes:    map[uint64]*node{rootID: {name: ""}},
+		ids:      map[string]uint64{"": rootID},
+		nextID:   rootID + 1,
+		listings: make(map[uint64][]dirent),
+		nextFh:   1,
+	}
+}
+
+// Serve answers requests read from dev, one at a time, until dev reports
+// io.EOF or the kernel sends DESTROY. It saves the changes made when it
+// returns.
+func (s *Server) Serve(dev io.ReadWriter) error {
+	err := s.serve(dev)
+	if syncErr := s.fs.Sync(); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+func (s *Server) serve(dev io.ReadWriter) error {
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := dev.Read(buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var h inHeader
+		hn, err := binary.Decode(buf[:n], binary.NativeEndian, &h)
+		if err != nil || int(h.Len) != n {
+			return errors.New("malformed FUSE request")
+		}
+		reply, err := s.handle(h, buf[hn:n])
+		if err == errNoReply {
+			continue
+		}
+
+		out := outHeader{Unique: h.Unique}
+		if err == errNoSys {
+			out.Error = -enosys
+			reply = nil
+		} else if err != nil {
+			out.Error = -int32(vfs.Errno(err))
+			reply = nil
+		}
+		out.Len = uint32(binary.Size(out) + len(reply))
+		msg, _ := binary.Append(nil, binary.NativeEndian, out)
+		if _, err := dev.Write(append(msg, reply...)); err != nil {
+			return err
+		}
+		if h.Opcode == opDestroy {
+			return nil
+		}
+	}
+}
+
+// encode lays out the fields of a reply
+func encode(fields ...any) []byte {
+	var b []byte
+	for _, field := range fields {
+		b, _ = binary.Append(b, binary.NativeEndian, field)
+	}
+	return b
+}
+
+// decode reads the fixed part of a request into in and returns what
+// follows it
+func decode(body []byte, in any) ([]byte, error) {
+	n, err := binary.Decode(body, binary.NativeEndian, in)
+	if err != nil {
+		return nil, filesystem.ErrInvalid
+	}
+	return body[n:], nil
+}
+
+// names splits the NUL-terminated names at the end of a request
+func names(body []byte, count int) ([]string, error) {
+	var out []string
+	for range count {
+		i := bytes.IndexByte(body, 0)
+		if i < 0 {
+			return nil, filesystem.ErrInvalid
+		}
+		out = append(out, string(body[:i]))
+		body = body[i+1:]
+	}
+	return out, nil
+}
+
+// handle answers a request and returns the body of the reply
+func (s *Server) handle(h inHeader, body []byte) ([]byte, error) {
+	switch h.Opcode {
+	case opInit:
+		return s.init(body)
+	case opDestroy, opRelease, opAccess:
+		return nil, nil
+	case opForget:
+		var in forgetIn
+		if _, err := decode(body, &in); err == nil {
+			s.forget(h.Nodeid, in.Nlookup)
+		}
+		return nil, errNoReply
+	case opBatchForget:
+		var in batchForgetIn
+		rest, err := decode(body, &in)
+		for i := uint32(0); err == nil && i < in.Count; i++ {
+			var one forgetOne
+			if rest, err = decode(rest, &one); err == nil {
+				s.forget(one.Nodeid, one.Nlookup)
+			}
+		}
+		return nil, errNoReply
+	case opInterrupt:
+		// Requests are answered in order, so the one to interrupt is done
+		return nil, errNoReply
+	}
+
+	// Every other request is about a node
+	n := s.nodes[h.Nodeid]
+	if n == nil {
+		return nil, filesystem.ErrNotExist
+	}
+	switch h.Opcode {
+	case opLookup:
+		return s.lookup(n, body)
+	case opGetattr:
+		return s.getattr(n)
+	case opSetattr:
+		return s.setattr(n, body)
+	case opOpen:
+		return s.open(n, body)
+	case opRead:
+		return s.read(n, body)
+	case opWrite:
+		return s.write(n, body)
+	case opFlush, opFsync, opFsyncdir:
+		return nil, s.fs.Sync()
+	case opStatfs:
+		return s.statfs()
+	case opOpendir:
+		return s.opendir(n)
+	case opReaddir:
+		return s.readdir(body)
+	case opReleasedir:
+		var in readIn
+		if _, err := decode(body, &in); err == nil {
+			delete(s.listings, in.Fh)
+		}
+		return nil, nil
+	case opCreate:
+		return s.create(n, body)
+	case opMkdir:
+		return s.mkdir(n, body)
+	case opUnlink, opRmdir:
+		return s.remove(n, body, h.Opcode == opRmdir)
+	case opRename, opRename2:
+		return s.rename(n, body, h.Opcode == opRename2)
+	}
+	// Links, locks, extended attributes and the rest
+	return nil, errNoSys
+}
+
+func (s *Server) init(body []byte) ([]byte, error) {
+	var in initIn
+	if _, err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	out := initOut{
+		Major:               protoMajor,
+		Minor:               min(in.Minor, protoMinor),
+		MaxReadahead:        in.MaxReadahead,
+		Flags:               initBigWrites | initMaxPages,
+		MaxBackground:       16,
+		CongestionThreshold: 12,
+		MaxWrite:            maxWrite,
+		TimeGran:            uint32(time.Second), // Time stamps are whole seconds
+		MaxPages:            maxWrite / 4096,
+	}
+	if in.Major > protoMajor {
+		// The kernel will ask again with our major version
+		return encode(initOut{Major: protoMajor}), nil
+	}
+	return encode(out), nil
+}
+
+// forget drops lookups of a node the kernel no longer needs
+func (s *Server) forget(id, lookups uint64) {
+	n := s.nodes[id]
+	if n == nil || id == rootID {
+		return
+	}
+	n.lookups -= min(lookups, n.lookups)
+	if n.lookups == 0 {
+		delete(s.nodes, id)
+		if s.ids[n.name] == id {
+			delete(s.ids, n.name)
+		}
+	}
+}
+
+// attr fills in the attributes the kernel caches for a node
+func (s *Server) attr(a vfs.Attr) attr {
+	out := attr{
+		Ino:     a.Ino,
+		Size:    uint64(a.Size),
+		Blocks:  uint64(a.Blocks),
+		Atime:   uint64(a.ModTime.Unix()),
+		Mtime:   uint64(a.ModTime.Unix()),
+		Ctime:   uint64(a.ModTime.Unix()),
+		Mode:    modeReg | 0o644,
+		Nlink:   1,
+		UID:     s.uid,
+		GID:     s.gid,
+		Blksize: filesystem.BlockSize,
+	}
+	if a.Dir {
+		out.Mode, out.Nlink = modeDir|0o755, 2
+	}
+	return out
+}
+
+// entry gives the kernel a node ID for a, counting one more lookup of it
+func (s *Server) entry(a vfs.Attr) []byte {
+	id, ok := s.ids[a.Name]
+	if !ok {
+		id = s.nextID
+		s.nextID++
+		s.ids[a.Name] = id
+		s.nodes[id] = &node{name: a.Name}
+	}
+	s.nodes[id].lookups++
+	return encode(entryOut{
+		Nodeid:     id,
+		EntryValid: uint64(attrValid / time.Second),
+		AttrValid:  uint64(attrValid / time.Second),
+		Attr:       s.attr(a),
+	})
+}
+
+// child returns the name of the entry named at the start of body inside n
+func child(n *node, body []byte) (string, error) {
+	elems, err := names(body, 1)
+	if err != nil {
+		return "", err
+	}
+	return vfs.Join(n.name, elems[0])
+}
+
+func (s *Server) lookup(n *node, body []byte) ([]byte, error) {
+	name, err := child(n, body)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.entry(a), nil
+}
+
+func (s *Server) getattr(n *node) ([]byte, error) {
+	a, err := s.fs.Stat(n.name)
+	if err != nil {
+		return nil, err
+	}
+	return encode(attrOut{AttrValid: uint64(attrValid / time.Second), Attr: s.attr(a)}), nil
+}
+
+func (s *Server) setattr(n *node, body []byte) ([]byte, error) {
+	var in setattrIn
+	if _, err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	if in.Valid&fattrSize != 0 {
+		if err := s.fs.Truncate(n.name, int64(in.Size)); err != nil {
+			return nil, err
+		}
+	}
+	if in.Valid&(fattrMtime|fattrMtimeNow) != 0 {
+		mtime := time.Now()
+		if in.Valid&fattrMtimeNow == 0 {
+			mtime = time.Unix(int64(in.Mtime), int64(in.MtimeNsec))
+		}
+		if err := s.fs.Chtimes(n.name, mtime); err != nil {
+			return nil, err
+		}
+	}
+	return s.getattr(n)
+}
+
+func (s *Server) open(n *node, body []byte) ([]byte, error) {
+	var in openIn
+	if _, err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	a, err := s.fs.Stat(n.name)
+	if err != nil {
+		return nil, err
+	}
+	if a.Dir {
+		return nil, vfs.ErrIsDir
+	}
+	if in.Flags&oAccMode != oRdonly && s.fs.ReadOnly() {
+		return nil, filesystem.ErrReadOnly
+	}
+	// Files are read and written by name, so there is no handle to keep
+	return encode(openOut{}), nil
+}
+
+func (s *Server) read(n *node, body []byte) ([]byte, error) {
+	var in readIn
+	if _, err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, min(in.Size, maxWrite))
+	count, err := s.fs.ReadAt(n.name, buf, int64(in.Offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:count], nil
+}
+
+func (s *Server) write(n *node, body []byte) ([]byte, error) {
+	var in writeIn
+	data, err := decode(body, &in)
+	if err != nil || len(data) < int(in.Size) {
+		return nil, filesystem.ErrInvalid
+	}
+	count, err := s.fs.WriteAt(n.name, data[:in.Size], int64(in.Offset))
+	if err != nil {
+		return nil, err
+	}
+	return encode(writeOut{Size: uint32(count)}), nil
+}
+
+func (s *Server) statfs() ([]byte, error) {
+	usage := s.fs.Usage()
+	return encode(statfsOut{
+		Blocks:  uint64(usage.TotalBlocks),
+		Bfree:   uint64(usage.FreeBlocks),
+		Bavail:  uint64(usage.FreeBlocks),
+		Files:   uint64(usage.Names),
+		Ffree:   uint64(usage.FreeNames),
+		Bsize:   filesystem.BlockSize,
+		Namelen: filesystem.MaxNameLength,
+		Frsize:  filesystem.BlockSize,
+	}), nil
+}
+
+// opendir takes a listing of the directory for READDIR to page through, so
+// that changes part way do not shift the offsets
+func (s *Server) opendir(n *node) ([]byte, error) {
+	self, err := s.fs.Stat(n.name)
+	if err != nil {
+		return nil, err
+	}
+	up, err := s.fs.Stat(vfs.Parent(n.name))
+	if err != nil {
+		return nil, err
+	}
+	children, err := s.fs.ReadDir(n.name)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := []dirent{{".", self.Ino, true}, {"..", up.Ino, true}}
+	for _, a := range children {
+		listing = append(listing, dirent{path.Base(a.Name), a.Ino, a.Dir})
+	}
+	fh := s.nextFh
+	s.nextFh++
+	s.listings[fh] = listing
+	return encode(openOut{Fh: fh}), nil
+}
+
+func (s *Server) readdir(body []byte) ([]byte, error) {
+	var in readIn
+	if _, err := decode(body, &in); err != nil {
+		return nil, err
+	}
+	listing, ok := s.listings[in.Fh]
+	if !ok {
+		return nil, filesystem.ErrInvalid
+	}
+
+	var out []byte
+	for i := in.Offset; i < uint64(len(listing)); i++ {
+		entry := listing[i]
+		typ := uint32(dtReg)
+		if entry.dir {
+			typ = dtDir
+		}
+		record := encode(direntHeader{Ino: entry.ino, Off: i + 1, Namelen: uint32(len(entry.name)), Type: typ})
+		record = append(record, entry.name...)
+		record = append(record, make([]byte, (8-len(record)%8)%8)...)
+		if len(out)+len(record) > int(in.Size) {
+			break
+		}
+		out = append(out, record...)
+	}
+	return out, nil
+}
+
+func (s *Server) create(n *node, body []byte) ([]byte, error) {
+	var in createIn
+	rest, err := decode(body, &in)
+	if err != nil {
+		return nil, err
+	}
+	name, err := child(n, rest)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return append(s.entry(a), encode(openOut{})...), nil
+}
+
+func (s *Server) mkdir(n *node, body []byte) ([]byte, error) {
+	var in mkdirIn
+	rest, err := decode(body, &in)
+	if err != nil {
+		return nil, err
+	}
+	name, err := child(n, rest)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.fs.Mkdir(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.entry(a), nil
+}
+
+func (s *Server) remove(n *node, body []byte, dir bool) ([]byte, error) {
+	name, err := child(n, body)
+	if err != nil {
+		return nil, err
+	}
+	if dir {
+		err = s.fs.Rmdir(name)
+	} else {
+		err = s.fs.Remove(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The kernel may still hold the node, but the name is free for a new one
+	delete(s.ids, name)
+	return nil, nil
+}
+
+func (s *Server) rename(n *node, body []byte, withFlags bool) ([]byte, error) {
+	var newDir uint64
+	var flags uint32
+	var rest []byte
+	var err error
+	if withFlags {
+		var in rename2In
+		rest, err = decode(body, &in)
+		newDir, flags = in.Newdir, in.Flags
+	} else {
+		var in renameIn
+		rest, err = decode(body, &in)
+		newDir = in.Newdir
+	}
+	if err != nil {
+		return nil, err
+	}
+	elems, err := names(rest, 2)
+	if err != nil {
+		return nil, err
+	}
+	target := s.nodes[newDir]
+	if target == nil {
+		return nil, filesystem.ErrNotExist
+	}
+	oldName, err := vfs.Join(n.name, elems[0])
+	if err != nil {
+		return nil, err
+	}
+	newName, err := vfs.Join(target.name, elems[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&renameExchange != 0 {
+		return nil, filesystem.ErrUnsupported
+	}
+	if flags&renameNoReplace != 0 {
+		if _, err := s.fs.Stat(newName); err == nil {
+			return nil, filesystem.ErrExist
+		}
+	}
+	if err := s.fs.Rename(oldName, newName); err != nil {
+		return nil, err
+	}
+
+	// Nodes keep their IDs under their new names
+	delete(s.ids, newName)
+	for id, n := range s.nodes {
+		if n.name == oldName || strings.HasPrefix(n.name, oldName+"/") {
+			if s.ids[n.name] == id {
+				delete(s.ids, n.name)
+			}
+			n.name = newName + strings.TrimPrefix(n.name, oldName)
+			s.ids[n.name] = id
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,203 @@
+package fuse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/vfs"
+)
+
+// kernel plays the kernel's side of the FUSE device over a pipe
+type kernel struct {
+	t      *testing.T
+	conn   net.Conn
+	unique uint64
+}
+
+// newKernel serves an image holding docs/readme.txt and connects to it
+func newKernel(t *testing.T) (*kernel, *filesystem.FileSystem, chan error) {
+	t.Helper()
+	fs := filesystem.CreateFS(256, "tester")
+	if err := filesystem.FormatFS(fs, 16, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := filesystem.SaveFS(fs, filepath.Join(t.TempDir(), "disk")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filesystem.CloseFS(fs) })
+	_, err := filesystem.PutReaderFS(fs, bytes.NewReader([]byte("hello, world")), filesystem.PutOptions{Name: "docs/readme.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- NewServer(vfs.New(fs)).Serve(dev) }()
+	t.Cleanup(func() { conn.Close() })
+	return &kernel{t: t, conn: conn}, fs, done
+}
+
+// request sends a request made of the given fields and returns the error
+// number and body of the reply
+func (k *kernel) request(op uint32, nodeid uint64, fields ...any) (int32, []byte) {
+	k.t.Helper()
+	k.unique++
+	body := encode(fields...)
+	h := inHeader{Opcode: op, Unique: k.unique, Nodeid: nodeid}
+	h.Len = uint32(binary.Size(h) + len(body))
+	if _, err := k.conn.Write(append(encode(h), body...)); err != nil {
+		k.t.Fatal(err)
+	}
+
+	buf := make([]byte, bufferSize)
+	n, err := k.conn.Read(buf)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	var out outHeader
+	hn, err := binary.Decode(buf[:n], binary.NativeEndian, &out)
+	if err != nil || int(out.Len) != n || out.Unique != k.unique {
+		k.t.Fatalf("malformed reply %+v to request %d", out, k.unique)
+	}
+	return out.Error, buf[hn:n]
+}
+
+// call sends a request that must succeed and decodes the fixed part of its
+// reply into out, if not nil, returning what follows
+func (k *kernel) call(out any, op uint32, nodeid uint64, fields ...any) []byte {
+	k.t.Helper()
+	errno, body := k.request(op, nodeid, fields...)
+	if errno != 0 {
+		k.t.Fatalf("opcode %d failed with errno %d", op, -errno)
+	}
+	if out == nil {
+		return body
+	}
+	rest, err := decode(body, out)
+	if err != nil {
+		k.t.Fatalf("opcode %d: reply too short", op)
+	}
+	return rest
+}
+
+// name is a NUL-terminated name as requests carry them
+func name(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func (k *kernel) lookup(parent uint64, elem string) entryOut {
+	k.t.Helper()
+	var out entryOut
+	k.call(&out, opLookup, parent, name(elem))
+	return out
+}
+
+func (k *kernel) read(nodeid, offset uint64, size uint32) string {
+	k.t.Helper()
+	return string(k.call(nil, opRead, nodeid, readIn{Offset: offset, Size: size}))
+}
+
+// readdir lists a directory with OPENDIR and READDIR
+func (k *kernel) readdir(nodeid uint64) []string {
+	k.t.Helper()
+	var open openOut
+	k.call(&open, opOpendir, nodeid)
+	defer k.call(nil, opReleasedir, nodeid, readIn{Fh: open.Fh})
+
+	var names []string
+	body := k.call(nil, opReaddir, nodeid, readIn{Fh: open.Fh, Size: 4096})
+	for len(body) > 0 {
+		var d direntHeader
+		rest, err := decode(body, &d)
+		if err != nil {
+			k.t.Fatal("short READDIR record")
+		}
+		names = append(names, string(rest[:d.Namelen]))
+		record := binary.Size(d) + int(d.Namelen)
+		body = body[record+(8-record%8)%8:]
+	}
+	return names
+}
+
+func TestServe(t *testing.T) {
+	k, fs, done := newKernel(t)
+
+	var init initOut
+	k.call(&init, opInit, 0, initIn{Major: protoMajor, Minor: protoMinor, MaxReadahead: 1 << 16})
+	if init.Major != protoMajor || init.MaxWrite != maxWrite {
+		t.Fatalf("INIT replied %+v", init)
+	}
+
+	// Look up the file and read it
+	docs := k.lookup(rootID, "docs")
+	if docs.Attr.Mode&modeDir == 0 {
+		t.Fatalf("docs has mode %#o, want a directory", docs.Attr.Mode)
+	}
+	readme := k.lookup(docs.Nodeid, "readme.txt")
+	if readme.Attr.Mode&modeReg == 0 || readme.Attr.Size != 12 {
+		t.Fatalf("readme.txt has mode %#o and size %d", readme.Attr.Mode, readme.Attr.Size)
+	}
+	if got := k.read(readme.Nodeid, 7, 100); got != "world" {
+		t.Fatalf("read %q, want %q", got, "world")
+	}
+	if errno, _ := k.request(opLookup, rootID, name("missing")); errno != -vfs.ENOENT {
+		t.Fatalf("LOOKUP of a missing name failed with %d, want -ENOENT", errno)
+	}
+	if got, want := k.readdir(docs.Nodeid), []string{".", "..", "readme.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("READDIR of docs = %v, want %v", got, want)
+	}
+
+	// Create a file, write to it and read it back
+	var created entryOut
+	k.call(&created, opCreate, docs.Nodeid, createIn{Flags: 2, Mode: modeReg | 0o644}, name("new.txt"))
+	var written writeOut
+	k.call(&written, opWrite, created.Nodeid, writeIn{Size: 5}, []byte("fresh"))
+	if written.Size != 5 {
+		t.Fatalf("wrote %d bytes, want 5", written.Size)
+	}
+	if got := k.read(created.Nodeid, 0, 100); got != "fresh" {
+		t.Fatalf("read %q back, want %q", got, "fresh")
+	}
+
+	// Move it to the root; the node keeps its ID under the new name
+	k.call(nil, opRename, docs.Nodeid, renameIn{Newdir: rootID}, name("new.txt"), name("moved.txt"))
+	if got := k.read(created.Nodeid, 0, 100); got != "fresh" {
+		t.Fatalf("read %q after the rename, want %q", got, "fresh")
+	}
+	if moved := k.lookup(rootID, "moved.txt"); moved.Nodeid != created.Nodeid {
+		t.Fatalf("moved.txt has node %d, want %d", moved.Nodeid, created.Nodeid)
+	}
+
+	// Remove the original
+	k.call(nil, opUnlink, docs.Nodeid, name("readme.txt"))
+	if errno, _ := k.request(opUnlink, docs.Nodeid, name("readme.txt")); errno != -vfs.ENOENT {
+		t.Fatalf("second UNLINK failed with %d, want -ENOENT", errno)
+	}
+	if got, want := k.readdir(rootID), []string{".", "..", "docs", "moved.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("READDIR of the root = %v, want %v", got, want)
+	}
+
+	// DESTROY ends Serve, which saves the image
+	k.call(nil, opDestroy, 0)
+	if err := <-done; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	filesystem.CloseFS(fs)
+	saved, err := filesystem.OpenFS(fs.DiskName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.CloseFS(saved)
+	data := make([]byte, 5)
+	if _, err := filesystem.ReadAtFS(saved, "moved.txt", data, 0); err != nil || string(data) != "fresh" {
+		t.Fatalf("saved moved.txt holds %q, %v", data, err)
+	}
+	if _, err := filesystem.StatFS(saved, "docs/readme.txt"); err == nil {
+		t.Fatal("saved image still holds docs/readme.txt")
+	}
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// MountOptions control how Mount attaches the file system
+type MountOptions struct {
+	FSName   string // Shown as the source of the mount, e.g. the image name
+	ReadOnly bool
+}
+
+// Device is the connection to the kernel for one mount. Each Read returns
+// one request and each Write sends one reply, as Server.Serve expects.
+type Device struct {
+	file   *os.File
+	dir    string
+	helper string // fusermount program that mounted dir, if not mounted directly
+}
+
+// Mount attaches a FUSE file system to dir and returns the device to serve
+// it on. The root user mounts it directly; other users need the fusermount3
+// or fusermount program that comes with FUSE.
+func Mount(dir string, opts MountOptions) (*Device, error) {
+	if opts.FSName == "" {
+		opts.FSName = "fs"
+	}
+	if os.Geteuid() == 0 {
+		return mountDirect(dir, opts)
+	}
+	return mountHelper(dir, opts)
+}
+
+func mountDirect(dir string, opts MountOptions) (*Device, error) {
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/fuse", Err: err}
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+	if opts.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d", fd, os.Getuid(), os.Getgid())
+	if err := syscall.Mount(opts.FSName, dir, "fuse.fs", flags, data); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "mount", Path: dir, Err: err}
+	}
+	return &Device{file: os.NewFile(uintptr(fd), "/dev/fuse"), dir: dir}, nil
+}
+
+// mountHelper has fusermount mount dir and pass back the open /dev/fuse
+// over a socket, the way libfuse does for users without privileges
+func mountHelper(dir string, opts MountOptions) (*Device, error) {
+	helper, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if helper, err = exec.LookPath("fusermount"); err != nil {
+			return nil, fmt.Errorf("mounting as a user other than root needs fusermount3 or fusermount: %w", err)
+		}
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+	defer remote.Close()
+
+	options := "fsname=" + opts.FSName + ",subtype=fs"
+	if opts.ReadOnly {
+		options += ",ro"
+	}
+	cmd := exec.Command(helper, "-o", options, "--", dir)
+	cmd.ExtraFiles = []*os.File{remote} // Descriptor 3 in the helper
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w", helper, err)
+	}
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.(*net.UnixConn).ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive /dev/fuse from %s: %w", helper, err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return nil, fmt.Errorf("%s did not pass back /dev/fuse", helper)
+	}
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) == 0 {
+		return nil, fmt.Errorf("%s did not pass back /dev/fuse", helper)
+	}
+	return &Device{file: os.NewFile(uintptr(rights[0]), "/dev/fuse"), dir: dir, helper: helper}, nil
+}
+
+// Read returns the next request, or io.EOF once the file system has been
+// unmounted
+func (d *Device) Read(p []byte) (int, error) {
+	for {
+		n, err := d.file.Read(p)
+		switch {
+		case errors.Is(err, syscall.ENODEV):
+			return 0, io.EOF
+		case errors.Is(err, syscall.EINTR), errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.ENOENT):
+			// ENOENT is a request interrupted before it was read
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write sends a reply. A reply to a request that was interrupted meanwhile
+// is dropped.
+func (d *Device) Write(p []byte) (int, error) {
+	n, err := d.file.Write(p)
+	if errors.Is(err, syscall.ENOENT) {
+		return len(p), nil
+	}
+	return n, err
+}
+
+// Unmount detaches the file system, which makes Serve return once it has
+// answered the requests in progress. It fails while files are still in use.
+func (d *Device) Unmount() error {
+	if d.helper != "" {
+		out, err := exec.Command(d.helper, "-u", d.dir).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s -u failed: %w: %s", d.helper, err, out)
+		}
+		return nil
+	}
+	if err := syscall.Unmount(d.dir, 0); err != nil {
+		return &os.PathError{Op: "unmount", Path: d.dir, Err: err}
+	}
+	return nil
+}
+
+// Close closes the device
+func (d *Device) Close() error {
+	return d.file.Close()
+}
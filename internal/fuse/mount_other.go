@@ -0,0 +1,41 @@
+//go:build !linux
+
+package fuse
+
+import (
+	"fmt"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// MountOptions control how Mount attaches the file system
+type MountOptions struct {
+	FSName   string // Shown as the source of the mount, e.g. the image name
+	ReadOnly bool
+}
+
+// Device is the connection to the kernel for one mount
+type Device struct{}
+
+// Mount is only supported on Linux
+func Mount(dir string, opts MountOptions) (*Device, error) {
+	return nil, fmt.Errorf("%w: mounting with FUSE needs Linux", filesystem.ErrUnsupported)
+}
+
+func (d *Device) Read(p []byte) (int, error) {
+	return 0, filesystem.ErrUnsupported
+}
+
+func (d *Device) Write(p []byte) (int, error) {
+	return 0, filesystem.ErrUnsupported
+}
+
+// Unmount detaches the file system
+func (d *Device) Unmount() error {
+	return filesystem.ErrUnsupported
+}
+
+// Close closes the device
+func (d *Device) Close() error {
+	return nil
+}
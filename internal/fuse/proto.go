@@ -0,0 +1,260 @@
+package fuse
+
+// The kernel's FUSE protocol, from <linux/fuse.h>. Messages are laid out in
+// the machine's own byte order.
+
+const (
+	protoMajor = 7
+	protoMinor = 31 // Highest minor version whose messages are understood
+
+	maxWrite   = 128 << 10
+	bufferSize = maxWrite + 4096 // Room for a write and its headers
+)
+
+// Opcodes
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opMkdir       = 9
+	opUnlink      = 10
+	opRmdir       = 11
+	opRename      = 12
+	opOpen        = 14
+	opRead        = 15
+	opWrite       = 16
+	opStatfs      = 17
+	opRelease     = 18
+	opFsync       = 20
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opFsyncdir    = 30
+	opAccess      = 34
+	opCreate      = 35
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+	opRename2     = 45
+)
+
+// Flags of fuse_init_out
+const (
+	initBigWrites = 1 << 5
+	initMaxPages  = 1 << 22
+)
+
+// Bits of fuse_setattr_in.Valid
+const (
+	fattrSize     = 1 << 3
+	fattrMtime    = 1 << 5
+	fattrMtimeNow = 1 << 8
+)
+
+// Flags of fuse_rename2_in
+const (
+	renameNoReplace = 1 << 0
+	renameExchange  = 1 << 1
+)
+
+const (
+	rootID   = 1 // Node ID of the mount's root
+	oAccMode = 0x3
+	oRdonly  = 0x0
+	dtDir    = 4
+	dtReg    = 8
+	modeDir  = 0o040000
+	modeReg  = 0o100000
+	enosys   = 38 // Tells the kernel not to send a request again
+)
+
+type inHeader struct {
+	Len    uint32
+	Opcode uint32
+	Unique uint64
+	Nodeid uint64
+	UID    uint32
+	GID    uint32
+	PID    uint32
+	_      uint32
+}
+
+type outHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type initIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+type initOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	TimeGran            uint32
+	MaxPages            uint16
+	_                   uint16
+	_                   [8]uint32
+}
+
+type attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	AtimeNsec uint32
+	MtimeNsec uint32
+	CtimeNsec uint32
+	Mode      uint32
+	Nlink     uint32
+	UID       uint32
+	GID       uint32
+	Rdev      uint32
+	Blksize   uint32
+	_         uint32
+}
+
+type entryOut struct {
+	Nodeid         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           attr
+}
+
+type attrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	_             uint32
+	Attr          attr
+}
+
+type setattrIn struct {
+	Valid     uint32
+	_         uint32
+	Fh        uint64
+	Size      uint64
+	LockOwner uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	AtimeNsec uint32
+	MtimeNsec uint32
+	CtimeNsec uint32
+	Mode      uint32
+	_         uint32
+	UID       uint32
+	GID       uint32
+	_         uint32
+}
+
+type openIn struct {
+	Flags     uint32
+	OpenFlags uint32
+}
+
+type openOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	_         uint32
+}
+
+type createIn struct {
+	Flags     uint32
+	Mode      uint32
+	Umask     uint32
+	OpenFlags uint32
+}
+
+type mkdirIn struct {
+	Mode  uint32
+	Umask uint32
+}
+
+type renameIn struct {
+	Newdir uint64
+}
+
+type rename2In struct {
+	Newdir uint64
+	Flags  uint32
+	_      uint32
+}
+
+// readIn is also the body of READDIR
+type readIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	_         uint32
+}
+
+type writeIn struct {
+	Fh         uint64
+	Offset     uint64
+	Size       uint32
+	WriteFlags uint32
+	LockOwner  uint64
+	Flags      uint32
+	_          uint32
+}
+
+type writeOut struct {
+	Size uint32
+	_    uint32
+}
+
+type statfsOut struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	_       uint32
+	_       [6]uint32
+}
+
+type forgetIn struct {
+	Nlookup uint64
+}
+
+type batchForgetIn struct {
+	Count uint32
+	_     uint32
+}
+
+type forgetOne struct {
+	Nodeid  uint64
+	Nlookup uint64
+}
+
+// direntHeader precedes the name of each entry in a READDIR reply, which is
+// padded to 8 bytes
+type direntHeader struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
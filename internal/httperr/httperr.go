@@ -0,0 +1,31 @@
+// Package httperr maps file system errors to HTTP status codes, for the
+// servers that share a disk image over HTTP
+package httperr
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// Status returns the HTTP status code that best describes err
+func Status(err error) int {
+	switch {
+	case errors.Is(err, filesystem.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, filesystem.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, filesystem.ErrExist), errors.Is(err, filesystem.ErrTxConflict):
+		return http.StatusConflict
+	case errors.Is(err, filesystem.ErrNoSpace), errors.Is(err, filesystem.ErrNoInodes):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, filesystem.ErrInvalid), errors.Is(err, filesystem.ErrNameTooLong):
+		return http.StatusBadRequest
+	case errors.Is(err, filesystem.ErrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, filesystem.ErrLocked):
+		return http.StatusLocked
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,168 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Client is a minimal NBD client, enough to check a server from Go without
+// the kernel driver. Requests are sent one at a time.
+type Client struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	size   int64
+	flags  uint16
+	handle uint64
+}
+
+// Dial connects to the server at addr on network ("tcp" or "unix") and
+// chooses the export called name, "" being the server's default
+func Dial(network, addr, name string) (*Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn}
+	if err := c.handshake(name); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake chooses the export with NBD_OPT_GO
+func (c *Client) handshake(name string) error {
+	var greeting [18]byte
+	if _, err := io.ReadFull(c.conn, greeting[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(greeting[:]) != nbdMagic || binary.BigEndian.Uint64(greeting[8:]) != optMagic {
+		return errors.New("nbd: server does not speak the newstyle handshake")
+	}
+	if binary.BigEndian.Uint16(greeting[16:])&flagFixedNewstyle == 0 {
+		return errors.New("nbd: server does not support the fixed newstyle handshake")
+	}
+
+	b := binary.BigEndian.AppendUint32(nil, flagFixedNewstyle|flagNoZeroes)
+	b = binary.BigEndian.AppendUint64(b, optMagic)
+	b = binary.BigEndian.AppendUint32(b, optGo)
+	b = binary.BigEndian.AppendUint32(b, uint32(4+len(name)+2))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(name)))
+	b = append(b, name...)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	if _, err := c.conn.Write(b); err != nil {
+		return err
+	}
+
+	for {
+		var header [20]byte
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint64(header[:]) != optReplyMag {
+			return errors.New("nbd: bad option reply magic")
+		}
+		typ := binary.BigEndian.Uint32(header[12:])
+		data := make([]byte, binary.BigEndian.Uint32(header[16:]))
+		if _, err := io.ReadFull(c.conn, data); err != nil {
+			return err
+		}
+
+		switch {
+		case typ == repAck:
+			if c.flags&flagHasFlags == 0 {
+				return errors.New("nbd: server did not describe the export")
+			}
+			return nil
+		case typ == repInfo && len(data) >= 12 && binary.BigEndian.Uint16(data) == infoExport:
+			c.size = int64(binary.BigEndian.Uint64(data[2:]))
+			c.flags = binary.BigEndian.Uint16(data[10:])
+		case typ&(1<<31) != 0:
+			return fmt.Errorf("nbd: server refused export %q: error %#x %s", name, typ, data)
+		}
+	}
+}
+
+// Size returns the size of the export in bytes
+func (c *Client) Size() int64 {
+	return c.size
+}
+
+// ReadOnly reports whether the server refuses writes
+func (c *Client) ReadOnly() bool {
+	return c.flags&flagReadOnly != 0
+}
+
+// ReadAt reads len(p) bytes from off
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	if err := c.do(request{typ: cmdRead, offset: uint64(off), length: uint32(len(p))}, nil, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteAt writes p at off
+func (c *Client) WriteAt(p []byte, off int64) (int, error) {
+	if err := c.do(request{typ: cmdWrite, offset: uint64(off), length: uint32(len(p))}, p, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush asks the server to save what has been written
+func (c *Client) Flush() error {
+	return c.do(request{typ: cmdFlush}, nil, nil)
+}
+
+// Close disconnects from the server
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := request{typ: cmdDisc}
+	_, err := c.conn.Write(req.encode())
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// do sends a request with its data and reads the reply into p
+func (c *Client) do(req request, data, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handle++
+	req.handle = c.handle
+	if _, err := c.conn.Write(append(req.encode(), data...)); err != nil {
+		return err
+	}
+
+	var reply [replySize]byte
+	if _, err := io.ReadFull(c.conn, reply[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(reply[:]) != replyMagic || binary.BigEndian.Uint64(reply[8:]) != req.handle {
+		return errors.New("nbd: reply does not match the request")
+	}
+	if errno := binary.BigEndian.Uint32(reply[4:]); errno != 0 {
+		return &Error{Errno: errno}
+	}
+	if p != nil {
+		if _, err := io.ReadFull(c.conn, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Error is an error the server replied with
+type Error struct {
+	Errno uint32 // Linux error number
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nbd: server replied with error %d", e.Errno)
+}
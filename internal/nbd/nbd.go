@@ -0,0 +1,338 @@
+// Package nbd exports the data blocks of a disk image as a block device over
+// the newstyle handshake of the Network Block Device protocol, so that the
+// Linux nbd driver or qemu can attach it:
+//
+//	nbd-client -N disk01 127.0.0.1 10809 /dev/nbd0
+//
+// Reads and writes go through filesystem.Disk, below the FNT and DABPT, so
+// the device is the image's blocks exactly as they are stored. Writes are
+// saved to the image when the client flushes, sends a write with FUA, or
+// disconnects.
+//
+// The protocol has no authentication, so only serve it on a loopback
+// address or a Unix socket.
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// Server exports one image
+type Server struct {
+	fs   *filesystem.FileSystem
+	disk *filesystem.Disk
+
+	mu    sync.Mutex
+	dirty bool // Written since the last save
+}
+
+// NewServer returns a Server exporting the data blocks of fs. The export is
+// named after the image, and clients may also ask for the default export "".
+func NewServer(fs *filesystem.FileSystem) *Server {
+	return &Server{fs: fs, disk: filesystem.DiskFS(fs)}
+}
+
+// Serve accepts connections on l and serves each one in its own goroutine.
+// It only returns when l fails, with net.ErrClosed once l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(rwc)
+	}
+}
+
+// ServeConn serves a single client until it disconnects, saves the changes
+// it made and closes rwc
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+	c := &conn{s: s, r: bufio.NewReader(rwc), w: rwc}
+	err := c.handshake()
+	if err == nil && c.transmit {
+		err = c.serve()
+	}
+	if syncErr := s.Sync(); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// Sync saves writes that are not in the image yet. Call it before exiting
+// while clients are still connected.
+func (s *Server) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := filesystem.SaveFS(s.fs, s.fs.DiskName); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// written notes a write to be saved by the next Sync
+func (s *Server) written() {
+	s.mu.Lock()
+	s.dirty = true
+	s.mu.Unlock()
+}
+
+// flags returns the transmission flags of the export
+func (s *Server) flags() uint16 {
+	flags := uint16(flagHasFlags | flagSendFlush | flagSendFUA | flagSendWriteZeroes)
+	if s.fs.ReadOnly() {
+		flags |= flagReadOnly
+	}
+	return flags
+}
+
+// conn is a client connection. Requests are answered one at a time, in the
+// order they arrive.
+type conn struct {
+	s        *Server
+	r        *bufio.Reader
+	w        io.Writer
+	noZeroes bool // Client asked to leave out the padding after NBD_OPT_EXPORT_NAME
+	transmit bool // Handshake chose the export
+}
+
+// handshake greets the client and answers its options until it picks the
+// export or gives up
+func (c *conn) handshake() error {
+	var b [18]byte
+	binary.BigEndian.PutUint64(b[0:], nbdMagic)
+	binary.BigEndian.PutUint64(b[8:], optMagic)
+	binary.BigEndian.PutUint16(b[16:], flagFixedNewstyle|flagNoZeroes)
+	if _, err := c.w.Write(b[:]); err != nil {
+		return err
+	}
+
+	var clientFlags [4]byte
+	if _, err := io.ReadFull(c.r, clientFlags[:]); err != nil {
+		return err
+	}
+	c.noZeroes = binary.BigEndian.Uint32(clientFlags[:])&flagNoZeroes != 0
+
+	for {
+		var header [16]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint64(header[:]) != optMagic {
+			return fmt.Errorf("nbd: bad option magic %#x", binary.BigEndian.Uint64(header[:]))
+		}
+		option := binary.BigEndian.Uint32(header[8:])
+		length := binary.BigEndian.Uint32(header[12:])
+		if length > 4096 {
+			return fmt.Errorf("nbd: option %d of %d bytes is too long", option, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return err
+		}
+
+		done, err := c.option(option, data)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// option answers one option and reports whether the handshake is over
+func (c *conn) option(option uint32, data []byte) (bool, error) {
+	switch option {
+	case optExportName:
+		if !c.known(string(data)) {
+			// There is no way to refuse an export name but hanging up
+			return true, fmt.Errorf("nbd: no export named %q", data)
+		}
+		b := make([]byte, 10, 10+124)
+		binary.BigEndian.PutUint64(b, uint64(c.s.disk.Size()))
+		binary.BigEndian.PutUint16(b[8:], c.s.flags())
+		if !c.noZeroes {
+			b = b[:10+124]
+		}
+		c.transmit = true
+		_, err := c.w.Write(b)
+		return true, err
+
+	case optAbort:
+		_, err := c.w.Write(optionReply(option, repAck, nil))
+		return true, err
+
+	case optList:
+		if len(data) != 0 {
+			return false, c.reply(option, repErrInvalid, nil)
+		}
+		name := []byte(c.s.fs.DiskName)
+		entry := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+		if err := c.reply(option, repServer, append(entry, name...)); err != nil {
+			return false, err
+		}
+		return false, c.reply(option, repAck, nil)
+
+	case optInfo, optGo:
+		if len(data) < 6 {
+			return false, c.reply(option, repErrInvalid, nil)
+		}
+		n := binary.BigEndian.Uint32(data)
+		if uint64(len(data)) < 6+uint64(n) || uint64(len(data)) != 6+uint64(n)+2*uint64(binary.BigEndian.Uint16(data[4+n:])) {
+			return false, c.reply(option, repErrInvalid, nil)
+		}
+		if !c.known(string(data[4 : 4+n])) {
+			return false, c.reply(option, repErrUnknown, []byte("no such export"))
+		}
+
+		// The export and block size are sent whether or not they were asked for
+		export := binary.BigEndian.AppendUint16(nil, infoExport)
+		export = binary.BigEndian.AppendUint64(export, uint64(c.s.disk.Size()))
+		export = binary.BigEndian.AppendUint16(export, c.s.flags())
+		if err := c.reply(option, repInfo, export); err != nil {
+			return false, err
+		}
+		size := binary.BigEndian.AppendUint16(nil, infoBlockSize)
+		size = binary.BigEndian.AppendUint32(size, 1)
+		size = binary.BigEndian.AppendUint32(size, filesystem.BlockSize)
+		size = binary.BigEndian.AppendUint32(size, maxLength)
+		if err := c.reply(option, repInfo, size); err != nil {
+			return false, err
+		}
+		if err := c.reply(option, repAck, nil); err != nil {
+			return false, err
+		}
+		c.transmit = option == optGo
+		return c.transmit, nil
+	}
+	// Structured replies, metadata contexts, TLS and the rest
+	return false, c.reply(option, repErrUnsup, nil)
+}
+
+func (c *conn) reply(option, typ uint32, data []byte) error {
+	_, err := c.w.Write(optionReply(option, typ, data))
+	return err
+}
+
+// known reports whether name is the export
+func (c *conn) known(name string) bool {
+	return name == "" || name == c.s.fs.DiskName
+}
+
+// serve answers commands until the client disconnects
+func (c *conn) serve() error {
+	var b [requestSize]byte
+	for {
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var req request
+		if magic := req.decode(b[:]); magic != requestMagic {
+			return fmt.Errorf("nbd: bad request magic %#x", magic)
+		}
+
+		var data []byte
+		if req.typ == cmdWrite {
+			if req.length > maxLength {
+				// The data cannot be skipped safely, so give up on the client
+				return fmt.Errorf("nbd: write of %d bytes is too long", req.length)
+			}
+			data = make([]byte, req.length)
+			if _, err := io.ReadFull(c.r, data); err != nil {
+				return err
+			}
+		}
+		if req.typ == cmdDisc {
+			return nil
+		}
+
+		errno, payload := c.command(&req, data)
+		reply := make([]byte, replySize, replySize+len(payload))
+		binary.BigEndian.PutUint32(reply, replyMagic)
+		binary.BigEndian.PutUint32(reply[4:], errno)
+		binary.BigEndian.PutUint64(reply[8:], req.handle)
+		if errno == 0 {
+			reply = append(reply, payload...)
+		}
+		if _, err := c.w.Write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// command carries out a request and returns the error to reply with and,
+// for reads, the data
+func (c *conn) command(req *request, data []byte) (uint32, []byte) {
+	size := uint64(c.s.disk.Size())
+	inside := req.offset <= size && uint64(req.length) <= size-req.offset
+
+	switch req.typ {
+	case cmdRead:
+		if req.length > maxLength || !inside {
+			return errInval, nil
+		}
+		p := make([]byte, req.length)
+		if _, err := c.s.disk.ReadAt(p, int64(req.offset)); err != nil {
+			return errIO, nil
+		}
+		return 0, p
+
+	case cmdWrite, cmdWriteZeroes:
+		if c.s.fs.ReadOnly() {
+			return errPerm, nil
+		}
+		if req.typ == cmdWriteZeroes {
+			if req.length > maxLength {
+				return errInval, nil
+			}
+			data = make([]byte, req.length)
+		}
+		if !inside {
+			return errNoSpc, nil
+		}
+		if _, err := c.s.disk.WriteAt(data, int64(req.offset)); err != nil {
+			return errnoFor(err), nil
+		}
+		c.s.written()
+		if req.flags&cmdFlagFUA != 0 {
+			if err := c.s.Sync(); err != nil {
+				return errnoFor(err), nil
+			}
+		}
+		return 0, nil
+
+	case cmdFlush:
+		if err := c.s.Sync(); err != nil {
+			return errnoFor(err), nil
+		}
+		return 0, nil
+	}
+	// Trim, cache, block status and the rest
+	return errNotSup, nil
+}
+
+// errnoFor maps a file system error to the error sent to the client
+func errnoFor(err error) uint32 {
+	switch {
+	case errors.Is(err, filesystem.ErrReadOnly):
+		return errPerm
+	case errors.Is(err, filesystem.ErrNoSpace):
+		return errNoSpc
+	case errors.Is(err, filesystem.ErrInvalid):
+		return errInval
+	}
+	return errIO
+}
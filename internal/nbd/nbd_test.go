@@ -0,0 +1,124 @@
+package nbd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// serve exports fs on a loopback address and connects a Client to it
+func serve(t *testing.T, fs *filesystem.FileSystem) *Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go NewServer(fs).Serve(l)
+
+	c, err := Dial("tcp", l.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newImage saves a formatted image of numBlocks blocks and returns its path
+func newImage(t *testing.T, numBlocks int) string {
+	t.Helper()
+	fs := filesystem.CreateFS(numBlocks, "tester")
+	if err := filesystem.FormatFS(fs, 16, 16); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "disk")
+	if err := filesystem.SaveFS(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	filesystem.CloseFS(fs)
+	return path
+}
+
+func TestReadWrite(t *testing.T) {
+	const numBlocks = 64
+	path := newImage(t, numBlocks)
+	fs, err := filesystem.OpenFS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.CloseFS(fs)
+
+	c := serve(t, fs)
+	if c.Size() != numBlocks*filesystem.BlockSize {
+		t.Fatalf("export is %d bytes, want %d", c.Size(), numBlocks*filesystem.BlockSize)
+	}
+	if c.ReadOnly() {
+		t.Fatal("export of a writable image is read-only")
+	}
+
+	// Write across the boundary of two blocks and read it back
+	data := bytes.Repeat([]byte("nbd!"), filesystem.BlockSize/4)
+	off := int64(40*filesystem.BlockSize + filesystem.BlockSize/2)
+	if _, err := c.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := c.ReadAt(got, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read back %q", got)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Past the end of the device
+	var nbdErr *Error
+	if _, err := c.ReadAt(got, c.Size()); !errors.As(err, &nbdErr) || nbdErr.Errno != errInval {
+		t.Fatalf("read past the end = %v, want EINVAL", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flushed write is in the image
+	filesystem.CloseFS(fs)
+	saved, err := filesystem.OpenFS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.CloseFS(saved)
+	got = make([]byte, len(data))
+	if _, err := filesystem.DiskFS(saved).ReadAt(got, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("saved image holds %q", got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := newImage(t, 64)
+	fs, err := filesystem.OpenFSWithOptions(path, filesystem.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.CloseFS(fs)
+
+	c := serve(t, fs)
+	defer c.Close()
+	if !c.ReadOnly() {
+		t.Fatal("export of a read-only image is writable")
+	}
+	if _, err := c.ReadAt(make([]byte, filesystem.BlockSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	var nbdErr *Error
+	if _, err := c.WriteAt([]byte("no"), 0); !errors.As(err, &nbdErr) || nbdErr.Errno != errPerm {
+		t.Fatalf("write to a read-only export = %v, want EPERM", err)
+	}
+}
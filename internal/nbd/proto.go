@@ -0,0 +1,120 @@
+package nbd
+
+import "encoding/binary"
+
+// Handshake
+const (
+	nbdMagic    = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic    = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMag = 0x3e889045565a9
+
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+)
+
+// Options sent by the client during the handshake
+const (
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optInfo       = 6
+	optGo         = 7
+)
+
+// Option replies
+const (
+	repAck    = 1
+	repServer = 2
+	repInfo   = 3
+
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+)
+
+// Information sent with repInfo
+const (
+	infoExport    = 0
+	infoBlockSize = 3
+)
+
+// Transmission flags
+const (
+	flagHasFlags        = 1 << 0
+	flagReadOnly        = 1 << 1
+	flagSendFlush       = 1 << 2
+	flagSendFUA         = 1 << 3
+	flagSendWriteZeroes = 1 << 6
+)
+
+// Requests and replies during transmission
+const (
+	requestMagic = 0x25609513
+	replyMagic   = 0x67446698
+
+	requestSize = 28
+	replySize   = 16
+)
+
+// Commands
+const (
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdWriteZeroes = 6
+
+	cmdFlagFUA = 1 << 0
+)
+
+// Errors returned in replies, with their Linux values
+const (
+	errPerm   = 1
+	errIO     = 5
+	errInval  = 22
+	errNoSpc  = 28
+	errNotSup = 95
+)
+
+// maxLength is the most a single read or write may transfer
+const maxLength = 32 << 20
+
+// request is a command sent by the client during transmission
+type request struct {
+	flags  uint16
+	typ    uint16
+	handle uint64
+	offset uint64
+	length uint32
+}
+
+func (r *request) decode(b []byte) (magic uint32) {
+	magic = binary.BigEndian.Uint32(b)
+	r.flags = binary.BigEndian.Uint16(b[4:])
+	r.typ = binary.BigEndian.Uint16(b[6:])
+	r.handle = binary.BigEndian.Uint64(b[8:])
+	r.offset = binary.BigEndian.Uint64(b[16:])
+	r.length = binary.BigEndian.Uint32(b[24:])
+	return magic
+}
+
+func (r *request) encode() []byte {
+	b := make([]byte, requestSize)
+	binary.BigEndian.PutUint32(b, requestMagic)
+	binary.BigEndian.PutUint16(b[4:], r.flags)
+	binary.BigEndian.PutUint16(b[6:], r.typ)
+	binary.BigEndian.PutUint64(b[8:], r.handle)
+	binary.BigEndian.PutUint64(b[16:], r.offset)
+	binary.BigEndian.PutUint32(b[24:], r.length)
+	return b
+}
+
+// optionReply frames the reply to an option
+func optionReply(option, typ uint32, data []byte) []byte {
+	b := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint64(b, optReplyMag)
+	binary.BigEndian.PutUint32(b[8:], option)
+	binary.BigEndian.PutUint32(b[12:], typ)
+	binary.BigEndian.PutUint32(b[16:], uint32(len(data)))
+	return append(b, data...)
+}
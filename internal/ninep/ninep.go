@@ -0,0 +1,738 @@
+// Package ninep serves the files of a disk image over 9P2000.L, the dialect
+// of the Plan 9 file protocol spoken by the Linux v9fs client, so that an
+// image can be mounted without any FUSE libraries:
+//
+//	mount -t 9p -o trans=tcp,port=5640,version=9p2000.L 127.0.0.1 /mnt
+//
+// Directories are those of a vfs.FS. There are no permissions or owners:
+// files report mode 0644 and the server's own user, and changing them is
+// accepted and ignored.
+//
+// The protocol has no authentication, so only serve it on a loopback
+// address or a Unix socket.
+package ninep
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/vfs"
+)
+
+// Server serves a file system over 9P2000.L
+type Server struct {
+	fs       vfs.FS
+	uid, gid uint32 // Reported as the owner of every file
+}
+
+// NewServer returns a Server for fsys
+func NewServer(fsys vfs.FS) *Server {
+	return &Server{fs: fsys, uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+}
+
+// Serve accepts connections on l and serves each one in its own goroutine.
+// It only returns when l fails, with net.ErrClosed once l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(rwc)
+	}
+}
+
+// ServeConn serves a single client until it hangs up, saves the changes it
+// made and closes rwc
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) error {
+	defer rwc.Close()
+	c := &conn{s: s, rwc: rwc, msize: maxMsize, fids: make(map[uint32]*fid)}
+	err := c.serve()
+	if syncErr := s.Sync(); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// Sync saves changes that are not in the image yet. Writes are saved when the
+// client closes or syncs the file they went to, so call Sync before exiting
+// while clients are still connected.
+func (s *Server) Sync() error {
+	return s.fs.Sync()
+}
+
+// qidFor identifies a file or directory
+func qidFor(a vfs.Attr) qid {
+	if a.Dir {
+		return qid{typ: qtDir, path: a.Ino}
+	}
+	return qid{typ: qtFile, version: uint32(a.ModTime.Unix()), path: a.Ino}
+}
+
+// conn is a client connection. Requests are answered one at a time, in the
+// order they arrive.
+type conn struct {
+	s     *Server
+	rwc   io.ReadWriteCloser
+	msize uint32
+	fids  map[uint32]*fid
+}
+
+// fid is a file or directory the client holds a handle to
+type fid struct {
+	name    string
+	open    bool
+	dir     bool     // Set by Tlopen
+	flags   uint32   // Open flags
+	entries []dirent // Directory listing taken by Treaddir at offset 0
+}
+
+// dirent is an entry of a directory listing
+type dirent struct {
+	name string
+	qid  qid
+}
+
+func (c *conn) serve() error {
+	r := bufio.NewReader(c.rwc)
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < headerSize || n > c.msize {
+			return fmt.Errorf("9P message of %d bytes does not fit the message size of %d", n, c.msize)
+		}
+		msg := make([]byte, n-4)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return err
+		}
+
+		typ, tag := msg[0], binary.LittleEndian.Uint16(msg[1:3])
+		d := &decoder{b: msg[3:]}
+		e := &encoder{b: make([]byte, headerSize, 64)}
+		reply := typ + 1
+		if err := c.handle(typ, d, e); err != nil {
+			e.b = e.b[:headerSize]
+			e.u32(uint32(errnoFor(err)))
+			reply = msgRlerror
+		}
+		binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)))
+		e.b[4] = reply
+		binary.LittleEndian.PutUint16(e.b[5:], tag)
+		if _, err := c.rwc.Write(e.b); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers a request, writing the reply's fields to e
+func (c *conn) handle(typ uint8, d *decoder, e *encoder) error {
+	switch typ {
+	case msgTversion:
+		return c.version(d, e)
+	case msgTattach:
+		return c.attach(d, e)
+	case msgTwalk:
+		return c.walk(d, e)
+	case msgTlopen:
+		return c.lopen(d, e)
+	case msgTlcreate:
+		return c.lcreate(d, e)
+	case msgTread:
+		return c.read(d, e)
+	case msgTwrite:
+		return c.write(d, e)
+	case msgTclunk:
+		return c.clunk(d)
+	case msgTremove:
+		return c.remove(d)
+	case msgTgetattr:
+		return c.getattr(d, e)
+	case msgTsetattr:
+		return c.setattr(d)
+	case msgTreaddir:
+		return c.readdir(d, e)
+	case msgTstatfs:
+		return c.statfs(d, e)
+	case msgTfsync:
+		return c.fsync(d)
+	case msgTmkdir:
+		return c.mkdir(d, e)
+	case msgTrename:
+		return c.rename(d)
+	case msgTrenameat:
+		return c.renameat(d)
+	case msgTunlinkat:
+		return c.unlinkat(d)
+	case msgTflush:
+		// Requests are answered in order, so the one to flush is done
+		d.u16()
+		return d.err()
+	}
+	// Authentication, links, locks, extended attributes and the rest
+	return eOpNotSupp
+}
+
+// fid returns the fid the client numbered num
+func (c *conn) fid(num uint32) (*fid, error) {
+	f := c.fids[num]
+	if f == nil {
+		return nil, eBadF
+	}
+	return f, nil
+}
+
+// renameFids points the fids below oldName at newName
+func (c *conn) renameFids(oldName, newName string) {
+	for _, f := range c.fids {
+		if f.name == oldName || strings.HasPrefix(f.name, oldName+"/") {
+			f.name = newName + strings.TrimPrefix(f.name, oldName)
+		}
+	}
+}
+
+func (c *conn) version(d *decoder, e *encoder) error {
+	msize, version := d.u32(), d.str()
+	if err := d.err(); err != nil {
+		return err
+	}
+
+	// A new session drops every fid of the old one
+	c.fids = make(map[uint32]*fid)
+	c.msize = max(min(msize, maxMsize), ioHeader+1)
+	if !strings.HasPrefix(version, Version) {
+		version = "unknown"
+	} else {
+		version = Version
+	}
+	e.u32(c.msize)
+	e.str(version)
+	return nil
+}
+
+func (c *conn) attach(d *decoder, e *encoder) error {
+	num := d.u32()
+	d.u32() // afid; there is no authentication
+	d.str() // uname; new files belong to the image's current user
+	d.str() // aname; the whole image is served
+	d.u32() // n_uname
+	if err := d.err(); err != nil {
+		return err
+	}
+	if c.fids[num] != nil {
+		return eBadF
+	}
+
+	root, err := c.s.fs.Stat("")
+	if err != nil {
+		return err
+	}
+	c.fids[num] = &fid{name: ""}
+	e.qid(qidFor(root))
+	return nil
+}
+
+func (c *conn) walk(d *decoder, e *encoder) error {
+	num, newNum, count := d.u32(), d.u32(), d.u16()
+	names := make([]string, 0, min(count, maxWalk))
+	for range min(count, maxWalk) {
+		names = append(names, d.str())
+	}
+	if err := d.err(); err != nil {
+		return err
+	}
+	if count > maxWalk {
+		return eInval
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	if newNum != num && c.fids[newNum] != nil {
+		return eBadF
+	}
+
+	// Walk as far as possible; only failing at the first name is an error
+	name := f.name
+	var qids []qid
+	if len(names) > 0 {
+		cur, err := c.s.fs.Stat(name)
+		if err != nil {
+			return err
+		}
+		for _, elem := range names {
+			if !cur.Dir {
+				err = eNotDir
+				break
+			}
+			next := name
+			switch elem {
+			case ".":
+			case "..":
+				next = vfs.Parent(name)
+			default:
+				next, err = vfs.Join(name, elem)
+			}
+			if err != nil {
+				break
+			}
+			if cur, err = c.s.fs.Stat(next); err != nil {
+				break
+			}
+			name = next
+			qids = append(qids, qidFor(cur))
+		}
+		if len(qids) == 0 {
+			return err
+		}
+	}
+
+	if len(qids) == len(names) {
+		c.fids[newNum] = &fid{name: name}
+	}
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	return nil
+}
+
+func (c *conn) lopen(d *decoder, e *encoder) error {
+	num, flags := d.u32(), d.u32()
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	if f.open {
+		return eBadF
+	}
+	a, err := c.s.fs.Stat(f.name)
+	if err != nil {
+		return err
+	}
+
+	writing := flags&oAccMode != oRdonly
+	if a.Dir && writing {
+		return eIsDir
+	}
+	if writing && c.s.fs.ReadOnly() {
+		return filesystem.ErrReadOnly
+	}
+	if writing && flags&oTrunc != 0 && a.Size > 0 {
+		if err := c.s.fs.Truncate(f.name, 0); err != nil {
+			return err
+		}
+	}
+
+	f.open, f.dir, f.flags, f.entries = true, a.Dir, flags, nil
+	e.qid(qidFor(a))
+	e.u32(0) // iounit; the client works it out from the message size
+	return nil
+}
+
+func (c *conn) lcreate(d *decoder, e *encoder) error {
+	num, elem, flags := d.u32(), d.str(), d.u32()
+	d.u32() // mode; files have no permissions
+	d.u32() // gid
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	if f.open {
+		return eBadF
+	}
+	name, err := vfs.Join(f.name, elem)
+	if err != nil {
+		return err
+	}
+	a, err := c.s.fs.Create(name)
+	if err != nil {
+		return err
+	}
+
+	f.name, f.open, f.dir, f.flags = name, true, false, flags
+	e.qid(qidFor(a))
+	e.u32(0)
+	return nil
+}
+
+func (c *conn) read(d *decoder, e *encoder) error {
+	num, offset, count := d.u32(), d.u64(), d.u32()
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	if !f.open {
+		return eBadF
+	}
+	if f.dir {
+		return eIsDir
+	}
+
+	buf := make([]byte, min(count, c.msize-ioHeader))
+	n, err := c.s.fs.ReadAt(f.name, buf, int64(offset))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	e.u32(uint32(n))
+	e.b = append(e.b, buf[:n]...)
+	return nil
+}
+
+func (c *conn) write(d *decoder, e *encoder) error {
+	num, offset, count := d.u32(), d.u64(), d.u32()
+	data := d.take(int(count))
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	if !f.open || f.flags&oAccMode == oRdonly {
+		return eBadF
+	}
+
+	if f.flags&oAppend != 0 {
+		a, err := c.s.fs.Stat(f.name)
+		if err != nil {
+			return err
+		}
+		offset = uint64(a.Size)
+	}
+	n, err := c.s.fs.WriteAt(f.name, data, int64(offset))
+	if err != nil {
+		return err
+	}
+	e.u32(uint32(n))
+	return nil
+}
+
+func (c *conn) clunk(d *decoder) error {
+	num := d.u32()
+	if err := d.err(); err != nil {
+		return err
+	}
+	if _, err := c.fid(num); err != nil {
+		return err
+	}
+	delete(c.fids, num)
+	return c.s.Sync()
+}
+
+func (c *conn) remove(d *decoder) error {
+	num := d.u32()
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+
+	// The fid is clunked even if the remove fails
+	delete(c.fids, num)
+	a, err := c.s.fs.Stat(f.name)
+	if err != nil {
+		return err
+	}
+	if a.Dir {
+		return c.s.fs.Rmdir(f.name)
+	}
+	return c.s.fs.Remove(f.name)
+}
+
+func (c *conn) getattr(d *decoder, e *encoder) error {
+	num := d.u32()
+	d.u64() // request mask; every basic field is always sent
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	a, err := c.s.fs.Stat(f.name)
+	if err != nil {
+		return err
+	}
+
+	mode, nlink := uint32(modeReg|0o644), uint64(1)
+	if a.Dir {
+		mode, nlink = modeDir|0o755, 2
+	}
+	e.u64(getattrBasic)
+	e.qid(qidFor(a))
+	e.u32(mode)
+	e.u32(c.s.uid)
+	e.u32(c.s.gid)
+	e.u64(nlink)
+	e.u64(0) // rdev
+	e.u64(uint64(a.Size))
+	e.u64(filesystem.BlockSize)
+	e.u64(uint64(a.Blocks))
+	for range 3 {
+		// Access, modification and change times are all the same
+		e.u64(uint64(a.ModTime.Unix()))
+		e.u64(0)
+	}
+	e.u64(0) // Birth time, generation and data version are not reported
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	return nil
+}
+
+func (c *conn) setattr(d *decoder) error {
+	num, valid := d.u32(), d.u32()
+	d.u32() // mode, uid and gid; files have none to change
+	d.u32()
+	d.u32()
+	size := d.u64()
+	d.u64() // atime is not stored
+	d.u64()
+	mtimeSec, mtimeNsec := d.u64(), d.u64()
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	a, err := c.s.fs.Stat(f.name)
+	if err != nil {
+		return err
+	}
+	if a.Dir {
+		// Directories have no attributes of their own
+		return nil
+	}
+
+	if valid&setattrSize != 0 {
+		if err := c.s.fs.Truncate(f.name, int64(size)); err != nil {
+			return err
+		}
+	}
+	if valid&setattrMtime != 0 {
+		mtime := time.Now()
+		if valid&setattrMtimeSet != 0 {
+			mtime = time.Unix(int64(mtimeSec), int64(mtimeNsec))
+		}
+		if err := c.s.fs.Chtimes(f.name, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) readdir(d *decoder, e *encoder) error {
+	num, offset, count := d.u32(), d.u64(), d.u32()
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	if !f.open {
+		return eBadF
+	}
+	if !f.dir {
+		return eNotDir
+	}
+
+	// Take a listing at the start and page through it after that, so that
+	// changes part way do not shift the offsets
+	if offset == 0 || f.entries == nil {
+		self, err := c.s.fs.Stat(f.name)
+		if err != nil {
+			return err
+		}
+		up, err := c.s.fs.Stat(vfs.Parent(f.name))
+		if err != nil {
+			return err
+		}
+		children, err := c.s.fs.ReadDir(f.name)
+		if err != nil {
+			return err
+		}
+		f.entries = []dirent{{".", qidFor(self)}, {"..", qidFor(up)}}
+		for _, child := range children {
+			f.entries = append(f.entries, dirent{path.Base(child.Name), qidFor(child)})
+		}
+	}
+
+	// Each entry is qid[13] offset[8] type[1] name[s]
+	count = min(count, c.msize-ioHeader)
+	start := len(e.b)
+	e.u32(0)
+	for i := offset; i < uint64(len(f.entries)); i++ {
+		entry := f.entries[i]
+		if len(e.b)-start-4+24+len(entry.name) > int(count) {
+			break
+		}
+		typ := uint8(dtReg)
+		if entry.qid.typ == qtDir {
+			typ = dtDir
+		}
+		e.qid(entry.qid)
+		e.u64(i + 1)
+		e.u8(typ)
+		e.str(entry.name)
+	}
+	binary.LittleEndian.PutUint32(e.b[start:], uint32(len(e.b)-start-4))
+	return nil
+}
+
+func (c *conn) statfs(d *decoder, e *encoder) error {
+	num := d.u32()
+	if err := d.err(); err != nil {
+		return err
+	}
+	if _, err := c.fid(num); err != nil {
+		return err
+	}
+
+	usage := c.s.fs.Usage()
+	e.u32(v9fsMagic)
+	e.u32(filesystem.BlockSize)
+	e.u64(uint64(usage.TotalBlocks))
+	e.u64(uint64(usage.FreeBlocks))
+	e.u64(uint64(usage.FreeBlocks))
+	e.u64(uint64(usage.Names))
+	e.u64(uint64(usage.FreeNames))
+	e.u64(0) // fsid
+	e.u32(filesystem.MaxNameLength)
+	return nil
+}
+
+func (c *conn) fsync(d *decoder) error {
+	num := d.u32()
+	d.u32() // datasync; the whole image is saved either way
+	if err := d.err(); err != nil {
+		return err
+	}
+	if _, err := c.fid(num); err != nil {
+		return err
+	}
+	return c.s.Sync()
+}
+
+func (c *conn) mkdir(d *decoder, e *encoder) error {
+	num, elem := d.u32(), d.str()
+	d.u32() // mode; directories have no permissions
+	d.u32() // gid
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	name, err := vfs.Join(f.name, elem)
+	if err != nil {
+		return err
+	}
+	a, err := c.s.fs.Mkdir(name)
+	if err != nil {
+		return err
+	}
+	e.qid(qidFor(a))
+	return nil
+}
+
+func (c *conn) rename(d *decoder) error {
+	num, dirNum, elem := d.u32(), d.u32(), d.str()
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	dir, err := c.fid(dirNum)
+	if err != nil {
+		return err
+	}
+	name, err := vfs.Join(dir.name, elem)
+	if err != nil {
+		return err
+	}
+
+	oldName := f.name
+	if err := c.s.fs.Rename(oldName, name); err != nil {
+		return err
+	}
+	c.renameFids(oldName, name)
+	return nil
+}
+
+func (c *conn) renameat(d *decoder) error {
+	oldDirNum, oldElem, newDirNum, newElem := d.u32(), d.str(), d.u32(), d.str()
+	if err := d.err(); err != nil {
+		return err
+	}
+	oldDir, err := c.fid(oldDirNum)
+	if err != nil {
+		return err
+	}
+	newDir, err := c.fid(newDirNum)
+	if err != nil {
+		return err
+	}
+	oldName, err := vfs.Join(oldDir.name, oldElem)
+	if err != nil {
+		return err
+	}
+	newName, err := vfs.Join(newDir.name, newElem)
+	if err != nil {
+		return err
+	}
+
+	if err := c.s.fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	c.renameFids(oldName, newName)
+	return nil
+}
+
+func (c *conn) unlinkat(d *decoder) error {
+	num, elem, flags := d.u32(), d.str(), d.u32()
+	if err := d.err(); err != nil {
+		return err
+	}
+	f, err := c.fid(num)
+	if err != nil {
+		return err
+	}
+	name, err := vfs.Join(f.name, elem)
+	if err != nil {
+		return err
+	}
+	if flags&atRemoveDir != 0 {
+		return c.s.fs.Rmdir(name)
+	}
+	return c.s.fs.Remove(name)
+}
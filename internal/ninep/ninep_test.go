@@ -0,0 +1,250 @@
+package ninep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/vfs"
+)
+
+// client speaks 9P2000.L to a Server over an in-process pipe
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+// newClient serves an image holding docs/readme.txt and connects to it
+func newClient(t *testing.T) (*client, *filesystem.FileSystem) {
+	t.Helper()
+	fs := filesystem.CreateFS(256, "tester")
+	if err := filesystem.FormatFS(fs, 16, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := filesystem.SaveFS(fs, filepath.Join(t.TempDir(), "disk")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filesystem.CloseFS(fs) })
+	_, err := filesystem.PutReaderFS(fs, bytes.NewReader([]byte("hello, world")), filesystem.PutOptions{Name: "docs/readme.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- NewServer(vfs.New(fs)).ServeConn(server) }()
+	t.Cleanup(func() {
+		conn.Close()
+		if err := <-done; err != nil {
+			t.Errorf("ServeConn: %v", err)
+		}
+	})
+	return &client{t: t, conn: conn}, fs
+}
+
+// rpc sends a request built by fill and returns the reply's type and fields
+func (c *client) rpc(typ uint8, fill func(e *encoder)) (uint8, *decoder) {
+	c.t.Helper()
+	c.tag++
+	e := &encoder{b: make([]byte, headerSize)}
+	fill(e)
+	binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)))
+	e.b[4] = typ
+	binary.LittleEndian.PutUint16(e.b[5:], c.tag)
+	if _, err := c.conn.Write(e.b); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	msg := make([]byte, binary.LittleEndian.Uint32(size[:])-4)
+	if _, err := io.ReadFull(c.conn, msg); err != nil {
+		c.t.Fatal(err)
+	}
+	if tag := binary.LittleEndian.Uint16(msg[1:3]); tag != c.tag {
+		c.t.Fatalf("reply has tag %d, want %d", tag, c.tag)
+	}
+	return msg[0], &decoder{b: msg[3:]}
+}
+
+// call sends a request that must succeed
+func (c *client) call(typ uint8, fill func(e *encoder)) *decoder {
+	c.t.Helper()
+	reply, d := c.rpc(typ, fill)
+	if reply == msgRlerror {
+		c.t.Fatalf("request %d failed with errno %d", typ, d.u32())
+	}
+	if reply != typ+1 {
+		c.t.Fatalf("request %d got reply %d", typ, reply)
+	}
+	return d
+}
+
+// fail sends a request that must fail and returns its error number
+func (c *client) fail(typ uint8, fill func(e *encoder)) uint32 {
+	c.t.Helper()
+	reply, d := c.rpc(typ, fill)
+	if reply != msgRlerror {
+		c.t.Fatalf("request %d got reply %d, want Rlerror", typ, reply)
+	}
+	return d.u32()
+}
+
+func (c *client) walk(num, newNum uint32, names ...string) []qid {
+	c.t.Helper()
+	d := c.call(msgTwalk, func(e *encoder) {
+		e.u32(num)
+		e.u32(newNum)
+		e.u16(uint16(len(names)))
+		for _, name := range names {
+			e.str(name)
+		}
+	})
+	qids := make([]qid, d.u16())
+	for i := range qids {
+		qids[i] = qid{typ: d.u8(), version: d.u32(), path: d.u64()}
+	}
+	return qids
+}
+
+func (c *client) lopen(num, flags uint32) {
+	c.t.Helper()
+	c.call(msgTlopen, func(e *encoder) {
+		e.u32(num)
+		e.u32(flags)
+	})
+}
+
+func (c *client) read(num uint32, offset uint64, count uint32) []byte {
+	c.t.Helper()
+	d := c.call(msgTread, func(e *encoder) {
+		e.u32(num)
+		e.u64(offset)
+		e.u32(count)
+	})
+	return d.take(int(d.u32()))
+}
+
+func (c *client) clunk(num uint32) {
+	c.t.Helper()
+	c.call(msgTclunk, func(e *encoder) { e.u32(num) })
+}
+
+func TestServeConn(t *testing.T) {
+	c, fs := newClient(t)
+
+	d := c.call(msgTversion, func(e *encoder) {
+		e.u32(8192)
+		e.str(Version)
+	})
+	if msize, version := d.u32(), d.str(); msize != 8192 || version != Version {
+		t.Fatalf("Rversion = %d %q, want 8192 %q", msize, version, Version)
+	}
+	d = c.call(msgTattach, func(e *encoder) {
+		e.u32(0) // fid
+		e.u32(^uint32(0))
+		e.str("tester")
+		e.str("")
+		e.u32(0)
+	})
+	if typ := d.u8(); typ != qtDir {
+		t.Fatalf("root qid type = %#x, want a directory", typ)
+	}
+
+	// Walk to the file and read it
+	qids := c.walk(0, 1, "docs", "readme.txt")
+	if len(qids) != 2 || qids[0].typ != qtDir || qids[1].typ != qtFile {
+		t.Fatalf("walk returned %+v", qids)
+	}
+	c.lopen(1, oRdonly)
+	if got := c.read(1, 7, 100); string(got) != "world" {
+		t.Fatalf("read %q, want %q", got, "world")
+	}
+	c.clunk(1)
+
+	// A walk to a missing name fails at the first element
+	errno := c.fail(msgTwalk, func(e *encoder) {
+		e.u32(0)
+		e.u32(2)
+		e.u16(1)
+		e.str("missing")
+	})
+	if errno != vfs.ENOENT {
+		t.Fatalf("walk to a missing name failed with errno %d, want ENOENT", errno)
+	}
+
+	// Create a file in docs, write to it and read it back
+	c.walk(0, 2, "docs")
+	d = c.call(msgTlcreate, func(e *encoder) {
+		e.u32(2)
+		e.str("new.txt")
+		e.u32(2) // O_RDWR
+		e.u32(0o644)
+		e.u32(0)
+	})
+	if typ := d.u8(); typ != qtFile {
+		t.Fatalf("created qid type = %#x, want a file", typ)
+	}
+	d = c.call(msgTwrite, func(e *encoder) {
+		e.u32(2)
+		e.u64(0)
+		e.u32(5)
+		e.b = append(e.b, "fresh"...)
+	})
+	if n := d.u32(); n != 5 {
+		t.Fatalf("wrote %d bytes, want 5", n)
+	}
+	if got := c.read(2, 0, 100); string(got) != "fresh" {
+		t.Fatalf("read %q back, want %q", got, "fresh")
+	}
+	c.clunk(2)
+
+	// Move it to the root and remove the original
+	c.walk(0, 3, "docs")
+	c.call(msgTrenameat, func(e *encoder) {
+		e.u32(3)
+		e.str("new.txt")
+		e.u32(0)
+		e.str("moved.txt")
+	})
+	c.call(msgTunlinkat, func(e *encoder) {
+		e.u32(3)
+		e.str("readme.txt")
+		e.u32(0)
+	})
+	c.clunk(3)
+
+	var got []string
+	for _, st := range mustFiles(t, fs) {
+		got = append(got, st.Name)
+	}
+	if len(got) != 1 || got[0] != "moved.txt" {
+		t.Fatalf("image holds %v, want only moved.txt", got)
+	}
+	data := make([]byte, 5)
+	if _, err := filesystem.ReadAtFS(fs, "moved.txt", data, 0); err != nil || string(data) != "fresh" {
+		t.Fatalf("moved.txt holds %q, %v", data, err)
+	}
+
+	// Clunked fids are gone
+	if errno := c.fail(msgTclunk, func(e *encoder) { e.u32(3) }); errno != uint32(eBadF) {
+		t.Fatalf("clunk of a clunked fid failed with errno %d, want EBADF", errno)
+	}
+}
+
+// mustFiles describes every file in the image
+func mustFiles(t *testing.T, fs *filesystem.FileSystem) []filesystem.FileStat {
+	t.Helper()
+	files, err := filesystem.FilesFS(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
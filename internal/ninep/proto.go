@@ -0,0 +1,164 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/allim132/filesystem/internal/vfs"
+)
+
+// Version is the only protocol version the server speaks
+const Version = "9P2000.L"
+
+// Message types. Every reply is the request's type plus one, and failures
+// are reported with Rlerror in place of the reply.
+const (
+	msgRlerror   = 7
+	msgTstatfs   = 8
+	msgTlopen    = 12
+	msgTlcreate  = 14
+	msgTrename   = 20
+	msgTgetattr  = 24
+	msgTsetattr  = 26
+	msgTreaddir  = 40
+	msgTfsync    = 50
+	msgTmkdir    = 72
+	msgTrenameat = 74
+	msgTunlinkat = 76
+	msgTversion  = 100
+	msgTattach   = 104
+	msgTflush    = 108
+	msgTwalk     = 110
+	msgTread     = 116
+	msgTwrite    = 118
+	msgTclunk    = 120
+	msgTremove   = 122
+)
+
+const (
+	headerSize = 7  // size[4] type[1] tag[2]
+	ioHeader   = 24 // Room taken by the fields of Twrite and Rread around the data
+	maxMsize   = 1 << 20
+	maxWalk    = 16 // Most names a single Twalk may hold
+)
+
+// Qid types
+const (
+	qtDir  = 0x80
+	qtFile = 0x00
+)
+
+// Linux open flags carried by Tlopen and Tlcreate
+const (
+	oAccMode = 0x3
+	oRdonly  = 0x0
+	oTrunc   = 0x200
+	oAppend  = 0x400
+)
+
+// Tsetattr valid bits
+const (
+	setattrSize     = 0x8
+	setattrMtime    = 0x20
+	setattrMtimeSet = 0x100
+)
+
+const (
+	getattrBasic = 0x7ff // Every field of Rgetattr up to and including blocks
+	atRemoveDir  = 0x200 // Tunlinkat flag to remove a directory
+	v9fsMagic    = 0x01021997
+	dtDir        = 4
+	dtReg        = 8
+	modeDir      = 0o040000
+	modeReg      = 0o100000
+)
+
+// errno is a Linux error number, the form Rlerror reports failures in.
+// Most come from the file system through vfs.Errno; these are the ones the
+// protocol itself gives rise to.
+type errno uint32
+
+const (
+	eBadF      errno = 9
+	eNotDir    errno = vfs.ENOTDIR
+	eIsDir     errno = vfs.EISDIR
+	eInval     errno = vfs.EINVAL
+	eProto     errno = 71
+	eOpNotSupp errno = vfs.EOPNOTSUPP
+)
+
+func (e errno) Error() string {
+	return fmt.Sprintf("9P error %d", uint32(e))
+}
+
+// errnoFor returns the error number to report err with
+func errnoFor(err error) errno {
+	var e errno
+	if errors.As(err, &e) {
+		return e
+	}
+	return errno(vfs.Errno(err))
+}
+
+// qid is the server's identity for a file
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// decoder reads the fields of a message in order. A message too short for
+// its fields sets bad, and the fields read from then on are zero.
+type decoder struct {
+	b   []byte
+	bad bool
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.bad || len(d.b) < n {
+		d.bad = true
+		return make([]byte, min(n, 8))
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8   { return d.take(1)[0] }
+func (d *decoder) u16() uint16 { return binary.LittleEndian.Uint16(d.take(2)) }
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+
+func (d *decoder) str() string {
+	return string(d.take(int(d.u16())))
+}
+
+// err reports a message that was too short for the fields read from it
+func (d *decoder) err() error {
+	if d.bad {
+		return eProto
+	}
+	return nil
+}
+
+// encoder appends the fields of a message
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) u8(v uint8)   { e.b = append(e.b, v) }
+func (e *encoder) u16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+func (e *encoder) u32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+func (e *encoder) u64(v uint64) { e.b = binary.LittleEndian.AppendUint64(e.b, v) }
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
@@ -0,0 +1,53 @@
+package vfs
+
+import (
+	"errors"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// Linux error numbers, which both 9P2000.L and FUSE report failures in
+// whatever platform the server runs on
+const (
+	ENOENT       = 2
+	EIO          = 5
+	EBUSY        = 16
+	EEXIST       = 17
+	ENOTDIR      = 20
+	EISDIR       = 21
+	EINVAL       = 22
+	ENOSPC       = 28
+	EROFS        = 30
+	ENAMETOOLONG = 36
+	ENOTEMPTY    = 39
+	EOPNOTSUPP   = 95
+)
+
+// Errno returns the Linux error number that best describes err
+func Errno(err error) uint32 {
+	switch {
+	case errors.Is(err, ErrNotDir):
+		return ENOTDIR
+	case errors.Is(err, ErrIsDir):
+		return EISDIR
+	case errors.Is(err, ErrNotEmpty):
+		return ENOTEMPTY
+	case errors.Is(err, filesystem.ErrNotExist):
+		return ENOENT
+	case errors.Is(err, filesystem.ErrExist):
+		return EEXIST
+	case errors.Is(err, filesystem.ErrReadOnly):
+		return EROFS
+	case errors.Is(err, filesystem.ErrNoSpace), errors.Is(err, filesystem.ErrNoInodes):
+		return ENOSPC
+	case errors.Is(err, filesystem.ErrNameTooLong):
+		return ENAMETOOLONG
+	case errors.Is(err, filesystem.ErrInvalid):
+		return EINVAL
+	case errors.Is(err, filesystem.ErrUnsupported):
+		return EOPNOTSUPP
+	case errors.Is(err, filesystem.ErrLocked), errors.Is(err, filesystem.ErrTxConflict):
+		return EBUSY
+	}
+	return EIO
+}
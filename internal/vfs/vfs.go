@@ -0,0 +1,469 @@
+// Package vfs presents a file system as a tree of directories and files, the
+// view that mount adapters such as the 9P and FUSE servers translate their
+// requests into.
+//
+// The file system has no directories, but file names may contain '/', so a
+// directory is every name sharing a prefix. Directories made with Mkdir, or
+// left empty by removing their last file, only exist for the life of the
+// Tree. Names are relative and '/'-separated, "" being the root.
+package vfs
+
+import (
+	"errors"
+	"hash/fnv"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// Errors for requests that do not fit the kind of entry they name, in
+// addition to the filesystem package errors
+var (
+	ErrNotDir   = errors.New("not a directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotEmpty = errors.New("directory not empty")
+)
+
+// FS is a tree of directories and files. Changes to the contents of files
+// are only certain to reach the image after Sync.
+type FS interface {
+	Stat(name string) (Attr, error)
+	ReadDir(name string) ([]Attr, error) // Sorted by name
+	ReadAt(name string, p []byte, off int64) (int, error)
+	WriteAt(name string, p []byte, off int64) (int, error)
+	Truncate(name string, size int64) error
+	Chtimes(name string, modTime time.Time) error
+	Create(name string) (Attr, error) // Fails with ErrExist if name is taken
+	Mkdir(name string) (Attr, error)
+	Remove(name string) error // Removes a file
+	Rmdir(name string) error  // Removes an empty directory
+	Rename(oldName, newName string) error
+	Usage() filesystem.Usage
+	ReadOnly() bool
+	Sync() error
+}
+
+// Attr describes a file or directory. The fields of files come from their
+// DABPT entry.
+type Attr struct {
+	Name    string
+	Dir     bool
+	Ino     uint64 // Never 0; a file's changes when a put replaces it
+	Size    int64
+	Blocks  int64 // Space taken on disk, in 512-byte units
+	ModTime time.Time
+	Owner   string
+}
+
+// Join returns the name of the entry called elem in the directory dir. elem
+// must be a single element, not "." or "..".
+func Join(dir, elem string) (string, error) {
+	if elem == "" || elem == "." || elem == ".." || strings.Contains(elem, "/") {
+		return "", filesystem.ErrInvalid
+	}
+	if dir == "" {
+		return elem, nil
+	}
+	return dir + "/" + elem, nil
+}
+
+// Parent returns the directory holding name
+func Parent(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// Tree is the FS of a *filesystem.FileSystem
+type Tree struct {
+	fs      *filesystem.FileSystem
+	started time.Time
+
+	mu    sync.Mutex
+	dirs  map[string]bool // Directories that may hold no files
+	dirty bool            // Changes not saved to the image yet
+}
+
+// New returns a Tree for fs. A read-only file system refuses every change.
+func New(fs *filesystem.FileSystem) *Tree {
+	return &Tree{fs: fs, started: time.Now(), dirs: make(map[string]bool)}
+}
+
+// fileAttr describes a stored file
+func fileAttr(st filesystem.FileStat) Attr {
+	return Attr{
+		Name:    st.Name,
+		Ino:     uint64(st.Inode) + 1,
+		Size:    st.Size,
+		Blocks:  (st.AllocatedSize + 511) / 512,
+		ModTime: st.LastModified,
+		Owner:   st.Owner,
+	}
+}
+
+// dirAttr describes a directory, which is numbered by its name
+func dirAttr(name string, modTime time.Time) Attr {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return Attr{Name: name, Dir: true, Ino: h.Sum64() | 1<<63, ModTime: modTime}
+}
+
+// Stat describes the file or directory called name. A directory's time
+// stamp is that of the newest file below it.
+func (t *Tree) Stat(name string) (Attr, error) {
+	if name != "" {
+		st, err := filesystem.StatFS(t.fs, name)
+		if err == nil {
+			return fileAttr(*st), nil
+		}
+		if !errors.Is(err, filesystem.ErrNotExist) {
+			return Attr{}, err
+		}
+	}
+
+	// Not a file, so a directory if any file lies below it
+	entries, err := filesystem.ReadDirFS(t.fs, name)
+	if err != nil && !errors.Is(err, filesystem.ErrNotExist) {
+		return Attr{}, err
+	}
+	var modTime time.Time
+	for _, e := range entries {
+		if e.LastModified.After(modTime) {
+			modTime = e.LastModified
+		}
+	}
+	if modTime.IsZero() {
+		modTime = t.started
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if name == "" || len(entries) > 0 || t.dirs[name] {
+		return dirAttr(name, modTime), nil
+	}
+	return Attr{}, &iofs.PathError{Op: "stat", Path: name, Err: filesystem.ErrNotExist}
+}
+
+// lookup describes name and, for a directory, lists every file below it
+func (t *Tree) lookup(name string) (Attr, []string, error) {
+	a, err := t.Stat(name)
+	if err != nil || !a.Dir {
+		return a, nil, err
+	}
+	stats, err := filesystem.FilesFS(t.fs)
+	if err != nil {
+		return Attr{}, nil, err
+	}
+	var files []string
+	for _, st := range stats {
+		if name == "" || strings.HasPrefix(st.Name, name+"/") {
+			files = append(files, st.Name)
+		}
+	}
+	return a, files, nil
+}
+
+// ReadDir describes the entries directly inside the directory name
+func (t *Tree) ReadDir(name string) ([]Attr, error) {
+	a, err := t.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !a.Dir {
+		return nil, ErrNotDir
+	}
+	stats, err := filesystem.FilesFS(t.fs)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+
+	found := make(map[string]Attr)
+	addDir := func(rel string, modTime time.Time) {
+		dir := prefix + strings.Split(rel, "/")[0]
+		if a, ok := found[dir]; !ok || modTime.After(a.ModTime) {
+			found[dir] = dirAttr(dir, modTime)
+		}
+	}
+	for _, st := range stats {
+		rel, ok := strings.CutPrefix(st.Name, prefix)
+		if !ok {
+			continue
+		}
+		if strings.Contains(rel, "/") {
+			addDir(rel, st.LastModified)
+			continue
+		}
+		found[st.Name] = fileAttr(st)
+	}
+	t.mu.Lock()
+	for dir := range t.dirs {
+		if rel, ok := strings.CutPrefix(dir, prefix); ok {
+			addDir(rel, t.started)
+		}
+	}
+	t.mu.Unlock()
+
+	entries := make([]Attr, 0, len(found))
+	for _, a := range found {
+		entries = append(entries, a)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// ReadAt reads part of a file, like filesystem.ReadAtFS
+func (t *Tree) ReadAt(name string, p []byte, off int64) (int, error) {
+	return filesystem.ReadAtFS(t.fs, name, p, off)
+}
+
+// WriteAt writes part of a file, like filesystem.WriteAtFS
+func (t *Tree) WriteAt(name string, p []byte, off int64) (int, error) {
+	n, err := filesystem.WriteAtFS(t.fs, name, p, off)
+	if n > 0 {
+		t.changed()
+	}
+	return n, err
+}
+
+// Truncate sets the size of a file
+func (t *Tree) Truncate(name string, size int64) error {
+	if err := filesystem.TruncateFS(t.fs, name, size); err != nil {
+		return err
+	}
+	t.changed()
+	return nil
+}
+
+// Chtimes sets the modification time of a file. Directories have no time
+// stamp of their own, so they are left alone.
+func (t *Tree) Chtimes(name string, modTime time.Time) error {
+	a, err := t.Stat(name)
+	if err != nil || a.Dir {
+		return err
+	}
+	if err := filesystem.ChtimesFS(t.fs, name, modTime); err != nil {
+		return err
+	}
+	t.changed()
+	return nil
+}
+
+// checkNew makes sure name can be created: its parent is a directory and
+// nothing is called name yet
+func (t *Tree) checkNew(name string) error {
+	if _, err := Join(Parent(name), path.Base(name)); err != nil {
+		return err
+	}
+	dir, err := t.Stat(Parent(name))
+	if err != nil {
+		return err
+	}
+	if !dir.Dir {
+		return ErrNotDir
+	}
+	if _, err := t.Stat(name); err == nil {
+		return &iofs.PathError{Op: "create", Path: name, Err: filesystem.ErrExist}
+	}
+	return nil
+}
+
+// Create stores an empty file called name, which saves the image. The file
+// belongs to the image's current user.
+func (t *Tree) Create(name string) (Attr, error) {
+	if err := t.checkNew(name); err != nil {
+		return Attr{}, err
+	}
+	_, err := filesystem.PutReaderFS(t.fs, strings.NewReader(""), filesystem.PutOptions{
+		Name:       name,
+		AllowEmpty: true,
+	})
+	if err != nil {
+		return Attr{}, err
+	}
+	return t.Stat(name)
+}
+
+// Mkdir makes an empty directory
+func (t *Tree) Mkdir(name string) (Attr, error) {
+	if err := t.checkNew(name); err != nil {
+		return Attr{}, err
+	}
+	if t.fs.ReadOnly() {
+		return Attr{}, filesystem.ErrReadOnly
+	}
+
+	t.mu.Lock()
+	t.dirs[name] = true
+	t.mu.Unlock()
+	return dirAttr(name, t.started), nil
+}
+
+// Remove deletes a file and saves the image
+func (t *Tree) Remove(name string) error {
+	a, err := t.Stat(name)
+	if err != nil {
+		return err
+	}
+	if a.Dir {
+		return ErrIsDir
+	}
+	if err := filesystem.RemoveFS(t.fs, name); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.keepParent(name)
+	t.dirty = true
+	t.mu.Unlock()
+	return t.Sync()
+}
+
+// Rmdir removes an empty directory
+func (t *Tree) Rmdir(name string) error {
+	if name == "" {
+		return filesystem.ErrInvalid
+	}
+	a, files, err := t.lookup(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !a.Dir:
+		return ErrNotDir
+	case len(files) > 0:
+		return ErrNotEmpty
+	case t.fs.ReadOnly():
+		return filesystem.ErrReadOnly
+	}
+
+	t.mu.Lock()
+	delete(t.dirs, name)
+	t.keepParent(name)
+	t.mu.Unlock()
+	return nil
+}
+
+// keepParent remembers the directory holding name, so that it stays behind
+// when its last file is removed or renamed away. The caller holds t.mu.
+func (t *Tree) keepParent(name string) {
+	if dir := Parent(name); dir != "" {
+		t.dirs[dir] = true
+	}
+}
+
+// Rename moves a file or a whole directory to newName, replacing a file or
+// empty directory of the same kind that is already there, and saves the
+// image
+func (t *Tree) Rename(oldName, newName string) error {
+	if oldName == "" || newName == "" || strings.HasPrefix(newName, oldName+"/") {
+		return filesystem.ErrInvalid
+	}
+	if oldName == newName {
+		return nil
+	}
+	src, files, err := t.lookup(oldName)
+	if err != nil {
+		return err
+	}
+	dst, dstFiles, err := t.lookup(newName)
+	exists := err == nil
+	if exists {
+		switch {
+		case src.Dir && !dst.Dir:
+			return ErrNotDir
+		case !src.Dir && dst.Dir:
+			return ErrIsDir
+		case dst.Dir && len(dstFiles) > 0:
+			return ErrNotEmpty
+		}
+	} else if err := t.checkNew(newName); err != nil {
+		return err
+	}
+	if t.fs.ReadOnly() {
+		return filesystem.ErrReadOnly
+	}
+
+	// Renames hold the lock while they move files, so that the moves of two
+	// directories do not interleave
+	if !src.Dir {
+		files = []string{oldName}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if exists && !dst.Dir {
+		// The replaced file's entries are freed, so the rename that follows
+		// cannot run out of them
+		if err := filesystem.RemoveFS(t.fs, newName); err != nil {
+			return err
+		}
+		t.dirty = true
+	}
+	for i, file := range files {
+		if err := filesystem.RenameFS(t.fs, file, newName+strings.TrimPrefix(file, oldName)); err != nil {
+			// Move back the files of a directory that were already renamed
+			for _, done := range files[:i] {
+				filesystem.RenameFS(t.fs, newName+strings.TrimPrefix(done, oldName), done)
+			}
+			return err
+		}
+		t.dirty = true
+	}
+
+	for dir := range t.dirs {
+		if dir == oldName || strings.HasPrefix(dir, oldName+"/") {
+			delete(t.dirs, dir)
+			t.dirs[newName+strings.TrimPrefix(dir, oldName)] = true
+		}
+	}
+	t.keepParent(oldName)
+	return t.sync()
+}
+
+// Usage reports the free space and free FNT entries
+func (t *Tree) Usage() filesystem.Usage {
+	return filesystem.UsageFS(t.fs)
+}
+
+// ReadOnly reports whether the file system refuses changes
+func (t *Tree) ReadOnly() bool {
+	return t.fs.ReadOnly()
+}
+
+// Sync saves changes that are not in the image yet. Creating, removing and
+// renaming save the image straight away; writes and other changes to a
+// file's contents are left for Sync.
+func (t *Tree) Sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sync()
+}
+
+// sync is Sync for a caller that holds t.mu
+func (t *Tree) sync() error {
+	if !t.dirty {
+		return nil
+	}
+	if err := filesystem.SaveFS(t.fs, t.fs.DiskName); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// changed notes a change to be saved by the next Sync
+func (t *Tree) changed() {
+	t.mu.Lock()
+	t.dirty = true
+	t.mu.Unlock()
+}
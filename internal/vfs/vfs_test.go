@@ -0,0 +1,191 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// newTree returns a Tree for an image holding the named files, each
+// containing its own name
+func newTree(t *testing.T, names ...string) (*Tree, *filesystem.FileSystem) {
+	t.Helper()
+	fs := filesystem.CreateFS(256, "tester")
+	if err := filesystem.FormatFS(fs, 16, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := filesystem.SaveFS(fs, filepath.Join(t.TempDir(), "disk")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filesystem.CloseFS(fs) })
+	for _, name := range names {
+		_, err := filesystem.PutReaderFS(fs, bytes.NewReader([]byte(name)), filesystem.PutOptions{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return New(fs), fs
+}
+
+// entryNames returns the names of a directory listing, with a '/' after
+// directories
+func entryNames(entries []Attr) []string {
+	var names []string
+	for _, a := range entries {
+		if a.Dir {
+			names = append(names, a.Name+"/")
+		} else {
+			names = append(names, a.Name)
+		}
+	}
+	return names
+}
+
+func TestLookup(t *testing.T) {
+	tree, _ := newTree(t, "top.txt", "a/one.txt", "a/b/two.txt")
+
+	root, files, err := tree.lookup("")
+	if err != nil || !root.Dir || len(files) != 3 {
+		t.Fatalf(`lookup("") = %+v, %v, %v`, root, files, err)
+	}
+	dir, files, err := tree.lookup("a")
+	if err != nil || !dir.Dir || !slices.Equal(files, []string{"a/one.txt", "a/b/two.txt"}) {
+		t.Fatalf(`lookup("a") = %+v, %v, %v`, dir, files, err)
+	}
+	file, _, err := tree.lookup("a/b/two.txt")
+	if err != nil || file.Dir || file.Size != int64(len("a/b/two.txt")) || file.Ino == 0 {
+		t.Fatalf(`lookup("a/b/two.txt") = %+v, %v`, file, err)
+	}
+
+	// A name that only prefixes a file is not a directory
+	if _, _, err := tree.lookup("a/b/tw"); !errors.Is(err, filesystem.ErrNotExist) {
+		t.Fatalf(`lookup("a/b/tw") = %v, want ErrNotExist`, err)
+	}
+	if _, err := tree.Stat("missing"); !errors.Is(err, filesystem.ErrNotExist) {
+		t.Fatalf(`Stat("missing") = %v, want ErrNotExist`, err)
+	}
+
+	// Directories made with Mkdir exist until removed
+	if _, err := tree.Mkdir("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := tree.Stat("empty"); err != nil || !a.Dir {
+		t.Fatalf(`Stat("empty") = %+v, %v`, a, err)
+	}
+	if _, err := tree.Mkdir("top.txt/sub"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("Mkdir below a file = %v, want ErrNotDir", err)
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	tree, _ := newTree(t, "top.txt", "a/one.txt", "a/b/two.txt", "c/three.txt")
+	if _, err := tree.Mkdir("a/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := tree.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entryNames(entries), []string{"a/", "c/", "top.txt"}; !slices.Equal(got, want) {
+		t.Fatalf(`ReadDir("") = %v, want %v`, got, want)
+	}
+	entries, err = tree.ReadDir("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entryNames(entries), []string{"a/b/", "a/empty/", "a/one.txt"}; !slices.Equal(got, want) {
+		t.Fatalf(`ReadDir("a") = %v, want %v`, got, want)
+	}
+
+	if _, err := tree.ReadDir("top.txt"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("ReadDir of a file = %v, want ErrNotDir", err)
+	}
+	if _, err := tree.ReadDir("missing"); !errors.Is(err, filesystem.ErrNotExist) {
+		t.Fatalf("ReadDir of a missing directory = %v, want ErrNotExist", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tree, fs := newTree(t, "a/one.txt", "a/b/two.txt", "c/three.txt", "d/four.txt")
+
+	// A file into another directory, under a new name
+	if err := tree.Rename("a/one.txt", "c/uno.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, len("a/one.txt"))
+	if _, err := tree.ReadAt("c/uno.txt", data, 0); err != nil || string(data) != "a/one.txt" {
+		t.Fatalf("c/uno.txt holds %q, %v", data, err)
+	}
+
+	// A whole directory into another one
+	if err := tree.Rename("a/b", "c/b"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tree.ReadDir("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entryNames(entries), []string{"c/b/", "c/three.txt", "c/uno.txt"}; !slices.Equal(got, want) {
+		t.Fatalf(`ReadDir("c") = %v, want %v`, got, want)
+	}
+	if _, err := tree.Stat("c/b/two.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory emptied by the renames is kept
+	if a, err := tree.Stat("a"); err != nil || !a.Dir {
+		t.Fatalf(`Stat("a") = %+v, %v`, a, err)
+	}
+	if entries, err := tree.ReadDir("a"); err != nil || len(entries) != 0 {
+		t.Fatalf(`ReadDir("a") = %v, %v, want it empty`, entryNames(entries), err)
+	}
+
+	// Kinds must match, and only empty directories are replaced
+	if err := tree.Rename("d", "c"); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("Rename onto a full directory = %v, want ErrNotEmpty", err)
+	}
+	if err := tree.Rename("d", "c/uno.txt"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("Rename of a directory onto a file = %v, want ErrNotDir", err)
+	}
+	if err := tree.Rename("c/uno.txt", "a"); !errors.Is(err, ErrIsDir) {
+		t.Fatalf("Rename of a file onto a directory = %v, want ErrIsDir", err)
+	}
+	if err := tree.Rename("d", "a"); err != nil {
+		t.Fatalf("Rename onto an empty directory = %v", err)
+	}
+	if _, err := tree.Stat("a/four.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file replaces a file
+	if err := tree.Rename("c/three.txt", "c/uno.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data = make([]byte, len("c/three.txt"))
+	if _, err := tree.ReadAt("c/uno.txt", data, 0); err != nil || string(data) != "c/three.txt" {
+		t.Fatalf("replaced c/uno.txt holds %q, %v", data, err)
+	}
+	if _, err := tree.Stat("c/three.txt"); !errors.Is(err, filesystem.ErrNotExist) {
+		t.Fatalf("Stat of the renamed file = %v, want ErrNotExist", err)
+	}
+
+	// Renames are saved to the image
+	filesystem.CloseFS(fs)
+	saved, err := filesystem.OpenFS(fs.DiskName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filesystem.CloseFS(saved)
+	entries, err = New(saved).ReadDir("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entryNames(entries), []string{"a/four.txt"}; !slices.Equal(got, want) {
+		t.Fatalf(`saved image has %v in "a", want %v`, got, want)
+	}
+}
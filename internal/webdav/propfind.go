@@ -0,0 +1,102 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// multistatus is the body of a PROPFIND response. Only the live properties
+// a file manager needs are reported, whatever the request asked for.
+type multistatus struct {
+	XMLName   xml.Name   `xml:"D:multistatus"`
+	Namespace string     `xml:"xmlns:D,attr"`
+	Responses []response `xml:"D:response"`
+}
+
+type response struct {
+	Href     string   `xml:"D:href"`
+	Propstat propstat `xml:"D:propstat"`
+}
+
+type propstat struct {
+	Prop   prop   `xml:"D:prop"`
+	Status string `xml:"D:status"`
+}
+
+type prop struct {
+	DisplayName   string       `xml:"D:displayname"`
+	ResourceType  resourceType `xml:"D:resourcetype"`
+	ContentLength *int64       `xml:"D:getcontentlength,omitempty"`
+	ContentType   string       `xml:"D:getcontenttype,omitempty"`
+	LastModified  string       `xml:"D:getlastmodified,omitempty"`
+	ETag          string       `xml:"D:getetag,omitempty"`
+}
+
+type resourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+func (h *Handler) propfind(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	// The body names the wanted properties; every request gets them all
+	io.Copy(io.Discard, r.Body)
+
+	e, err := h.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	entries := []*entry{e}
+	if e.dir {
+		switch r.Header.Get("Depth") {
+		case "0":
+		case "1":
+			children, err := h.children(name, false)
+			if err != nil {
+				return 0, err
+			}
+			entries = append(entries, children...)
+		default:
+			// Depth: infinity is cheap when every name is already in memory
+			children, err := h.children(name, true)
+			if err != nil {
+				return 0, err
+			}
+			entries = append(entries, children...)
+		}
+	}
+
+	body := multistatus{Namespace: "DAV:"}
+	for _, e := range entries {
+		body.Responses = append(body.Responses, response{
+			Href:     hrefFor(e),
+			Propstat: propstat{Prop: e.props(), Status: "HTTP/1.1 200 OK"},
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, xml.Header)
+	// Headers are gone, so a failure part way can only cut the body short
+	xml.NewEncoder(w).Encode(body)
+	return 0, nil
+}
+
+// props returns the properties reported for an entry
+func (e *entry) props() prop {
+	p := prop{DisplayName: path.Base("/" + e.name)}
+	if e.dir {
+		p.ResourceType.Collection = &struct{}{}
+		return p
+	}
+	size := e.stat.Size
+	p.ContentLength = &size
+	p.ContentType = mime.TypeByExtension(path.Ext(e.name))
+	if p.ContentType == "" {
+		p.ContentType = "application/octet-stream"
+	}
+	p.LastModified = e.stat.LastModified.UTC().Format(http.TimeFormat)
+	p.ETag = etag(e.stat)
+	return p
+}
@@ -0,0 +1,65 @@
+package webdav
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+// ReadUsers loads the users allowed to log in from a file with one
+// "name:password" line per user. A password may be given as a bcrypt hash
+// instead, as written by "htpasswd -nB name", to keep it out of the file.
+// Blank lines and lines starting with '#' are ignored.
+func ReadUsers(name string) (map[string]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(text, ":")
+		if !ok || user == "" || len(user) > filesystem.MaxUsername {
+			return nil, fmt.Errorf("%w: %s:%d: expected name:password with a name of at most %d bytes", filesystem.ErrInvalid, name, line, filesystem.MaxUsername)
+		}
+		if strings.HasPrefix(password, "sha256:") {
+			return nil, fmt.Errorf("%w: %s:%d: unsalted sha256 passwords are no longer accepted; use a bcrypt hash", filesystem.ErrInvalid, name, line)
+		}
+		if isBcrypt(password) {
+			if _, err := bcrypt.Cost([]byte(password)); err != nil {
+				return nil, fmt.Errorf("%w: %s:%d: %w", filesystem.ErrInvalid, name, line, err)
+			}
+		}
+		users[user] = password
+	}
+	return users, scanner.Err()
+}
+
+// isBcrypt reports whether a stored password is a bcrypt hash
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword compares a password with the one stored for a user, in
+// constant time for passwords stored in the clear
+func checkPassword(stored, password string) bool {
+	if stored == "" {
+		return false
+	}
+	if isBcrypt(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
@@ -0,0 +1,53 @@
+package webdav
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+)
+
+func TestReadUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "users")
+	data := "# comment\n\nalice:" + string(hash) + "\nbob:plain\n"
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ReadUsers(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "plain", true},
+		{"bob", "plai", false},
+		{"carol", "", false},
+	} {
+		if ok := checkPassword(users[c.user], c.password); ok != c.ok {
+			t.Errorf("checkPassword(%s, %q) = %v, want %v", c.user, c.password, ok, c.ok)
+		}
+	}
+
+	// Unsalted hashes and malformed bcrypt hashes are refused
+	for _, line := range []string{"carol:sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", "carol:$2a$xx"} {
+		if err := os.WriteFile(name, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadUsers(name); !errors.Is(err, filesystem.ErrInvalid) {
+			t.Errorf("ReadUsers of %q = %v, want ErrInvalid", line, err)
+		}
+	}
+}
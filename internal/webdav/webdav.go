@@ -0,0 +1,409 @@
+// Package webdav serves the files of a disk image over HTTP using the subset
+// of WebDAV (RFC 4918) that file managers need to browse and edit them:
+// OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MOVE and MKCOL.
+//
+// The file system has no directories, but file names may contain '/', so a
+// collection is every name sharing a prefix. Collections made with MKCOL
+// that do not hold any files yet only exist for the life of the Handler.
+package webdav
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/allim132/filesystem/internal/filesystem"
+	"github.com/allim132/filesystem/internal/httperr"
+)
+
+// Handler serves a file system over WebDAV
+type Handler struct {
+	fs    *filesystem.FileSystem
+	users map[string]string // Passwords by user name, see ReadUsers
+
+	mu   sync.Mutex
+	dirs map[string]bool // Empty collections made by MKCOL
+}
+
+// NewHandler returns a Handler for fs. If users is not empty, every request
+// must log in with HTTP basic authentication as one of them, and files it
+// stores are owned by that user; otherwise files are owned by the image's
+// current user. A read-only file system refuses every change.
+func NewHandler(fs *filesystem.FileSystem, users map[string]string) *Handler {
+	return &Handler{fs: fs, users: users, dirs: make(map[string]bool)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fs"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	name := cleanPath(r.URL.Path)
+	var status int
+	var err error
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MOVE, MKCOL")
+		status = http.StatusOK
+	case "PROPFIND":
+		status, err = h.propfind(w, r, name)
+	case http.MethodGet, http.MethodHead:
+		status, err = h.get(w, r, name)
+	case http.MethodPut:
+		status, err = h.put(r, name, user)
+	case http.MethodDelete:
+		status, err = h.delete(name)
+	case "MOVE":
+		status, err = h.move(r, name)
+	case "MKCOL":
+		status, err = h.mkcol(r, name)
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+
+	if err != nil {
+		status = httperr.Status(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+}
+
+// authenticate checks the request's credentials and returns the user
+func (h *Handler) authenticate(r *http.Request) (string, bool) {
+	if len(h.users) == 0 {
+		return "", true
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || !checkPassword(h.users[user], password) {
+		return "", false
+	}
+	return user, true
+}
+
+// cleanPath turns a URL path into a file name, "" being the root collection
+func cleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// entry is a file or collection found by lookup
+type entry struct {
+	name  string
+	dir   bool
+	stat  filesystem.FileStat // Only set for files
+	files []string            // Every file below a collection
+}
+
+// lookup finds the file or collection called name
+func (h *Handler) lookup(name string) (*entry, error) {
+	stats, err := filesystem.FilesFS(h.fs)
+	if err != nil {
+		return nil, err
+	}
+	dir := &entry{name: name, dir: true}
+	for _, st := range stats {
+		if st.Name == name {
+			return &entry{name: name, stat: st}, nil
+		}
+		if name == "" || strings.HasPrefix(st.Name, name+"/") {
+			dir.files = append(dir.files, st.Name)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if name == "" || len(dir.files) > 0 || h.dirs[name] {
+		return dir, nil
+	}
+	return nil, fmt.Errorf("%s: %w", name, filesystem.ErrNotExist)
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	e, err := h.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if e.dir {
+		children, err := h.children(name, false)
+		if err != nil {
+			return 0, err
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Method == http.MethodHead {
+			return http.StatusOK, nil
+		}
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<title>/%s</title>\n<ul>\n", html.EscapeString(name))
+		for _, child := range children {
+			href := hrefFor(child)
+			label := path.Base(child.name)
+			if child.dir {
+				label += "/"
+			}
+			fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(label))
+		}
+		fmt.Fprintln(w, "</ul>")
+		return 0, nil
+	}
+
+	header := w.Header()
+	header.Set("Content-Length", fmt.Sprint(e.stat.Size))
+	header.Set("Last-Modified", e.stat.LastModified.UTC().Format(http.TimeFormat))
+	header.Set("ETag", etag(e.stat))
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		header.Set("Content-Type", ctype)
+	} else {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	if r.Method == http.MethodHead {
+		return http.StatusOK, nil
+	}
+	w.WriteHeader(http.StatusOK)
+	// Headers are gone, so a failure part way can only cut the body short
+	filesystem.GetWriterFS(h.fs, name, w)
+	return 0, nil
+}
+
+func (h *Handler) put(r *http.Request, name, user string) (int, error) {
+	if name == "" {
+		return http.StatusMethodNotAllowed, nil
+	}
+	e, err := h.lookup(name)
+	if err == nil && e.dir {
+		return http.StatusMethodNotAllowed, nil
+	}
+	// A file can only be stored in a collection that exists (RFC 4918 9.7.1)
+	if parent := path.Dir(name); parent != "." {
+		p, err := h.lookup(parent)
+		if err != nil || !p.dir {
+			return http.StatusConflict, nil
+		}
+	}
+	outcome, err := filesystem.PutReaderFS(h.fs, r.Body, filesystem.PutOptions{
+		Name:       name,
+		Mode:       filesystem.PutOverwrite,
+		Owner:      user,
+		AllowEmpty: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if outcome == filesystem.PutReplaced {
+		return http.StatusNoContent, nil
+	}
+	return http.StatusCreated, nil
+}
+
+func (h *Handler) delete(name string) (int, error) {
+	if name == "" {
+		return http.StatusForbidden, nil
+	}
+	e, err := h.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	// A collection is removed in one transaction, so that it goes entirely
+	// or not at all
+	tx, err := h.fs.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range e.filesToMove() {
+		if err := tx.Remove(file); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	h.forgetDirs(name)
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) move(r *http.Request, name string) (int, error) {
+	if name == "" {
+		return http.StatusForbidden, nil
+	}
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		return http.StatusBadRequest, nil
+	}
+	target := cleanPath(dest.Path)
+	if target == "" || target == name || strings.HasPrefix(target, name+"/") {
+		return http.StatusForbidden, nil
+	}
+
+	e, err := h.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	existing, err := h.lookup(target)
+	status := http.StatusCreated
+	if err == nil {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, nil
+		}
+		status = http.StatusNoContent
+	}
+
+	// Replace the target and rename everything in one transaction, so that
+	// a failure part way leaves both the source and the target as they were
+	tx, err := h.fs.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if existing != nil {
+		for _, file := range existing.filesToMove() {
+			if err := tx.Remove(file); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+	}
+	for _, file := range e.filesToMove() {
+		if err := tx.Rename(file, target+strings.TrimPrefix(file, name)); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if e.dir {
+		h.mu.Lock()
+		for dir := range h.dirs {
+			if dir == name || strings.HasPrefix(dir, name+"/") {
+				delete(h.dirs, dir)
+				h.dirs[target+strings.TrimPrefix(dir, name)] = true
+			}
+		}
+		h.mu.Unlock()
+	}
+	return status, nil
+}
+
+func (h *Handler) mkcol(r *http.Request, name string) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	}
+	if _, err := h.lookup(name); err == nil {
+		return http.StatusMethodNotAllowed, nil
+	}
+	if parent := path.Dir(name); parent != "." {
+		e, err := h.lookup(parent)
+		if err != nil || !e.dir {
+			return http.StatusConflict, nil
+		}
+	}
+	if h.fs.ReadOnly() {
+		return 0, filesystem.ErrReadOnly
+	}
+
+	h.mu.Lock()
+	h.dirs[name] = true
+	h.mu.Unlock()
+	return http.StatusCreated, nil
+}
+
+// filesToMove returns the files a delete or move of the entry affects
+func (e *entry) filesToMove() []string {
+	if e.dir {
+		return e.files
+	}
+	return []string{e.name}
+}
+
+// forgetDirs drops the empty collections at or below name
+func (h *Handler) forgetDirs(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for dir := range h.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(h.dirs, dir)
+		}
+	}
+}
+
+// children returns the entries directly inside the collection name, or every
+// entry below it if deep is set, sorted by name
+func (h *Handler) children(name string, deep bool) ([]*entry, error) {
+	stats, err := filesystem.FilesFS(h.fs)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+
+	found := make(map[string]*entry)
+	addDirs := func(rel string) {
+		// Every collection between name and rel
+		parts := strings.Split(rel, "/")
+		for i := 1; i <= len(parts); i++ {
+			if !deep && i > 1 {
+				break
+			}
+			dir := prefix + strings.Join(parts[:i], "/")
+			if found[dir] == nil {
+				found[dir] = &entry{name: dir, dir: true}
+			}
+		}
+	}
+	for _, st := range stats {
+		rel, ok := strings.CutPrefix(st.Name, prefix)
+		if !ok {
+			continue
+		}
+		if dir := path.Dir(rel); dir != "." {
+			addDirs(dir)
+			if !deep {
+				continue
+			}
+		}
+		found[st.Name] = &entry{name: st.Name, stat: st}
+	}
+	h.mu.Lock()
+	for dir := range h.dirs {
+		if rel, ok := strings.CutPrefix(dir, prefix); ok {
+			addDirs(rel)
+		}
+	}
+	h.mu.Unlock()
+
+	entries := make([]*entry, 0, len(found))
+	for _, e := range found {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// hrefFor returns the escaped URL path of an entry
+func hrefFor(e *entry) string {
+	href := (&url.URL{Path: "/" + e.name}).EscapedPath()
+	if e.dir && e.name != "" {
+		href += "/"
+	}
+	return href
+}
+
+// etag identifies a version of a file by its time stamp and size
+func etag(st filesystem.FileStat) string {
+	return fmt.Sprintf(`"%x-%x"`, st.LastModified.Unix(), st.Size)
+}